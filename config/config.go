@@ -3,9 +3,17 @@ package config
 import (
 	"cloud.google.com/go/logging"
 	"context"
+	"github.com/j-leg/tracula/internal/archive"
+	"github.com/j-leg/tracula/internal/db"
+	"github.com/j-leg/tracula/internal/stats"
 	"go.mongodb.org/mongo-driver/mongo"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type loggers struct {
@@ -17,33 +25,182 @@ type loggers struct {
 // Collections struct containing MongoDB collections to be used
 type Collections struct {
 	Stats      *mongo.Collection
+	Samples    *mongo.Collection // Daily samples, see CreateSamplesCollection
 	Exceptions *mongo.Collection
 	TrackPool  *mongo.Collection
+	State      *mongo.Collection // Job state such as sync watermarks, optional
+	JobRuns    *mongo.Collection // Job run history, optional
+}
+
+const (
+	METADATATTL    = 7   // Default number of days app metadata is kept
+	WRITEBATCHSIZE = 500 // Default number of app writes the executor flushes at once
+	RESUMEWINDOW   = 20  // Default number of hours an unfinished job run is resumed for
+	LEASETTL       = 5   // Default number of minutes a job lease lasts between renewals
+)
+
+// Concurrency bounds for the adaptive job executor
+type Concurrency struct {
+	Initial      int           // Number of atomics in flight at the start of a job
+	Min          int           // Floor when backing off
+	Max          int           // Ceiling when ramping up, the executor runs this many workers
+	BatchLatency time.Duration // Windows of completions slower than this are treated as unhealthy
+	TaskTimeout  time.Duration // Atomics running longer are cancelled
+	GracePeriod  time.Duration // Atomics in flight when a job is stopped have this long to finish
+}
+
+// DefaultConcurrency returns the executor bounds used by InitConfig
+func DefaultConcurrency() Concurrency {
+	return Concurrency{
+		Initial:      20,
+		Min:          5,
+		Max:          100,
+		BatchLatency: 10 * time.Second,
+		TaskTimeout:  2 * time.Minute,
+		GracePeriod:  30 * time.Second,
+	}
+}
+
+// Retry policy for fetches failing with a retryable error, transient or
+// rate limited. Retries back off exponentially with jitter and never outlast
+// the atomic's TaskTimeout.
+type Retry struct {
+	Attempts  int           // Attempts per fetch including the first, 1 disables retries
+	BaseDelay time.Duration // Delay before the first retry, doubled on each one
+	MaxDelay  time.Duration // Ceiling on the delay
+	Jitter    float64       // Fraction of each delay drawn at random, from 0 to 1
+}
+
+// DefaultRetry returns the retry policy used by InitConfig
+func DefaultRetry() Retry {
+	return Retry{
+		Attempts:  3,
+		BaseDelay: time.Second,
+		MaxDelay:  20 * time.Second,
+		Jitter:    0.5,
+	}
 }
 
 // Config for execution
 type Config struct {
 	Ctx          context.Context
 	Col          *Collections
+	Store        db.Store
 	Trace        *loggers
 	LoggerClient *logging.Client
 	LocalEnabled bool
+	Concurrency  Concurrency
+	Fetch        *stats.Options
+	Retry        Retry
+	MetadataTTL  time.Duration // How long app metadata is kept before the enrich job refreshes it
+	WriteBatch   int           // Number of app writes the executor queues before flushing them in bulk
+	Archive      archive.Sink  // Samples past the retention limit are archived here before being dropped, nil drops them outright
+	Trigger      string        // Recorded on job reports, such as the scheduler or user that started the job
+	Owner        string        // Identifies the invocation holding a job's lease, unique per invocation by default
+	LeaseTTL     time.Duration // A job's lease expires unless renewed within this, letting another invocation take over
+	ResumeWindow time.Duration // Invocations resume a job's unfinished run started within this window, later ones start a new run
+	Shard        db.Shard      // Runs the job over one shard of the apps, the zero value runs it over every app. Every shard of a run must use the same count, other layouts wait for its last shard to finish.
+	RunID        string        // Identifies a new run, set the same on every shard to aggregate their reports, unique by default
+	DryRun       bool          // Jobs fetch and compute as usual but write nothing, their reports carry the diff they would have written
+
+	// Closing Stop stops the running job, the atomics in flight get
+	// Concurrency.GracePeriod to finish. StopOnSignals closes it on SIGTERM
+	// and SIGINT, cancelling Ctx instead aborts the job at once.
+	Stop <-chan struct{}
 }
 
-// InitConfig - initialise config struct
+// CreateSamplesCollection creates the time-series collection for daily samples,
+// or returns it if it already exists. Samples expire after retentionDays, zero
+// keeps them until the monthly job purges them. Leave it zero when archiving,
+// samples the server expires are never archived.
+func CreateSamplesCollection(ctx context.Context, database *mongo.Database, name string, retentionDays int) (*mongo.Collection, error) {
+	return db.CreateSamplesCollection(ctx, database, name, time.Duration(retentionDays)*24*time.Hour)
+}
+
+// StopOnSignals returns a channel for Config.Stop closed on the first of the
+// signals, SIGTERM and SIGINT if none are given. The signals are only caught
+// once, a second one has its default effect, such as ending the process.
+// Call release once the job is over to stop catching them.
+func StopOnSignals(signals ...os.Signal) (stop <-chan struct{}, release func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+	}
+	caught := make(chan os.Signal, 1)
+	signal.Notify(caught, signals...)
+
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-caught:
+			close(stopCh)
+		case <-done:
+		}
+		signal.Stop(caught)
+	}()
+
+	var once sync.Once
+	return stopCh, func() { once.Do(func() { close(done) }) }
+}
+
+// InitConfig - initialise config struct backed by MongoDB collections
 func InitConfig(ctx context.Context, cols *Collections) *Config {
 	newLoggers, loggerClient := initCloudLoggers(ctx)
 	newConfig := Config{
 		Ctx:          ctx,
 		Col:          cols,
+		Store:        db.NewMongoStore(cols.Stats, cols.Samples, cols.Exceptions, cols.State, cols.JobRuns),
 		Trace:        newLoggers,
 		LoggerClient: loggerClient,
 		LocalEnabled: false,
+		Concurrency:  DefaultConcurrency(),
+		Fetch:        stats.DefaultOptions(),
+		Retry:        DefaultRetry(),
+		MetadataTTL:  METADATATTL * 24 * time.Hour,
+		WriteBatch:   WRITEBATCHSIZE,
+		ResumeWindow: RESUMEWINDOW * time.Hour,
+		LeaseTTL:     LEASETTL * time.Minute,
 	}
 
 	return &newConfig
 }
 
+// InitSQLiteConfig - initialise config struct backed by the SQLite database
+// at path, logging to stdout and stderr instead of Cloud Logging. The SQLite
+// driver needs cgo, builds tagged nosqlite leave it out.
+func InitSQLiteConfig(ctx context.Context, path string) (*Config, error) {
+	store, err := db.OpenSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	newConfig := Config{
+		Ctx:          ctx,
+		Store:        store,
+		Trace:        NewStdLoggers(os.Stdout, os.Stderr),
+		LocalEnabled: false,
+		Concurrency:  DefaultConcurrency(),
+		Fetch:        stats.DefaultOptions(),
+		Retry:        DefaultRetry(),
+		MetadataTTL:  METADATATTL * 24 * time.Hour,
+		WriteBatch:   WRITEBATCHSIZE,
+		ResumeWindow: RESUMEWINDOW * time.Hour,
+		LeaseTTL:     LEASETTL * time.Minute,
+	}
+
+	return &newConfig, nil
+}
+
+// NewStdLoggers returns loggers writing info and debug to out, errors to errOut
+func NewStdLoggers(out io.Writer, errOut io.Writer) *loggers {
+	flags := log.LstdFlags | log.LUTC
+	return &loggers{
+		Info:  log.New(out, "INFO ", flags),
+		Debug: log.New(out, "DEBUG ", flags),
+		Error: log.New(errOut, "ERROR ", flags),
+	}
+}
+
 func initCloudLoggers(ctx context.Context) (*loggers, *logging.Client) {
 	projectID := os.Getenv("PROJ_ID")
 
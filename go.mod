@@ -8,9 +8,11 @@ require (
 	github.com/PuerkitoBio/goquery v1.5.1
 	github.com/cheggaaa/pb/v3 v3.0.4
 	github.com/golang/protobuf v1.4.1 // indirect
+	github.com/mattn/go-sqlite3 v1.14.6
 	go.mongodb.org/mongo-driver v1.3.1
 	golang.org/x/net v0.0.0-20200506145744-7e3656a0809f // indirect
 	golang.org/x/sys v0.0.0-20200508214444-3aab700007d7 // indirect
+	golang.org/x/time v0.0.0-20220210224613-90d013bbcef8
 	google.golang.org/api v0.23.0 // indirect
 	google.golang.org/genproto v0.0.0-20200507105951-43844f6eee31 // indirect
 )
@@ -0,0 +1,128 @@
+// Package archive keeps daily samples that leave the store as gzipped JSONL
+// files, partitioned by domain and month, and reads them back
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path"
+	"sort"
+	"time"
+)
+
+// Archive file layout
+const (
+	EXTENSION   = ".jsonl.gz"
+	MONTHLAYOUT = "2006-01"
+	RUNLAYOUT   = "20060102T150405Z"
+)
+
+// Sink stores archive files under slash separated paths. Implement it to
+// archive to an object store, NewDir archives to a local directory.
+type Sink interface {
+	// Create returns a writer for a new file, the file must not be visible
+	// under its path until the writer is closed
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	// List returns the paths of the archive files under prefix in order, a
+	// missing prefix is not an error
+	List(prefix string) ([]string, error)
+}
+
+// Record is an archived sample, one per line
+type Record struct {
+	Domain      string    `json:"domain"`
+	AppID       int       `json:"app_id"`
+	Date        time.Time `json:"date"`
+	PlayerCount int       `json:"count"`
+}
+
+// Partition returns the path holding the domain's samples for the month
+// containing date
+func Partition(domain string, date time.Time) string {
+	return path.Join(domain, date.UTC().Format(MONTHLAYOUT))
+}
+
+type partitionFile struct {
+	out     io.WriteCloser
+	gz      *gzip.Writer
+	encoder *json.Encoder
+}
+
+// Writer writes records to one file per partition, named after the run so
+// successive runs never overwrite each other
+type Writer struct {
+	sink  Sink
+	name  string
+	files map[string]*partitionFile
+}
+
+// NewWriter returns a writer naming its files after runAt
+func NewWriter(sink Sink, runAt time.Time) *Writer {
+	return &Writer{
+		sink:  sink,
+		name:  runAt.UTC().Format(RUNLAYOUT) + EXTENSION,
+		files: make(map[string]*partitionFile),
+	}
+}
+
+// Write appends the record to its partition's file, creating it on first use
+func (w *Writer) Write(record Record) error {
+	partition := Partition(record.Domain, record.Date)
+	file, ok := w.files[partition]
+	if !ok {
+		out, err := w.sink.Create(path.Join(partition, w.name))
+		if err != nil {
+			return err
+		}
+		gz := gzip.NewWriter(out)
+		file = &partitionFile{out: out, gz: gz, encoder: json.NewEncoder(gz)}
+		w.files[partition] = file
+	}
+	return file.encoder.Encode(record)
+}
+
+// Close flushes and closes every file, returning the paths written. Every
+// file is closed even if one fails, the first error is returned.
+func (w *Writer) Close() ([]string, error) {
+	var firstErr error
+	names := make([]string, 0, len(w.files))
+	for partition, file := range w.files {
+		err := file.gz.Close()
+		if closeErr := file.out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		names = append(names, path.Join(partition, w.name))
+	}
+	sort.Strings(names)
+	w.files = make(map[string]*partitionFile)
+	return names, firstErr
+}
+
+// Read calls fn with every record of an archive file, stopping at the first error
+func Read(r io.Reader, fn func(Record) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	decoder := json.NewDecoder(gz)
+	for {
+		var record Record
+		err = decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package archive
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type dirSink struct {
+	root string
+}
+
+// NewDir returns a sink keeping archive files under the root directory
+func NewDir(root string) Sink {
+	return &dirSink{root: root}
+}
+
+// dirFile is written under a temporary name and renamed into place on close
+type dirFile struct {
+	*os.File
+	target string
+}
+
+func (f *dirFile) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.target)
+}
+
+func (d *dirSink) Create(name string) (io.WriteCloser, error) {
+	target := filepath.Join(d.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+"-")
+	if err != nil {
+		return nil, err
+	}
+	return &dirFile{File: file, target: target}, nil
+}
+
+func (d *dirSink) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.root, filepath.FromSlash(name)))
+}
+
+func (d *dirSink) List(prefix string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(filepath.Join(d.root, filepath.FromSlash(prefix)), func(name string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(name, EXTENSION) || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, name)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	return names, err
+}
@@ -0,0 +1,191 @@
+package backfill
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported import formats
+const (
+	CSV  = "csv"
+	JSON = "json"
+)
+
+// Record is a single historical data point. A record carries a sample
+// (PlayerCount), the figures of the month containing Date (AvgPlayers, Peak),
+// or both.
+type Record struct {
+	Domain      string    `json:"domain"`
+	AppID       int       `json:"app_id"`
+	Date        time.Time `json:"-"`
+	Timestamp   string    `json:"timestamp"`
+	PlayerCount *int      `json:"count"`
+	AvgPlayers  *int      `json:"avg_players"`
+	Peak        *int      `json:"peak"`
+}
+
+// Accepted timestamp layouts, unix seconds are accepted as well
+var layouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// Read parses records of the given format
+func Read(r io.Reader, format string) ([]Record, error) {
+	switch strings.ToLower(format) {
+	case CSV:
+		return ReadCSV(r)
+	case JSON:
+		return ReadJSON(r)
+	default:
+		return nil, fmt.Errorf("Unknown import format: %s", format)
+	}
+}
+
+// ReadCSV parses records from CSV with a header row naming the columns:
+// domain, app_id, timestamp and at least one of count, avg_players, peak
+func ReadCSV(r io.Reader) ([]Record, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for idx, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = idx
+	}
+	for _, name := range []string{"domain", "app_id", "timestamp"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column: %s", name)
+		}
+	}
+
+	var records []Record
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+
+		field := func(name string) string {
+			idx, ok := columns[name]
+			if !ok || idx >= len(row) {
+				return ""
+			}
+			return strings.TrimSpace(row[idx])
+		}
+
+		record := Record{Domain: field("domain"), Timestamp: field("timestamp")}
+		if record.AppID, err = strconv.Atoi(field("app_id")); err != nil {
+			return records, fmt.Errorf("line %d: invalid app_id: %s", line, err)
+		}
+		if record.PlayerCount, err = optionalInt(field("count")); err != nil {
+			return records, fmt.Errorf("line %d: invalid count: %s", line, err)
+		}
+		if record.AvgPlayers, err = optionalInt(field("avg_players")); err != nil {
+			return records, fmt.Errorf("line %d: invalid avg_players: %s", line, err)
+		}
+		if record.Peak, err = optionalInt(field("peak")); err != nil {
+			return records, fmt.Errorf("line %d: invalid peak: %s", line, err)
+		}
+		if err = record.validate(); err != nil {
+			return records, fmt.Errorf("line %d: %s", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// ReadJSON parses records from a JSON array of objects using the same
+// field names as the CSV columns
+func ReadJSON(r io.Reader) ([]Record, error) {
+	decoder := json.NewDecoder(r)
+	if _, err := decoder.Token(); err != nil { // Opening bracket
+		return nil, err
+	}
+
+	var records []Record
+	for idx := 0; decoder.More(); idx++ {
+		var record Record
+		if err := decoder.Decode(&record); err != nil {
+			return records, fmt.Errorf("element %d: %s", idx, err)
+		}
+		if err := record.validate(); err != nil {
+			return records, fmt.Errorf("element %d: %s", idx, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// UnmarshalJSON accepts the timestamp as a string or as a number of unix seconds
+func (r *Record) UnmarshalJSON(data []byte) error {
+	type plainRecord Record
+	aux := struct {
+		*plainRecord
+		Timestamp json.RawMessage `json:"timestamp"`
+	}{plainRecord: (*plainRecord)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	r.Timestamp = ""
+	if len(aux.Timestamp) == 0 || string(aux.Timestamp) == "null" {
+		return nil
+	}
+	if aux.Timestamp[0] == '"' {
+		return json.Unmarshal(aux.Timestamp, &r.Timestamp)
+	}
+	var seconds json.Number
+	if err := json.Unmarshal(aux.Timestamp, &seconds); err != nil {
+		return fmt.Errorf("invalid timestamp: %s", aux.Timestamp)
+	}
+	r.Timestamp = seconds.String()
+	return nil
+}
+
+func (r *Record) validate() error {
+	if r.Domain == "" {
+		return fmt.Errorf("missing domain")
+	}
+	if r.PlayerCount == nil && r.AvgPlayers == nil && r.Peak == nil {
+		return fmt.Errorf("record has no count, avg_players or peak")
+	}
+
+	date, err := parseTimestamp(r.Timestamp)
+	if err != nil {
+		return err
+	}
+	r.Date = date
+	return nil
+}
+
+func parseTimestamp(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	for _, layout := range layouts {
+		if date, err := time.Parse(layout, value); err == nil {
+			return date.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp: %q", value)
+}
+
+func optionalInt(value string) (*int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	res, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,55 @@
+package backfill
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCSV(t *testing.T) {
+	input := `domain,app_id,timestamp,count,avg_players,peak
+steam,730,2020-01-15,500000,,
+steam,730,2020-01-01T00:00:00Z,,450000,800000
+osrs,939,1578873600,100000,,
+`
+	records, err := Read(strings.NewReader(input), CSV)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("[FAIL] TestReadCSV: %d records, %v\n", len(records), err)
+	}
+	if *records[0].PlayerCount != 500000 || records[0].AvgPlayers != nil {
+		t.Errorf("[FAIL] TestReadCSV: unexpected sample %+v\n", records[0])
+	}
+	if records[1].PlayerCount != nil || *records[1].AvgPlayers != 450000 || *records[1].Peak != 800000 {
+		t.Errorf("[FAIL] TestReadCSV: unexpected monthly record %+v\n", records[1])
+	}
+	if !records[2].Date.Equal(time.Date(2020, time.January, 13, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("[FAIL] TestReadCSV: unexpected unix timestamp %s\n", records[2].Date)
+	}
+
+	_, err = Read(strings.NewReader("domain,app_id,timestamp,count\nsteam,730,2020-01-15,\n"), CSV)
+	if err == nil {
+		t.Errorf("[FAIL] TestReadCSV: empty record accepted\n")
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	input := `[
+		{"domain": "steam", "app_id": 730, "timestamp": "2020-01-15", "count": 500000},
+		{"domain": "steam", "app_id": 730, "timestamp": "2020-01-01", "avg_players": 450000},
+		{"domain": "steam", "app_id": 730, "timestamp": 1577836800, "count": 400000}
+	]`
+	records, err := Read(strings.NewReader(input), JSON)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("[FAIL] TestReadJSON: %d records, %v\n", len(records), err)
+	}
+	if records[1].Date.Day() != 1 || *records[1].AvgPlayers != 450000 {
+		t.Errorf("[FAIL] TestReadJSON: unexpected record %+v\n", records[1])
+	}
+	if !records[2].Date.Equal(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("[FAIL] TestReadJSON: unexpected unix timestamp %+v\n", records[2])
+	}
+
+	if _, err = Read(strings.NewReader(input), "xml"); err == nil {
+		t.Errorf("[FAIL] TestReadJSON: unknown format accepted\n")
+	}
+}
@@ -0,0 +1,184 @@
+package core
+
+import (
+  "errors"
+  "fmt"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/archive"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+// ArchiveReport summarises a cold archive run
+type ArchiveReport struct {
+  Samples    int      // Samples written to the archive
+  Duplicates int      // Samples already archived, such as restored ones, dropped without being written again
+  Purged     int      // Samples dropped from the store
+  Files   []string // Archive files written
+}
+
+// RestoreReport summarises the re-import of an archived partition
+type RestoreReport struct {
+  Files       int // Archive files read
+  Apps        int // Apps updated
+  Samples     int // Samples added
+  Duplicates  int // Samples skipped as the app already had one that day
+  UnknownApps []string
+  Errors      []string
+}
+
+// archiveSamples writes the samples dated before the cutoff to the archive
+// then drops them from the store. Nothing is dropped unless every file was
+// written, the samples are archived again by the next run instead. Days the
+// archive already holds, restored with RestoreArchive, are dropped without
+// being written again. A dry run counts the samples and writes nothing.
+func archiveSamples(cfg *config.Config, before time.Time) (*ArchiveReport, error) {
+  report := ArchiveReport{}
+  archived := archivedDays{sink: cfg.Archive, partitions: make(map[string]map[archivedDay]bool)}
+  var writer *archive.Writer
+  if !cfg.DryRun { writer = archive.NewWriter(cfg.Archive, time.Now()) }
+
+  err := cfg.Store.IterateSamplesBefore(cfg.Ctx, before, func(key db.AppKey, sample db.DailyMetric) error {
+    record := archive.Record{Domain: key.Domain, AppID: key.AppID, Date: sample.Date, PlayerCount: sample.PlayerCount}
+    found, err := archived.contains(record)
+    if err != nil { return err }
+    if found {
+      report.Duplicates++
+      return nil
+    }
+    report.Samples++
+    if writer == nil { return nil }
+    return writer.Write(record)
+  })
+  if cfg.DryRun {
+    report.Purged = report.Samples + report.Duplicates
+    return &report, err
+  }
+  files, closeErr := writer.Close()
+  report.Files = files
+  if err == nil { err = closeErr }
+  if err != nil { return &report, err }
+
+  report.Purged, err = cfg.Store.PurgeSamplesBefore(cfg.Ctx, before)
+  return &report, err
+}
+
+type archivedDay struct {
+  appID int
+  day   time.Time
+}
+
+// archivedDays reads the days held by each partition of the archive on first
+// use, the files written by the current run are not visible until closed
+type archivedDays struct {
+  sink       archive.Sink
+  partitions map[string]map[archivedDay]bool
+}
+
+func (a *archivedDays) contains(record archive.Record) (bool, error) {
+  partition := archive.Partition(record.Domain, record.Date)
+  days, ok := a.partitions[partition]
+  if !ok {
+    days = make(map[archivedDay]bool)
+    files, err := a.sink.List(partition)
+    if err != nil { return false, err }
+    for _, name := range files {
+      file, err := a.sink.Open(name)
+      if err != nil { return false, err }
+      err = archive.Read(file, func(archived archive.Record) error {
+        days[archivedDay{archived.AppID, truncateDay(archived.Date)}] = true
+        return nil
+      })
+      file.Close()
+      if err != nil { return false, fmt.Errorf("%s: %w", name, err) }
+    }
+    a.partitions[partition] = days
+  }
+  return days[archivedDay{record.AppID, truncateDay(record.Date)}], nil
+}
+
+// archiveExpired archives the samples past RETENTIONLIMIT, a failure is
+// logged and leaves the samples in the store
+func archiveExpired(cfg *config.Config) *ArchiveReport {
+  before := time.Now().UTC().Add(-RETENTIONLIMIT * HOURSPERDAY * time.Hour)
+  report, err := archiveSamples(cfg, before)
+  if err != nil {
+    cfg.Trace.Error.Printf("error archiving samples before %s, they are kept until the next run %s", before.Format(DATEPATTERN), err)
+    return nil
+  }
+  cfg.Trace.Info.Printf("archive execution REPORT:\n    samples: %d\n    duplicates: %d\n    purged: %d\n    files: %d",
+    report.Samples, report.Duplicates, report.Purged, len(report.Files))
+  return report
+}
+
+// RestoreArchive re-imports the samples archived for the domain in the month
+// containing month. Days the app already has a sample for are skipped, so
+// restoring twice or from overlapping runs does not duplicate samples.
+func RestoreArchive(cfg *config.Config, domain string, month time.Time) (*RestoreReport, error) {
+  if cfg.Archive == nil { return nil, errors.New("no archive configured") }
+
+  files, err := cfg.Archive.List(archive.Partition(domain, month))
+  if err != nil { return nil, err }
+
+  report := RestoreReport{Files: len(files)}
+  groups := make(map[db.AppKey][]db.DailyMetric)
+  var keys []db.AppKey
+  for _, name := range files {
+    file, err := cfg.Archive.Open(name)
+    if err != nil { return &report, err }
+
+    err = archive.Read(file, func(record archive.Record) error {
+      key := db.AppKey{Domain: record.Domain, AppID: record.AppID}
+      if _, ok := groups[key]; !ok { keys = append(keys, key) }
+      groups[key] = append(groups[key], db.DailyMetric{Date: record.Date, PlayerCount: record.PlayerCount})
+      return nil
+    })
+    file.Close()
+    if err != nil { return &report, fmt.Errorf("%s: %w", name, err) }
+  }
+
+  month = month.UTC()
+  monthStart := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+  monthEnd := monthStart.AddDate(0, 1, 0)
+  for _, key := range keys {
+    app, err := cfg.Store.FindApp(cfg.Ctx, key.Domain, key.AppID)
+    if err == db.ErrNotFound {
+      report.UnknownApps = append(report.UnknownApps, fmt.Sprintf("%s:%d", key.Domain, key.AppID))
+      continue
+    }
+    if err == nil { err = restoreSamples(cfg, app, groups[key], monthStart, monthEnd, &report) }
+    if err != nil {
+      report.Errors = append(report.Errors, fmt.Sprintf("%s:%d - %s", key.Domain, key.AppID, err))
+      continue
+    }
+    report.Apps++
+  }
+
+  cfg.Trace.Info.Printf("restore execution REPORT:\n    files: %d\n    apps: %d\n    samples: %d\n    duplicates: %d\n    unknown: %d\n    errors: %d",
+    report.Files, report.Apps, report.Samples, report.Duplicates, len(report.UnknownApps), len(report.Errors))
+  return &report, nil
+}
+
+func restoreSamples(cfg *config.Config, app *db.App, samples []db.DailyMetric, monthStart time.Time, monthEnd time.Time, report *RestoreReport) error {
+  existing, err := cfg.Store.GetDailyMetrics(cfg.Ctx, app.ID, monthStart, monthEnd)
+  if err != nil { return err }
+
+  days := make(map[time.Time]bool, len(existing))
+  for _, sample := range existing { days[truncateDay(sample.Date)] = true }
+
+  added := make([]db.DailyMetric, 0, len(samples))
+  for _, sample := range samples {
+    day := truncateDay(sample.Date)
+    if days[day] {
+      report.Duplicates++
+      continue
+    }
+    days[day] = true
+    added = append(added, sample)
+  }
+  sortDates(added)
+
+  if err = cfg.Store.InsertDailyMetrics(cfg.Ctx, app.ID, added); err != nil { return err }
+  report.Samples += len(added)
+  return nil
+}
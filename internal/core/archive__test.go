@@ -0,0 +1,60 @@
+package core
+
+import (
+  "context"
+  "path/filepath"
+  "testing"
+  "time"
+  "github.com/j-leg/tracula/internal/archive"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+func TestArchiveRestore(t *testing.T) {
+  cfg, dir, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+  cfg.Archive = archive.NewDir(filepath.Join(dir, "archive"))
+
+  app := db.App{StaticData: db.StaticAppData{Name: "Dota 2", AppID: 570, Domain: "steam"}}
+  if err := cfg.Store.InsertApp(cfg.Ctx, &app); err != nil { t.Fatal(err) }
+  now := time.Now().UTC().Truncate(time.Second)
+  samples := []db.DailyMetric{
+    {Date: time.Date(2020, time.January, 5, 0, 0, 0, 0, time.UTC), PlayerCount: 100},
+    {Date: time.Date(2020, time.January, 6, 0, 0, 0, 0, time.UTC), PlayerCount: 200},
+    {Date: now, PlayerCount: 300},
+  }
+  if err := cfg.Store.InsertDailyMetrics(cfg.Ctx, app.ID, samples); err != nil { t.Fatal(err) }
+
+  report, err := archiveSamples(cfg, now.AddDate(0, 0, -RETENTIONLIMIT))
+  if err != nil { t.Fatal(err) }
+  if report.Samples != 2 || report.Purged != 2 || len(report.Files) != 1 || filepath.Dir(report.Files[0]) != "steam/2020-01" {
+    t.Errorf("[FAIL] TestArchiveRestore: unexpected archive report %+v\n", report)
+  }
+  remaining, err := cfg.Store.GetDailyMetrics(cfg.Ctx, app.ID, time.Time{}, time.Time{})
+  if err != nil || len(remaining) != 1 {
+    t.Errorf("[FAIL] TestArchiveRestore: expected 1 sample left, got %d %v\n", len(remaining), err)
+  }
+
+  restored, err := RestoreArchive(cfg, "steam", samples[0].Date)
+  if err != nil { t.Fatal(err) }
+  if restored.Files != 1 || restored.Apps != 1 || restored.Samples != 2 || restored.Duplicates != 0 {
+    t.Errorf("[FAIL] TestArchiveRestore: unexpected restore report %+v\n", restored)
+  }
+
+  // Restoring again adds nothing
+  restored, err = RestoreArchive(cfg, "steam", samples[0].Date)
+  if err != nil { t.Fatal(err) }
+  if restored.Samples != 0 || restored.Duplicates != 2 {
+    t.Errorf("[FAIL] TestArchiveRestore: unexpected second restore report %+v\n", restored)
+  }
+
+  // Archiving the restored samples again drops them without a second copy
+  report, err = archiveSamples(cfg, now.AddDate(0, 0, -RETENTIONLIMIT))
+  if err != nil { t.Fatal(err) }
+  if report.Samples != 0 || report.Duplicates != 2 || report.Purged != 2 || len(report.Files) != 0 {
+    t.Errorf("[FAIL] TestArchiveRestore: unexpected report archiving restored samples %+v\n", report)
+  }
+  files, err := cfg.Archive.List(archive.Partition("steam", samples[0].Date))
+  if err != nil || len(files) != 1 {
+    t.Errorf("[FAIL] TestArchiveRestore: expected a single archive file, got %v %v\n", files, err)
+  }
+}
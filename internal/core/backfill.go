@@ -0,0 +1,201 @@
+package core
+
+import (
+  "fmt"
+  "sort"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/backfill"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+// ImportReport summarises a historical import
+type ImportReport struct {
+  Apps        int      // Apps updated
+  Samples     int      // Samples added
+  Duplicates  int      // Samples skipped as the app already had one that day
+  Expired     int      // Samples older than RETENTIONLIMIT, only used for monthly metrics
+  Metrics     int      // Monthly metrics computed for months without one
+  Overwritten int      // Stored monthly metrics replaced by explicit figures
+  UnknownApps []string // Apps missing from the library, run Refresh before importing
+  Errors      []string
+}
+
+// Backfill merges historical records into the library. Samples are added
+// without duplicating days. Months the records touch get a metric computed
+// from their samples if they have none, a stored metric is only replaced by
+// explicit monthly figures. Each month is written on its own, so the monthly
+// job can run alongside.
+func Backfill(cfg *config.Config, records []backfill.Record) *ImportReport {
+  report := ImportReport{}
+
+  groups := make(map[db.AppKey][]backfill.Record)
+  var keys []db.AppKey
+  for _, record := range records {
+    key := db.AppKey{Domain: record.Domain, AppID: record.AppID}
+    if _, ok := groups[key]; !ok { keys = append(keys, key) }
+    groups[key] = append(groups[key], record)
+  }
+
+  now := time.Now().UTC()
+  for _, key := range keys {
+    app, err := cfg.Store.FindApp(cfg.Ctx, key.Domain, key.AppID)
+    if err == db.ErrNotFound {
+      report.UnknownApps = append(report.UnknownApps, fmt.Sprintf("%s:%d", key.Domain, key.AppID))
+      continue
+    }
+    if err != nil {
+      report.Errors = append(report.Errors, fmt.Sprintf("%s:%d - %s", key.Domain, key.AppID, err))
+      continue
+    }
+
+    existing, err := cfg.Store.GetDailyMetrics(cfg.Ctx, app.ID, time.Time{}, time.Time{})
+    if err != nil {
+      report.Errors = append(report.Errors, fmt.Sprintf("%s:%d - %s", key.Domain, key.AppID, err))
+      continue
+    }
+
+    stored := make(map[time.Time]db.Metric, len(app.Metrics))
+    for _, metric := range app.Metrics { stored[metric.Date] = metric }
+    added := mergeHistory(app, existing, groups[key], &now, &report)
+
+    // Only the months whose metric changed, including gains moved by a new month before them
+    err = cfg.Store.InsertDailyMetrics(cfg.Ctx, app.ID, added)
+    for _, metric := range app.Metrics {
+      if err != nil { break }
+      if previous, ok := stored[metric.Date]; ok && sameMetric(&previous, &metric) { continue }
+      err = cfg.Store.SetMetric(cfg.Ctx, app.ID, metric)
+    }
+    if err != nil {
+      report.Errors = append(report.Errors, fmt.Sprintf("%s:%d - %s", key.Domain, key.AppID, err))
+      continue
+    }
+    report.Apps++
+  }
+
+  cfg.Trace.Info.Printf("backfill execution REPORT:\n    apps: %d\n    samples: %d\n    duplicates: %d\n    metrics: %d\n    overwritten: %d\n    unknown: %d\n    errors: %d",
+    report.Apps, report.Samples, report.Duplicates, report.Metrics, report.Overwritten, len(report.UnknownApps), len(report.Errors))
+  return &report
+}
+
+type monthFigures struct {
+  total        int
+  numCounted   int
+  peak         int
+  avg          *int // Explicit figures from the import
+  explicitPeak *int
+  touched      bool
+}
+
+// mergeHistory computes the monthly metrics of the complete months the
+// records touch, returning the samples to add alongside the existing ones.
+// A stored metric was computed from every sample of its month, most of which
+// are purged by now, so the samples never replace it, explicit figures do.
+func mergeHistory(app *db.App, existing []db.DailyMetric, records []backfill.Record, now *time.Time, report *ImportReport) []db.DailyMetric {
+  days := make(map[time.Time]bool)
+  months := make(map[time.Time]*monthFigures)
+  figuresFor := func(date time.Time) *monthFigures {
+    date = date.UTC()
+    month := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+    if _, ok := months[month]; !ok { months[month] = &monthFigures{} }
+    return months[month]
+  }
+  addSample := func(figures *monthFigures, count int) {
+    figures.total += count
+    figures.numCounted++
+    figures.peak = max(figures.peak, count)
+  }
+
+  for _, dailyMetric := range existing {
+    days[truncateDay(dailyMetric.Date)] = true
+    addSample(figuresFor(dailyMetric.Date), dailyMetric.PlayerCount)
+  }
+
+  added := make([]db.DailyMetric, 0)
+  for _, record := range records {
+    figures := figuresFor(record.Date)
+    if record.AvgPlayers != nil || record.Peak != nil {
+      if record.AvgPlayers != nil { figures.avg = record.AvgPlayers }
+      if record.Peak != nil { figures.explicitPeak = record.Peak }
+      figures.touched = true
+    }
+    if record.PlayerCount == nil { continue }
+
+    day := truncateDay(record.Date)
+    if days[day] {
+      report.Duplicates++
+      continue
+    }
+    days[day] = true
+    addSample(figures, *record.PlayerCount)
+    figures.touched = true
+    report.Samples++
+
+    if dayDiff(now, &record.Date) >= RETENTIONLIMIT {
+      report.Expired++
+      continue
+    }
+    added = append(added, db.DailyMetric{Date: record.Date, PlayerCount: *record.PlayerCount})
+  }
+
+  sortDates(added)
+  if n := len(added); n > 0 && added[n-1].Date.After(app.LastMetric.Date) {
+    app.LastMetric = added[n-1]
+  }
+
+  // Only complete months have a metric, the current one is left to the monthly job
+  currentMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+  metricsByMonth := make(map[time.Time]db.Metric)
+  for _, metric := range app.Metrics {
+    metricsByMonth[metric.Date] = metric
+  }
+  for month, figures := range months {
+    if !figures.touched || !month.Before(currentMonth) { continue }
+    explicit := figures.avg != nil || figures.explicitPeak != nil
+
+    metric, ok := metricsByMonth[month]
+    switch {
+    case ok && !explicit:
+      continue
+    case ok:
+      report.Overwritten++
+    default:
+      metric = db.Metric{Date: month, Peak: figures.peak}
+      if figures.numCounted > 0 { metric.AvgPlayers = figures.total / figures.numCounted }
+      report.Metrics++
+    }
+    if figures.avg != nil { metric.AvgPlayers = *figures.avg }
+    if figures.explicitPeak != nil { metric.Peak = *figures.explicitPeak }
+    metricsByMonth[month] = metric
+  }
+
+  app.Metrics = rebuildMetrics(metricsByMonth)
+  return added
+}
+
+// rebuildMetrics orders the metrics and recomputes the gains between them
+func rebuildMetrics(metricsByMonth map[time.Time]db.Metric) []db.Metric {
+  var monthList []time.Time
+  for month := range metricsByMonth { monthList = append(monthList, month) }
+  sort.Slice(monthList, func(i int, j int) bool { return monthList[i].Before(monthList[j]) })
+
+  metricList := make([]db.Metric, 0, len(monthList))
+  var previous *db.Metric
+  for _, month := range monthList {
+    metric := metricsByMonth[month]
+    nextMonth := month.AddDate(0, 1, 0)
+    metricList = append(metricList, *constructNewMonthMetric(previous, metric.Peak, metric.AvgPlayers, &nextMonth))
+    previous = &metricList[len(metricList)-1]
+  }
+  return metricList
+}
+
+func sameMetric(a *db.Metric, b *db.Metric) bool {
+  return a.Date.Equal(b.Date) && a.AvgPlayers == b.AvgPlayers && a.Peak == b.Peak && a.Gain == b.Gain &&
+    a.GainRatio == b.GainRatio && a.NoPrevious == b.NoPrevious
+}
+
+func truncateDay(date time.Time) time.Time {
+  date = date.UTC()
+  return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+  "testing"
+  "time"
+  "github.com/j-leg/tracula/internal/backfill"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+func intPtr(val int) *int { return &val }
+
+func TestMergeHistory(t *testing.T) {
+  now := time.Date(2020, time.April, 10, 0, 0, 0, 0, time.UTC)
+  app := db.App{}
+  existing := []db.DailyMetric{
+    {Date: time.Date(2020, time.March, 20, 12, 0, 0, 0, time.UTC), PlayerCount: 300},
+  }
+  records := []backfill.Record{
+    // Same day as the existing sample
+    {Date: time.Date(2020, time.March, 20, 0, 0, 0, 0, time.UTC), PlayerCount: intPtr(999)},
+    {Date: time.Date(2020, time.March, 21, 0, 0, 0, 0, time.UTC), PlayerCount: intPtr(100)},
+    // Explicit monthly figures
+    {Date: time.Date(2019, time.December, 1, 0, 0, 0, 0, time.UTC), AvgPlayers: intPtr(50), Peak: intPtr(80)},
+    // Outside retention, only used for the January metric
+    {Date: time.Date(2020, time.January, 5, 0, 0, 0, 0, time.UTC), PlayerCount: intPtr(100)},
+    // Current month is left to the monthly job
+    {Date: time.Date(2020, time.April, 2, 0, 0, 0, 0, time.UTC), PlayerCount: intPtr(400)},
+  }
+
+  report := ImportReport{}
+  added := mergeHistory(&app, existing, records, &now, &report)
+
+  if report.Samples != 3 || report.Duplicates != 1 || report.Expired != 1 || report.Metrics != 3 {
+    t.Errorf("[FAIL] TestMergeHistory: unexpected report %+v\n", report)
+  }
+  if len(added) != 2 || app.LastMetric.PlayerCount != 400 {
+    t.Errorf("[FAIL] TestMergeHistory: unexpected added samples %+v\n", added)
+  }
+  if len(app.Metrics) != 3 {
+    t.Fatalf("[FAIL] TestMergeHistory: unexpected metrics %+v\n", app.Metrics)
+  }
+
+  december, january, march := app.Metrics[0], app.Metrics[1], app.Metrics[2]
+  if december.AvgPlayers != 50 || december.Peak != 80 || !december.NoPrevious {
+    t.Errorf("[FAIL] TestMergeHistory: unexpected december %+v\n", december)
+  }
+  if january.AvgPlayers != 100 || january.Gain != 50 || january.GainRatio != 1 {
+    t.Errorf("[FAIL] TestMergeHistory: unexpected january %+v\n", january)
+  }
+  if march.Date.Month() != time.March || march.AvgPlayers != 200 || march.Peak != 300 {
+    t.Errorf("[FAIL] TestMergeHistory: unexpected march %+v\n", march)
+  }
+}
+
+func TestMergeHistoryStoredMetrics(t *testing.T) {
+  now := time.Date(2020, time.April, 10, 0, 0, 0, 0, time.UTC)
+  january := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+  february := time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC)
+  app := db.App{Metrics: []db.Metric{
+    {Date: january, AvgPlayers: 500, Peak: 900, NoPrevious: true},
+    {Date: february, AvgPlayers: 600, Peak: 1000, Gain: 100, GainRatio: 0.2},
+  }}
+  records := []backfill.Record{
+    // A single day of a month with a stored metric leaves it alone
+    {Date: time.Date(2020, time.January, 5, 0, 0, 0, 0, time.UTC), PlayerCount: intPtr(10)},
+    // Explicit figures replace it
+    {Date: february, Peak: intPtr(1200)},
+  }
+
+  report := ImportReport{}
+  mergeHistory(&app, nil, records, &now, &report)
+  if report.Metrics != 0 || report.Overwritten != 1 || report.Samples != 1 {
+    t.Errorf("[FAIL] TestMergeHistoryStoredMetrics: unexpected report %+v\n", report)
+  }
+  if len(app.Metrics) != 2 || app.Metrics[0].AvgPlayers != 500 || app.Metrics[0].Peak != 900 {
+    t.Errorf("[FAIL] TestMergeHistoryStoredMetrics: january was replaced %+v\n", app.Metrics)
+  }
+  if app.Metrics[1].AvgPlayers != 600 || app.Metrics[1].Peak != 1200 || app.Metrics[1].Gain != 100 {
+    t.Errorf("[FAIL] TestMergeHistoryStoredMetrics: unexpected february %+v\n", app.Metrics[1])
+  }
+}
@@ -0,0 +1,160 @@
+package core
+
+import (
+  "context"
+  "errors"
+  "sort"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CHECKPOINTINTERVAL is the number of minutes between checkpoints while a job runs
+const CHECKPOINTINTERVAL = 1
+
+// BOOKKEEPINGTIMEOUT is the number of seconds the final writes of a job run
+// have, they are made even if cfg.Ctx was cancelled
+const BOOKKEEPINGTIMEOUT = 10
+
+// jobRun is a logical run of a job, which may take several invocations when
+// the library does not fit in one. Progress is kept as the low watermark of
+// the apps dispatched in id order, plus the apps completed above it, which
+// are skipped on resume.
+type jobRun struct {
+  cfg        *config.Config
+  checkpoint *db.Checkpoint // nil when the store cannot keep checkpoints
+  isResumed  bool
+  dispatched []primitive.ObjectID
+  done       map[primitive.ObjectID]bool
+}
+
+// startRun resumes the unfinished run of the job's shard if it started within
+// cfg.ResumeWindow, otherwise it starts a new one under cfg.RunID if set. Dry
+// runs go over every app and keep no checkpoint.
+func startRun(cfg *config.Config, jobType int) *jobRun {
+  run := jobRun{cfg: cfg, done: make(map[primitive.ObjectID]bool)}
+  if cfg.DryRun { return &run }
+  now := time.Now().UTC()
+
+  checkpoint, err := cfg.Store.GetCheckpoint(cfg.Ctx, jobType, cfg.Shard)
+  switch {
+  case errors.Is(err, db.ErrNotSupported):
+    return &run
+  case err == nil && now.Sub(checkpoint.StartedAt) < resumeWindow(cfg):
+    cfg.Trace.Info.Printf("Resuming %s run %s after app %s", jobName(jobType), checkpoint.RunID, checkpoint.AfterID.Hex())
+    run.checkpoint = checkpoint
+    run.isResumed = true
+    for _, id := range checkpoint.Completed { run.done[id] = true }
+    return &run
+  case err == nil:
+    cfg.Trace.Info.Printf("Abandoning %s run %s started %s", jobName(jobType), checkpoint.RunID, checkpoint.StartedAt.Format(DATEPATTERN))
+  case err != db.ErrNotFound:
+    cfg.Trace.Error.Printf("Error loading %s checkpoint, starting a new run %s", jobName(jobType), err)
+  }
+
+  run.checkpoint = &db.Checkpoint{JobType: jobType, Shard: cfg.Shard, RunID: newRunID(cfg), StartedAt: now}
+  return &run
+}
+
+// newRunID is shared by the shards of a run when the caller sets cfg.RunID
+func newRunID(cfg *config.Config) string {
+  if cfg.RunID != "" { return cfg.RunID }
+  return primitive.NewObjectID().Hex()
+}
+
+func resumeWindow(cfg *config.Config) time.Duration {
+  if cfg.ResumeWindow > 0 { return cfg.ResumeWindow }
+  return config.RESUMEWINDOW * time.Hour
+}
+
+// enabled reports whether the run keeps checkpoints, runs over apps held in
+// memory have none
+func (r *jobRun) enabled() bool {
+  return r != nil && r.checkpoint != nil
+}
+
+// afterID is where the run resumes, zero for a new run
+func (r *jobRun) afterID() primitive.ObjectID {
+  if !r.enabled() { return primitive.NilObjectID }
+  return r.checkpoint.AfterID
+}
+
+// runID identifies the logical run, runs without checkpoints are only ever
+// one invocation long
+func (r *jobRun) runID(cfg *config.Config) string {
+  if !r.enabled() { return newRunID(cfg) }
+  return r.checkpoint.RunID
+}
+
+func (r *jobRun) resumed() bool {
+  return r != nil && r.isResumed
+}
+
+// totals are the counters carried over from earlier invocations
+func (r *jobRun) totals() jobTotals {
+  if !r.enabled() { return jobTotals{} }
+  return jobTotals{numSuccess: r.checkpoint.NumSuccess, numErrors: r.checkpoint.NumErrors}
+}
+
+func (r *jobRun) markDispatched(id primitive.ObjectID) {
+  if !r.enabled() { return }
+  r.dispatched = append(r.dispatched, id)
+}
+
+func (r *jobRun) markDone(id primitive.ObjectID) {
+  if !r.enabled() { return }
+  r.done[id] = true
+}
+
+// unmarkDone is for apps whose write was dropped, they run again on resume
+func (r *jobRun) unmarkDone(id primitive.ObjectID) {
+  if !r.enabled() { return }
+  delete(r.done, id)
+}
+
+// completed reports whether an earlier invocation of the run completed the app
+func (r *jobRun) completed(id primitive.ObjectID) bool {
+  return r.enabled() && r.done[id]
+}
+
+// save persists the watermark, the apps completed above it and the counters.
+// Only call it once the completed apps' writes have been flushed.
+func (r *jobRun) save(totals jobTotals) {
+  if !r.enabled() { return }
+
+  for len(r.dispatched) > 0 && r.done[r.dispatched[0]] {
+    r.checkpoint.AfterID = r.dispatched[0]
+    delete(r.done, r.dispatched[0])
+    r.dispatched = r.dispatched[1:]
+  }
+  r.checkpoint.Completed = make([]primitive.ObjectID, 0, len(r.done))
+  for id := range r.done { r.checkpoint.Completed = append(r.checkpoint.Completed, id) }
+  sort.Slice(r.checkpoint.Completed, func(i int, j int) bool {
+    return r.checkpoint.Completed[i].Hex() < r.checkpoint.Completed[j].Hex()
+  })
+  r.checkpoint.NumSuccess = totals.numSuccess
+  r.checkpoint.NumErrors = totals.numErrors
+
+  ctx, cancel := bookkeepingContext()
+  defer cancel()
+  if err := r.cfg.Store.SaveCheckpoint(ctx, r.checkpoint); err != nil {
+    r.cfg.Trace.Error.Printf("Error saving %s checkpoint - %s", jobName(r.checkpoint.JobType), err)
+  }
+}
+
+// complete drops the checkpoint so the next invocation starts a new run
+func (r *jobRun) complete() {
+  if !r.enabled() { return }
+  ctx, cancel := bookkeepingContext()
+  defer cancel()
+  if err := r.cfg.Store.DeleteCheckpoint(ctx, r.checkpoint.JobType, r.checkpoint.Shard); err != nil {
+    r.cfg.Trace.Error.Printf("Error clearing %s checkpoint - %s", jobName(r.checkpoint.JobType), err)
+  }
+}
+
+// bookkeepingContext is detached from cfg.Ctx, so an aborted job still
+// records how far it got
+func bookkeepingContext() (context.Context, context.CancelFunc) {
+  return context.WithTimeout(context.Background(), BOOKKEEPINGTIMEOUT*time.Second)
+}
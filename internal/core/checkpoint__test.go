@@ -0,0 +1,46 @@
+package core
+
+import (
+  "context"
+  "testing"
+  "github.com/j-leg/tracula/internal/db"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestJobRunCheckpoint(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+
+  run := startRun(cfg, db.DAILY)
+  if !run.afterID().IsZero() || run.totals().numSuccess != 0 {
+    t.Fatalf("[FAIL] TestJobRunCheckpoint: expected a new run, got %+v\n", run.checkpoint)
+  }
+
+  // Completions out of order only move the watermark past the contiguous ones
+  ids := []primitive.ObjectID{primitive.NewObjectID(), primitive.NewObjectID(), primitive.NewObjectID()}
+  for _, id := range ids { run.markDispatched(id) }
+  run.markDone(ids[0])
+  run.markDone(ids[2])
+  run.save(jobTotals{numSuccess: 2})
+
+  resumed := startRun(cfg, db.DAILY)
+  if resumed.afterID() != ids[0] || resumed.totals().numSuccess != 2 || resumed.checkpoint.RunID != run.checkpoint.RunID {
+    t.Errorf("[FAIL] TestJobRunCheckpoint: unexpected resumed checkpoint %+v\n", resumed.checkpoint)
+  }
+  // The app completed above the watermark is not run again
+  if resumed.completed(ids[1]) || !resumed.completed(ids[2]) {
+    t.Errorf("[FAIL] TestJobRunCheckpoint: unexpected completed apps %+v\n", resumed.checkpoint.Completed)
+  }
+  resumed.markDispatched(ids[1])
+  resumed.markDispatched(ids[2])
+  resumed.markDone(ids[1])
+  resumed.save(jobTotals{numSuccess: 3})
+  if resumed.afterID() != ids[2] || len(resumed.checkpoint.Completed) != 0 {
+    t.Errorf("[FAIL] TestJobRunCheckpoint: watermark did not pass the completed app %+v\n", resumed.checkpoint)
+  }
+
+  resumed.complete()
+  if _, err := cfg.Store.GetCheckpoint(cfg.Ctx, db.DAILY, cfg.Shard); err != db.ErrNotFound {
+    t.Errorf("[FAIL] TestJobRunCheckpoint: expected the checkpoint to be cleared, got %v\n", err)
+  }
+}
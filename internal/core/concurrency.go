@@ -0,0 +1,69 @@
+package core
+
+import (
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/stats"
+)
+
+const (
+  ERRORTHRESHOLD = 0.2 // Error ratio above which a window is treated as unhealthy
+  RAMPSTEP       = 5   // Additive increase applied after a healthy window
+)
+
+// adaptiveConcurrency bounds the atomics in flight, adjusted after each
+// window of completions: additive increase while windows are healthy,
+// multiplicative decrease when the domains push back
+type adaptiveConcurrency struct {
+  current      int
+  min          int
+  max          int
+  batchLatency time.Duration
+
+  numTotal     int
+  numErrors    int
+  numThrottled int
+}
+
+func newAdaptiveConcurrency(cfg *config.Config) *adaptiveConcurrency {
+  bounds := cfg.Concurrency
+  defaults := config.DefaultConcurrency()
+  if bounds.Max <= 0 { bounds.Max = defaults.Max }
+  if bounds.Min <= 0 { bounds.Min = min(defaults.Min, bounds.Max) }
+  if bounds.Initial <= 0 { bounds.Initial = defaults.Initial }
+  if bounds.BatchLatency <= 0 { bounds.BatchLatency = defaults.BatchLatency }
+
+  return &adaptiveConcurrency{
+    current:      max(bounds.Min, min(bounds.Initial, bounds.Max)),
+    min:          bounds.Min,
+    max:          bounds.Max,
+    batchLatency: bounds.BatchLatency,
+  }
+}
+
+// limit is the number of atomics allowed in flight
+func (a *adaptiveConcurrency) limit() int {
+  return a.current
+}
+
+// record accounts for a completed atomic in the current window
+func (a *adaptiveConcurrency) record(err error) {
+  a.numTotal++
+  if err == nil { return }
+  a.numErrors++
+  if stats.IsThrottled(err) { a.numThrottled++ }
+}
+
+// adjust resizes the limit from the window just completed and resets the counters
+func (a *adaptiveConcurrency) adjust(elapsed time.Duration) {
+  if a.numTotal == 0 { return }
+
+  errorRatio := float64(a.numErrors) / float64(a.numTotal)
+  if a.numThrottled > 0 || errorRatio > ERRORTHRESHOLD || elapsed > a.batchLatency {
+    a.current = max(a.min, a.current/2)
+  } else {
+    a.current = min(a.max, a.current+RAMPSTEP)
+  }
+
+  a.numTotal, a.numErrors, a.numThrottled = 0, 0, 0
+}
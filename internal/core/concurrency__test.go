@@ -0,0 +1,51 @@
+package core
+
+import (
+  "errors"
+  "testing"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/stats"
+)
+
+func TestAdaptiveConcurrency(t *testing.T) {
+  cfg := &config.Config{
+    Concurrency: config.Concurrency{Initial: 20, Min: 5, Max: 30, BatchLatency: time.Second},
+  }
+  concurrency := newAdaptiveConcurrency(cfg)
+
+  // Healthy batches ramp up to the ceiling
+  for i := 0; i < 10; i++ {
+    concurrency.record(nil)
+    concurrency.adjust(time.Millisecond)
+  }
+  if concurrency.limit() != 30 {
+    t.Errorf("[FAIL] TestAdaptiveConcurrency: expected 30, got %d\n", concurrency.limit())
+  }
+
+  // A single throttled response halves the limit
+  concurrency.record(nil)
+  concurrency.record(&stats.StatusError{Domain: "steam", StatusCode: 429})
+  concurrency.adjust(time.Millisecond)
+  if concurrency.limit() != 15 {
+    t.Errorf("[FAIL] TestAdaptiveConcurrency: expected 15, got %d\n", concurrency.limit())
+  }
+
+  // Slow batches back off but never below the floor
+  for i := 0; i < 10; i++ {
+    concurrency.record(nil)
+    concurrency.adjust(2 * time.Second)
+  }
+  if concurrency.limit() != 5 {
+    t.Errorf("[FAIL] TestAdaptiveConcurrency: expected 5, got %d\n", concurrency.limit())
+  }
+
+  // Too many plain errors count as unhealthy too
+  concurrency.current = 20
+  concurrency.record(errors.New("not found"))
+  concurrency.record(nil)
+  concurrency.adjust(time.Millisecond)
+  if concurrency.limit() != 10 {
+    t.Errorf("[FAIL] TestAdaptiveConcurrency: expected 10, got %d\n", concurrency.limit())
+  }
+}
@@ -5,10 +5,9 @@ import (
   "github.com/j-leg/tracula/internal/db"
   "github.com/j-leg/tracula/internal/stats"
   "context"
+  "errors"
+  "go.mongodb.org/mongo-driver/bson/primitive"
   "time"
-  "github.com/cheggaaa/pb/v3"
-  "math"
-  "os"
 )
 
 // Constants
@@ -17,251 +16,216 @@ const (
   FUNCTIONDURATION = 8
   LOCALFUNCDURATION = 50
 
-  ROUTINELIMIT        = 50 // Max number of go-routines running concurrently
-  REFRESHROUTINELIMIT = 50
   DATEPATTERN         = "2006-01-02 15:04:05"
 
   NOACTIVITYLIMIT   = 3
-  LIMIT             = 50 
 )
 
-// Exported entry points
+// Exported entry points, each returns the report of the invocation
 // Daily
-func Daily(cfg *config.Config) {
-  execute(cfg, db.DAILY, dailyAtomic)
+func Daily(cfg *config.Config) (*db.JobRun, error) {
+  return withLease(cfg, db.DAILY, func(lease *jobLease) (*db.JobRun, error) {
+    return execute(cfg, db.DAILY, dailyAtomic, lease, nil)
+  })
 }
 
-// Monthly
-func Monthly(cfg *config.Config) {
-  execute(cfg, db.MONTHLY, monthlyAtomic)
+// Monthly computes last month's metrics. Samples past the retention limit
+// are archived first when an archive is configured, by the first shard only,
+// whose report counts them.
+func Monthly(cfg *config.Config) (*db.JobRun, error) {
+  return withLease(cfg, db.MONTHLY, func(lease *jobLease) (*db.JobRun, error) {
+    var steps jobSteps
+    if cfg.Archive != nil && cfg.Shard.Index == 0 { steps.archive = archiveExpired(cfg) }
+    return execute(cfg, db.MONTHLY, monthlyAtomic, lease, &steps)
+  })
 }
 
 // Track
-func Track(cfg *config.Config) {
-  execute(cfg, db.TRACK, trackAtomic)
+func Track(cfg *config.Config) (*db.JobRun, error) {
+  return withLease(cfg, db.TRACK, func(lease *jobLease) (*db.JobRun, error) {
+    return execute(cfg, db.TRACK, trackAtomic, lease, nil)
+  })
 }
 
-// Recover
-func Recover(cfg *config.Config) {
-  // TODO
-  db.Flush(cfg.Ctx, cfg.Col.Exceptions)
-  execute(cfg, db.RECOVERY, dailyAtomic)
+// Recover re-runs the failed jobs of every app with a due exception. It only
+// holds its own lease, so a retry may run alongside the job it belongs to.
+// That is safe as the writes of either are idempotent: an app gets one
+// sample a day and one metric a month.
+func Recover(cfg *config.Config) (*db.JobRun, error) {
+  return withLease(cfg, db.RECOVERY, func(lease *jobLease) (*db.JobRun, error) {
+    return execute(cfg, db.RECOVERY, recoverAtomic, lease, nil)
+  })
 }
 
-// Refresh - TODO
-func Refresh(cfg *config.Config) {
-  appList, err := db.GetFullStaticData(cfg.Ctx, cfg.Col.Stats)
-  if err != nil {
-    cfg.Trace.Error.Printf("error retrieving app list %s", err)
-    return
+// Refresh updates the app library. Domains able to list incrementally are
+// synced from their watermark, the rest are diffed against the full library.
+// The report covers the apps inserted by either. When sharded, the first
+// shard syncs, every shard diffs the domains unable to sync and inserts its
+// part of the new apps.
+// A dry run cannot advance the watermarks, it diffs every domain against the
+// full library instead.
+func Refresh(cfg *config.Config) (*db.JobRun, error) {
+  return withLease(cfg, db.REFRESH, func(lease *jobLease) (*db.JobRun, error) {
+    return refresh(cfg, lease)
+  })
+}
+
+func refresh(cfg *config.Config, lease *jobLease) (*db.JobRun, error) {
+  var fullDomains []string
+  steps := jobSteps{inserted: make(map[string]int)}
+  for _, provider := range stats.Providers() {
+    if !provider.Capabilities().AppList { continue }
+    if cfg.DryRun {
+      fullDomains = append(fullDomains, provider.Domain())
+      continue
+    }
+
+    if !canSyncIncremental(cfg, provider.Domain()) {
+      fullDomains = append(fullDomains, provider.Domain())
+      continue
+    }
+
+    // Incremental syncs keep a single watermark per domain, left to the first shard
+    if cfg.Shard.Index != 0 { continue }
+    inserted, err := syncIncremental(cfg, provider.Domain())
+    steps.inserted[provider.Domain()] += inserted
+    if err == nil { continue }
+    if !errors.Is(err, stats.ErrNotSupported) {
+      cfg.Trace.Error.Printf("error syncing %s apps %s", provider.Domain(), err)
+      continue
+    }
+    fullDomains = append(fullDomains, provider.Domain())
   }
-  // Convert list to map
-  var currentAppMap map[int]bool = make(map[int]bool)
-  for _, appElement := range appList {
-    currentAppMap[appElement.AppID] = true
+
+  var newApps []*db.App
+  if len(fullDomains) > 0 {
+    var err error
+    if newApps, err = newLibraryApps(cfg, fullDomains); err != nil { return nil, err }
   }
+  newApps = shardApps(newApps, cfg.Shard)
+  return runPool(cfg, db.REFRESH, len(newApps), newSliceIterator(newApps), refreshAtomic, nil, lease, &steps), nil
+}
 
-  newDomainAppMap, err := stats.FetchApps()
+// newLibraryApps returns the apps of the domains missing from the library
+func newLibraryApps(cfg *config.Config, domains []string) ([]*db.App, error) {
+  newDomainAppMap, err := stats.FetchApps(cfg.Ctx, cfg.Fetch, domains...)
   if err != nil {
     cfg.Trace.Error.Printf("error fetching latest apps %s", err)
-    return
+    return nil, err
   }
-  // Identify and construct new apps
+
+  // Drop the apps already in the library, streaming it rather than loading it whole
+  err = cfg.Store.IterateStaticData(cfg.Ctx, func(staticData *db.StaticAppData) error {
+    delete(newDomainAppMap[staticData.Domain], staticData.AppID)
+    return nil
+  }, domains...)
+  if err != nil {
+    cfg.Trace.Error.Printf("error retrieving app list %s", err)
+    return nil, err
+  }
+
+  // Construct new apps
   var newApps []*db.App
   for domain, appMap := range newDomainAppMap {
     for appId, appName := range appMap {
-
-      // Check if exists already in library
-      _, ok := currentAppMap[appId]
-      if ok { continue }
-
       cfg.Trace.Info.Printf("New app: %s - id: %d", appName, appId)
 
       newStaticData := db.StaticAppData{Name: appName, AppID: appId, Domain: domain}
       newApp := db.App{
-        Metrics:      make([]db.Metric, 0), // Initialise 0 len slice instead of nil slice
-        DailyMetrics: make([]db.DailyMetric, 0),
-        StaticData:   newStaticData,
+        Metrics:    make([]db.Metric, 0), // Initialise 0 len slice instead of nil slice
+        StaticData: newStaticData,
       }
       newApps = append(newApps, &newApp)
     }
   }
-  // TODO: Resolve legacy flow
-  numDocuments := len(newApps)
-  numBatches := int(math.Ceil(float64(numDocuments/LIMIT)))
-  numSuccess, numErrors := 0, 0
-
-  // Local - only
-  var bar *pb.ProgressBar
-  var timeout <-chan time.Time 
-
-  if cfg.LocalEnabled {
-    bar = pb.StartNew(numDocuments)
-    bar.SetRefreshRate(time.Second)
-    bar.SetWriter(os.Stdout)
-    bar.Start()
-    timeout = time.After(LOCALFUNCDURATION * time.Minute)
-  } else {
-    timeout = time.After(FUNCTIONDURATION * time.Minute)
+  return newApps, nil
+}
+
+// shardApps keeps the apps of the shard
+func shardApps(apps []*db.App, shard db.Shard) []*db.App {
+  if !shard.Sharded() { return apps }
+  var kept []*db.App
+  for _, app := range apps {
+    if shard.Contains(app.StaticData.Key()) { kept = append(kept, app) }
   }
+  return kept
+}
 
-  workChannel := make(chan msgAtomic)
-  jobType := "refresh"
-
-  for i := 0; i <= numBatches; i++ {
-    start := i*LIMIT
-    end := start+LIMIT
-    curr := start 
-
-    numRoutines := 0
-    for curr < min(end, numDocuments) { 
-      // Deferred cancel handled in atomic go-routine
-      childCtx, _ := context.WithCancel(cfg.Ctx)
-      go refreshAtomic(childCtx, newApps[curr], cfg.Col, workChannel)
-      numRoutines++
-      curr++
-    }
+// getJobParams returns an estimate of the number of apps the job runs over,
+// for progress only, and an iterator over the apps of the shard starting after afterID
+func getJobParams(cfg *config.Config, jobType int, afterID primitive.ObjectID) (int, db.AppIterator, error) {
+  filter := db.AppFilter{AfterID: afterID, Shard: cfg.Shard}
 
-    for completed := 0; completed < numRoutines; completed++ {
-      select {
-      case msg := <- workChannel:
-        if msg.err == nil {
-          numSuccess++
-        } else {
-          cfg.Trace.Error.Printf("Error process [%s] app %s - %s", jobType, msg.ID, msg.err.Error()) 
-          numErrors++
-        }
-      case <- timeout:
-        cfg.Trace.Info.Println("Process timeout signal received. Terminate.")
-        close(workChannel)
-        return
-      }
-      if cfg.LocalEnabled { bar.Increment() }
-    }
+  switch jobType {
+  case db.MONTHLY, db.REFRESH, db.TRACK:
+  case db.RECOVERY:
+    // Recovery runs over the apps that have a due exception
+    filter.DueExceptions = true
+  case db.DAILY:
+    filter.TrackedOnly = true
+  case db.ENRICH:
+    // Apps of domains with metadata that have none, or it is older than the cadence
+    filter.MetadataDomains = stats.MetadataDomains()
+    filter.MetadataStaleBefore = time.Now().UTC().Add(-metadataTTL(cfg))
+  default:
+    return 0, nil, errors.New("Invalid job")
   }
 
-  close(workChannel)
-  if bar != nil { bar.Finish() }
-
-  cfg.Trace.Info.Printf("%s execution REPORT:\n    success: %d\n    errors: %d", jobType, numSuccess, numErrors)
+  return cfg.Store.IterateApps(cfg.Ctx, filter)
 }
 
-type executeAtomic func(ctx context.Context, app *db.App, cols *config.Collections, ch chan<-msgAtomic)  
+type executeAtomic func(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic)  
 
-func execute(cfg *config.Config, jobType int, atomic executeAtomic) {
-  numDocuments, cursor, err := db.GetJobParams(cfg, jobType)
+func execute(cfg *config.Config, jobType int, atomic executeAtomic, lease *jobLease, steps *jobSteps) (*db.JobRun, error) {
+  run := startRun(cfg, jobType)
+  numDocuments, cursor, err := getJobParams(cfg, jobType, run.afterID())
   if err != nil {
     cfg.Trace.Error.Printf("Error initialising job params: %s", err)
-    return
-  }
-
-  numBatches := int(math.Ceil(float64(numDocuments/LIMIT)))
-  numSuccess, numErrors := 0, 0
-
-  // Local - only
-  var bar *pb.ProgressBar
-  var timeout <-chan time.Time 
-
-  if cfg.LocalEnabled {
-    bar = pb.StartNew(numDocuments)
-    bar.SetRefreshRate(time.Second)
-    bar.SetWriter(os.Stdout)
-    bar.Start()
-    timeout = time.After(LOCALFUNCDURATION * time.Minute)
-  } else {
-    timeout = time.After(FUNCTIONDURATION * time.Minute)
-  }
-
-  workChannel := make(chan msgAtomic)
-
-  for i := 0; i <= numBatches; i++ {
-    curr := 0
-    numRoutines := 0
-    for curr < LIMIT && cursor.Next(cfg.Ctx) {
-      var app db.App
-      curr++
-      if err := cursor.Decode(&app); err != nil {
-        cfg.Trace.Error.Printf("Error decoding. %s", err)
-        continue
-      }
-      
-      // Deferred cancel handled in atomic go-routine
-      childCtx, _ := context.WithCancel(cfg.Ctx)
-      go atomic(childCtx, &app, cfg.Col, workChannel)
-      numRoutines++
-    }
-
-    for completed := 0; completed < numRoutines; completed++ {
-      select {
-      case msg := <- workChannel:
-        if msg.err == nil {
-          cfg.Trace.Debug.Printf("Successful process [%d] for app %s.", jobType, msg.ID)
-          numSuccess++
-        } else {
-          cfg.Trace.Error.Printf("Error process [%d] app %s - %s", jobType, msg.ID, msg.err.Error()) 
-          numErrors++
-        }
-      case <- timeout:
-        cfg.Trace.Info.Println("Process timeout signal received. Terminate.")
-        close(workChannel)
-        cursor.Close(cfg.Ctx)
-        return
-      }
-      if cfg.LocalEnabled { bar.Increment() }
-    }
+    return nil, err
   }
 
-  close(workChannel)
-  cursor.Close(cfg.Ctx)
-  if bar != nil { bar.Finish() }
-
-  var job string
-  switch jobType {
-    case db.DAILY:
-      job = "daily"
-    case db.MONTHLY:
-      job = "monthly"
-    case db.RECOVERY:
-      job = "recovery"
-    case db.REFRESH:
-      job = "refresh"
-    case db.TRACK:
-      job = "track"
-    default:
-      cfg.Trace.Error.Printf("Invalid job type %d", jobType)
-  }
-  cfg.Trace.Info.Printf("%s execution REPORT:\n    success: %d\n    errors: %d", job, numSuccess, numErrors)
+  return runPool(cfg, jobType, numDocuments, cursor, atomic, run, lease, steps), nil
 }
 
-func dailyAtomic(ctx context.Context, app *db.App, cols *config.Collections, ch chan<-msgAtomic) {
+func dailyAtomic(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
   var err error
-  defer finaliseAtomic(ctx, ch, app.ID.String(), &err)
+  var mutation *db.Mutation
+  defer finaliseAtomic(ctx, ch, app, &mutation, &err)
 
   var currDateTime time.Time
   currDateTime, err = time.Parse(DATEPATTERN, time.Now().UTC().String()[:19])
   if err != nil { return }
 
   var quantity int
-  quantity, err = stats.Fetch(app.StaticData.Domain, app.StaticData.AppID)
+  err = withRetry(ctx, cfg, func() (fetchErr error) {
+    quantity, fetchErr = stats.Fetch(ctx, cfg.Fetch, app.StaticData.Domain, app.StaticData.AppID)
+    return fetchErr
+  })
   if err != nil { return }
 
   newDailyElement := db.DailyMetric{Date: currDateTime, PlayerCount: quantity}
-  app.DailyMetrics = append(app.DailyMetrics, newDailyElement)
   app.LastMetric = newDailyElement
-  
-  err = db.UpdateApp(ctx, app, cols.Stats)
+
+  mutation = &db.Mutation{AppRef: app.ID, Sample: &newDailyElement}
 }
 
-func monthlyAtomic(ctx context.Context, app *db.App, cols *config.Collections, ch chan<-msgAtomic) {
+func monthlyAtomic(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
   var err error
-  defer finaliseAtomic(ctx, ch, app.ID.String(), &err)
+  var mutation *db.Mutation
+  defer finaliseAtomic(ctx, ch, app, &mutation, &err)
 
   var currDateTime time.Time
   currDateTime, err = time.Parse(DATEPATTERN, time.Now().UTC().String()[:19])
   if err != nil { return }
   
-  newPeak, newAverage := analyseMonthData(app, &currDateTime)
-  
+  monthStart, monthEnd := targetMonth(&currDateTime)
+  var samples []db.DailyMetric
+  samples, err = cfg.Store.GetDailyMetrics(ctx, app.ID, monthStart, monthEnd)
+  if err != nil { return }
+
+  newPeak, newAverage := analyseMonthData(samples)
+  sortDates(app.Metrics)
+
   var prevMonthMetricPtr *db.Metric = nil
   if len(app.Metrics) > 0 {
     prevMonthMetricPtr = &(app.Metrics[len(app.Metrics)-1])
@@ -270,19 +234,25 @@ func monthlyAtomic(ctx context.Context, app *db.App, cols *config.Collections, c
   newMonthMetricPtr := constructNewMonthMetric(prevMonthMetricPtr, newPeak, newAverage, &currDateTime)
   app.Metrics = append(app.Metrics, *newMonthMetricPtr)
 
-  err = db.UpdateApp(ctx, app, cols.Stats)
+  mutation = &db.Mutation{AppRef: app.ID, Metric: newMonthMetricPtr}
+  // With an archive the expired samples are dropped once archived, never here
+  if cfg.Archive == nil {
+    mutation.PurgeBefore = currDateTime.Add(-RETENTIONLIMIT * HOURSPERDAY * time.Hour)
+  }
 }
 
-func refreshAtomic(ctx context.Context, app *db.App, cols *config.Collections, ch chan<-msgAtomic) {
+func refreshAtomic(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
   var err error
-  defer finaliseAtomic(ctx, ch, app.ID.String(), &err)
+  var mutation *db.Mutation
+  defer finaliseAtomic(ctx, ch, app, &mutation, &err)
 
-  err = db.AddNewApp(ctx, app, cols.Stats)
+  mutation = &db.Mutation{Insert: app}
 }
 
-func trackAtomic(ctx context.Context, app *db.App, cols *config.Collections, ch chan<-msgAtomic) {
+func trackAtomic(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
   var err error
-  defer finaliseAtomic(ctx, ch, app.ID.String(), &err)
+  var mutation *db.Mutation
+  defer finaliseAtomic(ctx, ch, app, &mutation, &err)
 
   // Set track flag
   // A non-zero playercount over the last 3 months (or up to 3 months)
@@ -297,12 +267,14 @@ func trackAtomic(ctx context.Context, app *db.App, cols *config.Collections, ch
 
   if !isWorthTracking {
     var val int
-    val, err = stats.Fetch(app.StaticData.Domain, app.StaticData.AppID)
+    err = withRetry(ctx, cfg, func() (fetchErr error) {
+      val, fetchErr = stats.Fetch(ctx, cfg.Fetch, app.StaticData.Domain, app.StaticData.AppID)
+      return fetchErr
+    })
     if err != nil { return }
-    if val == 0 {
-      if app.Tracked { db.SetTrackFlag(ctx, app.ID, false, cols.Stats) }
-      return
-    }
+    isWorthTracking = val > 0
+  }
+  if isWorthTracking != app.Tracked {
+    mutation = &db.Mutation{AppRef: app.ID, Tracked: &isWorthTracking}
   }
-  if !app.Tracked { db.SetTrackFlag(ctx, app.ID, true, cols.Stats) }
 }
@@ -2,19 +2,23 @@ package core
 
 import (
   "context"
+  "github.com/j-leg/tracula/internal/db"
 )
 
 type msgAtomic struct {
   ID string
+  app *db.App
+  mutation *db.Mutation // Write left to the executor, nil if there is nothing to write
   err error
 }
 
-func finaliseAtomic(ctx context.Context, ch chan<-msgAtomic, id string, err *error) {
+func finaliseAtomic(ctx context.Context, ch chan<-msgAtomic, app *db.App, mutation **db.Mutation, err *error) {
   newMsg := msgAtomic {
-    ID: id,
+    ID: app.ID.String(),
+    app: app,
     err: (*err),
   }
-  ctx.Done()
+  if mutation != nil && *err == nil { newMsg.mutation = *mutation }
   ch<-newMsg
 }
 
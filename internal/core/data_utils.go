@@ -1,7 +1,6 @@
 package core 
 
 import (
-  "fmt"
   "sort"
   "time"
   "github.com/j-leg/tracula/internal/db"
@@ -40,35 +39,25 @@ func sortDates(m interface{}) {
   }
 }
 
-func analyseMonthData(appBom *db.App, currentDateTime *time.Time) (int, int) {
-  var newDailyMetricList []db.DailyMetric
+// targetMonth returns the bounds [start, end) of the month before currentDateTime,
+// normally this process is called on the first day of the month
+func targetMonth(currentDateTime *time.Time) (time.Time, time.Time) {
+  end := time.Date(currentDateTime.Year(), currentDateTime.Month(), 1, 0, 0, 0, 0, time.UTC)
+  return end.AddDate(0, -1, 0), end
+}
 
+// analyseMonthData returns the peak and average of the month's samples
+func analyseMonthData(samples []db.DailyMetric) (int, int) {
   var total int = 0
   var numCounted int = 0
   var newPeak int = 0
 
-  // Criteria for including metric in the monthly calculation:
-  // 1. Before today's date
-  // 2. Element month = current month - 1 (normally this process called on the first day of the month)
-  targetMonth := currentDateTime.Month() - 1
-  if targetMonth == 0 { targetMonth = time.December }
-
-  // Criteria for purge:
-  // 1. day difference <= RETENTIONLIMIT
-  for _, dailyMetric := range appBom.DailyMetrics {
-    if dayDiff(currentDateTime, &dailyMetric.Date) >= RETENTIONLIMIT { continue }
-    if targetMonth == dailyMetric.Date.Month() {
-      newPeak = max(newPeak, dailyMetric.PlayerCount)
-      total += dailyMetric.PlayerCount
-      numCounted++
-    }
-    newDailyMetricList = append(newDailyMetricList, dailyMetric)
+  for _, dailyMetric := range samples {
+    newPeak = max(newPeak, dailyMetric.PlayerCount)
+    total += dailyMetric.PlayerCount
+    numCounted++
   }
 
-  sortDates(newDailyMetricList)
-  sortDates(appBom.Metrics)
-  appBom.DailyMetrics = newDailyMetricList
-
   var newAverage int = 0
   if numCounted > 0 { newAverage = total / numCounted }
 
@@ -82,32 +71,20 @@ func dayDiff(a, b *time.Time) int {
 }
 
 func constructNewMonthMetric(previous *db.Metric, peak int, avg int, cdt *time.Time) *db.Metric {
-  var gainStr string = "-"
-  var gainPcStr string = "-"
-  if previous != nil {
-    gain := avg - previous.AvgPlayers
-    if previous.AvgPlayers > 0 {
-      gainPc := gain / previous.AvgPlayers
-      gainPcStr = fmt.Sprintf("%.2f%%", float32(gainPc))
-    }
-    gainStr = fmt.Sprintf("%d", gain)
-  }
-
-  var targetMonth time.Month = cdt.Month() - 1
-  var targetYear int = cdt.Year()
-  if cdt.Month() == 0 {
-    targetMonth = time.December
-    targetYear--
-  }
+  monthStart, _ := targetMonth(cdt)
 
   // Construct new month metric
   var newMonthMetric = db.Metric{
-    Date:        time.Date(targetYear, targetMonth, 1, 0, 0, 0, 0, time.UTC),
-    AvgPlayers:  avg,
-    Gain:        gainStr,
-    GainPercent: gainPcStr,
-    Peak:        peak,
+    Date:       monthStart,
+    AvgPlayers: avg,
+    NoPrevious: previous == nil,
+    Peak:       peak,
+  }
+  if previous != nil {
+    newMonthMetric.Gain = avg - previous.AvgPlayers
+    if previous.AvgPlayers > 0 {
+      newMonthMetric.GainRatio = float64(newMonthMetric.Gain) / float64(previous.AvgPlayers)
+    }
   }
   return &newMonthMetric
 }
-
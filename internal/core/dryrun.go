@@ -0,0 +1,79 @@
+package core
+
+import (
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+func newDiff() *db.Diff {
+  return &db.Diff{
+    Inserted:  make([]string, 0),
+    Tracked:   make([]string, 0),
+    Untracked: make([]string, 0),
+    Samples:   make([]db.SampleChange, 0),
+    Metrics:   make([]db.MetricChange, 0),
+    Metadata:  make([]string, 0),
+  }
+}
+
+// preview adds the writes to the diff in place of applying them. Samples
+// and metrics the store already holds for their day or date are left out,
+// as ApplyMutations would skip them. Existing data and purges are read from
+// the store, a failed read fails the app's write.
+func (r *jobReport) preview(cfg *config.Config, mutations []db.Mutation, apps []*db.App) []error {
+  errs := make([]error, len(mutations))
+  for i := range mutations {
+    errs[i] = r.previewMutation(cfg, &mutations[i], appKey(apps[i]))
+  }
+  return errs
+}
+
+func (r *jobReport) previewMutation(cfg *config.Config, mutation *db.Mutation, key string) error {
+  if mutation.Insert != nil {
+    r.Diff.Inserted = append(r.Diff.Inserted, key)
+    return nil
+  }
+
+  if mutation.Sample != nil {
+    day := mutation.Sample.Date.UTC().Truncate(24 * time.Hour)
+    samples, err := cfg.Store.GetDailyMetrics(cfg.Ctx, mutation.AppRef, day, day.AddDate(0, 0, 1))
+    if err != nil { return err }
+    if len(samples) == 0 { r.Diff.Samples = append(r.Diff.Samples, db.SampleChange{App: key, Sample: *mutation.Sample}) }
+  }
+  if mutation.Metric != nil {
+    date := mutation.Metric.Date
+    metrics, err := cfg.Store.GetMetrics(cfg.Ctx, mutation.AppRef, date, date.AddDate(0, 0, 1))
+    if err != nil { return err }
+    stored := false
+    for _, metric := range metrics {
+      if metric.Date.Equal(date) { stored = true }
+    }
+    if !stored { r.Diff.Metrics = append(r.Diff.Metrics, db.MetricChange{App: key, Metric: *mutation.Metric}) }
+  }
+  if mutation.Tracked != nil && *mutation.Tracked { r.Diff.Tracked = append(r.Diff.Tracked, key) }
+  if mutation.Tracked != nil && !*mutation.Tracked { r.Diff.Untracked = append(r.Diff.Untracked, key) }
+  if mutation.Metadata != nil { r.Diff.Metadata = append(r.Diff.Metadata, key) }
+  if !mutation.PurgeBefore.IsZero() {
+    samples, err := cfg.Store.GetDailyMetrics(cfg.Ctx, mutation.AppRef, time.Time{}, mutation.PurgeBefore)
+    if err != nil { return err }
+    r.Diff.Purged += len(samples)
+  }
+  return nil
+}
+
+// logDiff logs the diff of a dry run, one line per app
+func logDiff(cfg *config.Config, name string, diff *db.Diff) {
+  cfg.Trace.Info.Printf("%s dry run DIFF:\n    inserted: %d\n    tracked: %d\n    untracked: %d\n    samples: %d\n    metrics: %d\n    metadata: %d\n    archived: %d\n    purged: %d",
+    name, len(diff.Inserted), len(diff.Tracked), len(diff.Untracked), len(diff.Samples), len(diff.Metrics), len(diff.Metadata), diff.Archived, diff.Purged)
+  for _, key := range diff.Inserted { cfg.Trace.Info.Printf("+ insert %s", key) }
+  for _, key := range diff.Tracked { cfg.Trace.Info.Printf("+ track %s", key) }
+  for _, key := range diff.Untracked { cfg.Trace.Info.Printf("- track %s", key) }
+  for _, change := range diff.Samples {
+    cfg.Trace.Info.Printf("+ sample %s %s count %d", change.App, change.Sample.Date.Format(DATEPATTERN), change.Sample.PlayerCount)
+  }
+  for _, change := range diff.Metrics {
+    cfg.Trace.Info.Printf("+ metric %s %s avg %d peak %d gain %d", change.App, change.Metric.Date.Format(DATEPATTERN), change.Metric.AvgPlayers, change.Metric.Peak, change.Metric.Gain)
+  }
+  for _, key := range diff.Metadata { cfg.Trace.Info.Printf("~ metadata %s", key) }
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+  "context"
+  "testing"
+  "time"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+func TestDryRun(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+  cfg.DryRun = true
+
+  // An active app not yet tracked, with a sample past retention
+  app := db.App{
+    StaticData: db.StaticAppData{Name: "Dota 2", AppID: 570, Domain: "steam"},
+    Metrics:    []db.Metric{{Date: time.Now().UTC().AddDate(0, -1, 0), AvgPlayers: 100, Peak: 200}},
+  }
+  if err := cfg.Store.InsertApp(cfg.Ctx, &app); err != nil { t.Fatal(err) }
+  samples := []db.DailyMetric{{Date: time.Date(2020, time.January, 5, 0, 0, 0, 0, time.UTC), PlayerCount: 100}}
+  if err := cfg.Store.InsertDailyMetrics(cfg.Ctx, app.ID, samples); err != nil { t.Fatal(err) }
+
+  report, err := Track(cfg)
+  if err != nil || !report.DryRun || len(report.Diff.Tracked) != 1 || report.Diff.Tracked[0] != "steam:570" || report.NumSuccess != 1 {
+    t.Errorf("[FAIL] TestDryRun: unexpected track report %+v %v\n", report, err)
+  }
+
+  report, err = Monthly(cfg)
+  if err != nil || len(report.Diff.Metrics) != 1 || report.Diff.Purged != 1 {
+    t.Errorf("[FAIL] TestDryRun: unexpected monthly report %+v %v\n", report, err)
+  }
+
+  // Nothing was written, not even the job state
+  stored, err := cfg.Store.FindApp(cfg.Ctx, "steam", 570)
+  if err != nil || stored.Tracked || len(stored.Metrics) != 1 {
+    t.Errorf("[FAIL] TestDryRun: expected the app unchanged, got %+v %v\n", stored, err)
+  }
+  remaining, err := cfg.Store.GetDailyMetrics(cfg.Ctx, app.ID, time.Time{}, time.Time{})
+  if err != nil || len(remaining) != 1 {
+    t.Errorf("[FAIL] TestDryRun: expected the sample kept, got %d %v\n", len(remaining), err)
+  }
+  runs, err := cfg.Store.ListJobRuns(cfg.Ctx, db.ANYJOB, 10)
+  if err != nil || len(runs) != 0 {
+    t.Errorf("[FAIL] TestDryRun: expected no job runs recorded, got %+v %v\n", runs, err)
+  }
+  if _, err = cfg.Store.GetCheckpoint(cfg.Ctx, db.MONTHLY, cfg.Shard); err != db.ErrNotFound {
+    t.Errorf("[FAIL] TestDryRun: expected no checkpoint, got %v\n", err)
+  }
+}
+
+func TestDryRunPreviewExisting(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+
+  // A sample and a metric already stored, as an earlier attempt would leave them
+  month := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+  app := db.App{
+    StaticData: db.StaticAppData{Name: "Dota 2", AppID: 570, Domain: "steam"},
+    Metrics:    []db.Metric{{Date: month, AvgPlayers: 100, Peak: 200}},
+  }
+  if err := cfg.Store.InsertApp(cfg.Ctx, &app); err != nil { t.Fatal(err) }
+  sampled := time.Date(2020, time.February, 5, 8, 0, 0, 0, time.UTC)
+  if err := cfg.Store.InsertDailyMetrics(cfg.Ctx, app.ID, []db.DailyMetric{{Date: sampled, PlayerCount: 100}}); err != nil { t.Fatal(err) }
+
+  mutations := []db.Mutation{
+    {AppRef: app.ID, Sample: &db.DailyMetric{Date: sampled.Add(4 * time.Hour), PlayerCount: 120}},
+    {AppRef: app.ID, Sample: &db.DailyMetric{Date: sampled.AddDate(0, 0, 1), PlayerCount: 130}},
+    {AppRef: app.ID, Metric: &db.Metric{Date: month, AvgPlayers: 110}},
+    {AppRef: app.ID, Metric: &db.Metric{Date: month.AddDate(0, 1, 0), AvgPlayers: 120}},
+  }
+  apps := []*db.App{&app, &app, &app, &app}
+  report := jobReport{&db.JobRun{Diff: newDiff()}}
+  for _, err := range report.preview(cfg, mutations, apps) {
+    if err != nil { t.Fatal(err) }
+  }
+
+  // Only the writes ApplyMutations would not skip are listed
+  diff := report.Diff
+  if len(diff.Samples) != 1 || diff.Samples[0].Sample.PlayerCount != 130 {
+    t.Errorf("[FAIL] TestDryRunPreviewExisting: expected only the unsampled day, got %+v\n", diff.Samples)
+  }
+  if len(diff.Metrics) != 1 || diff.Metrics[0].Metric.AvgPlayers != 120 {
+    t.Errorf("[FAIL] TestDryRunPreviewExisting: expected only the missing month, got %+v\n", diff.Metrics)
+  }
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+  "context"
+  "errors"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+  "github.com/j-leg/tracula/internal/stats"
+)
+
+// Enrich refreshes the store metadata of apps whose metadata is missing or
+// older than cfg.MetadataTTL
+func Enrich(cfg *config.Config) (*db.JobRun, error) {
+  return withLease(cfg, db.ENRICH, func(lease *jobLease) (*db.JobRun, error) {
+    return execute(cfg, db.ENRICH, enrichAtomic, lease, nil)
+  })
+}
+
+func metadataTTL(cfg *config.Config) time.Duration {
+  if cfg.MetadataTTL > 0 { return cfg.MetadataTTL }
+  return config.METADATATTL * 24 * time.Hour
+}
+
+func enrichAtomic(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
+  var err error
+  var mutation *db.Mutation
+  defer finaliseAtomic(ctx, ch, app, &mutation, &err)
+
+  var metadata *stats.Metadata
+  err = withRetry(ctx, cfg, func() (fetchErr error) {
+    metadata, fetchErr = stats.FetchMetadata(ctx, cfg.Fetch, app.StaticData.Domain, app.StaticData.AppID)
+    return fetchErr
+  })
+
+  // Stamp apps without metadata too, so they wait for the next cadence
+  if errors.Is(err, stats.ErrNoMetadata) {
+    err = nil
+    metadata = nil
+  }
+  if err != nil { return }
+
+  mutation = &db.Mutation{AppRef: app.ID, Metadata: constructMetadata(metadata)}
+}
+
+func constructMetadata(metadata *stats.Metadata) *db.AppMetadata {
+  updatedAt := time.Now().UTC()
+  if metadata == nil {
+    return &db.AppMetadata{Unavailable: true, UpdatedAt: updatedAt}
+  }
+
+  newMetadata := db.AppMetadata{
+    Type:        metadata.Type,
+    Genres:      metadata.Genres,
+    Developers:  metadata.Developers,
+    Publishers:  metadata.Publishers,
+    ReleaseDate: metadata.ReleaseDate,
+    ReleaseText: metadata.ReleaseText,
+    ComingSoon:  metadata.ComingSoon,
+    IsFree:      metadata.IsFree,
+    UpdatedAt:   updatedAt,
+  }
+  if metadata.Price != nil {
+    newMetadata.Price = &db.Price{
+      Currency:        metadata.Price.Currency,
+      Initial:         metadata.Price.Initial,
+      Final:           metadata.Price.Final,
+      DiscountPercent: metadata.Price.DiscountPercent,
+    }
+  }
+  return &newMetadata
+}
@@ -0,0 +1,264 @@
+package core
+
+import (
+  "context"
+  "fmt"
+  "os"
+  "time"
+  "github.com/cheggaaa/pb/v3"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+  "github.com/j-leg/tracula/internal/stats"
+)
+
+// jobTotals are the counters of a logical run, kept on its checkpoint
+type jobTotals struct {
+  numSuccess int
+  numErrors  int
+}
+
+// jobName is used in logs and reports
+func jobName(jobType int) string {
+  switch jobType {
+  case db.DAILY:
+    return "daily"
+  case db.MONTHLY:
+    return "monthly"
+  case db.RECOVERY:
+    return "recovery"
+  case db.REFRESH:
+    return "refresh"
+  case db.TRACK:
+    return "track"
+  case db.ENRICH:
+    return "enrich"
+  default:
+    return "unknown"
+  }
+}
+
+// recordsExceptions reports whether failures of the job are left to the
+// recovery job. Recovery reschedules its own exceptions and refresh inserts
+// apps the next refresh finds again.
+func recordsExceptions(jobType int) bool {
+  return jobType != db.RECOVERY && jobType != db.REFRESH
+}
+
+// sliceIterator iterates apps already in memory, such as the apps Refresh discovers
+type sliceIterator struct {
+  apps []*db.App
+  pos  int
+}
+
+func newSliceIterator(apps []*db.App) *sliceIterator { return &sliceIterator{apps: apps} }
+
+func (it *sliceIterator) Next(ctx context.Context) bool {
+  if it.pos >= len(it.apps) { return false }
+  it.pos++
+  return true
+}
+
+func (it *sliceIterator) App() (*db.App, error) { return it.apps[it.pos-1], nil }
+
+func (it *sliceIterator) Err() error { return nil }
+
+func (it *sliceIterator) Close(ctx context.Context) error { return nil }
+
+// runPool runs the atomic over every app of the cursor on a fixed pool of
+// Concurrency.Max workers. Apps are handed out as soon as a worker is free,
+// up to the adaptive limit in flight, so a slow app only holds up its own
+// worker. Each atomic is cancelled after Concurrency.TaskTimeout. Progress is
+// checkpointed to run, if it keeps checkpoints, so a run stopped by the
+// timeout is resumed by the next invocation. The report covers this
+// invocation, along with the steps the job ran ahead of the pool.
+// Losing the job's lease, if it has one, stops the job like a timeout.
+//
+// The function timeout and closing cfg.Stop stop the job: nothing more is
+// dispatched and the atomics in flight have Concurrency.GracePeriod to finish
+// before they are cancelled. Cancelling cfg.Ctx aborts the job at once. Apps
+// left unfinished either way are reported as skipped, not as errors. Signals
+// are left to the caller, which stops the job through either.
+func runPool(cfg *config.Config, jobType int, numDocuments int, cursor db.AppIterator, atomic executeAtomic, run *jobRun, lease *jobLease, steps *jobSteps) *db.JobRun {
+  defer cursor.Close(cfg.Ctx)
+
+  // Local - only
+  var bar *pb.ProgressBar
+  var timeout <-chan time.Time
+
+  if cfg.LocalEnabled {
+    bar = pb.StartNew(numDocuments)
+    bar.SetRefreshRate(time.Second)
+    bar.SetWriter(os.Stdout)
+    bar.Start()
+    timeout = time.After(LOCALFUNCDURATION * time.Minute)
+  } else {
+    timeout = time.After(FUNCTIONDURATION * time.Minute)
+  }
+
+  concurrency := newAdaptiveConcurrency(cfg)
+  report := newJobReport(cfg, jobType, run)
+  report.addSteps(steps)
+  writer := newBatchWriter(cfg, jobType, report)
+  defaults := config.DefaultConcurrency()
+  taskTimeout := cfg.Concurrency.TaskTimeout
+  if taskTimeout <= 0 { taskTimeout = defaults.TaskTimeout }
+  gracePeriod := cfg.Concurrency.GracePeriod
+  if gracePeriod <= 0 { gracePeriod = defaults.GracePeriod }
+
+  // Atomics run under the job context, cancelled once the job is over
+  jobCtx, cancel := context.WithCancel(cfg.Ctx)
+  defer cancel()
+
+  // Both channels hold a message per worker, so workers never block on a
+  // dispatcher that has stopped listening
+  numWorkers := concurrency.max
+  tasks := make(chan *db.App, numWorkers)
+  results := make(chan msgAtomic, numWorkers)
+  for i := 0; i < numWorkers; i++ {
+    go func() {
+      for app := range tasks {
+        ctx, cancelTask := context.WithTimeout(jobCtx, taskTimeout)
+        atomic(ctx, app, cfg, results)
+        cancelTask()
+      }
+    }()
+  }
+  defer close(tasks)
+
+  // The checkpoint counts the whole run, carrying over earlier invocations
+  base := run.totals()
+  current := func() jobTotals {
+    return jobTotals{
+      numSuccess: base.numSuccess + report.NumSuccess,
+      numErrors:  base.numErrors + report.NumErrors + report.NumTimedOut,
+    }
+  }
+
+  var checkpoint <-chan time.Time
+  if run.enabled() {
+    ticker := time.NewTicker(CHECKPOINTINTERVAL * time.Minute)
+    defer ticker.Stop()
+    checkpoint = ticker.C
+  }
+
+  lost := lease.lost()
+  var next *db.App
+  var cursorErr error
+  var grace <-chan time.Time
+  exhausted, stopping, aborted := false, false, false
+  inFlight := make(map[*db.App]bool)
+  stop := func(reason string) {
+    if stopping { return }
+    stopping = true
+    grace = time.After(gracePeriod)
+    cfg.Trace.Info.Printf("%s. Draining %d apps in flight.", reason, len(inFlight))
+  }
+
+  // The adaptive limit is adjusted after each window of as many completions
+  windowSize, windowDone, windowStart := concurrency.limit(), 0, time.Now()
+
+loop:
+  for {
+    for next == nil && !exhausted && !stopping {
+      if !cursor.Next(cfg.Ctx) {
+        exhausted = true
+        if cursorErr = cursor.Err(); cursorErr != nil { cfg.Trace.Error.Printf("Error iterating apps. %s", cursorErr) }
+        break
+      }
+      app, err := cursor.App()
+      if err != nil {
+        cfg.Trace.Error.Printf("Error decoding. %s", err)
+        continue
+      }
+      // Already counted by the invocation that completed it, dispatching it
+      // lets the watermark move past it
+      if run.completed(app.ID) {
+        run.markDispatched(app.ID)
+        continue
+      }
+      next = app
+    }
+    if (next == nil || stopping) && len(inFlight) == 0 { break }
+
+    // A nil channel never receives, so nothing is dispatched above the limit
+    // or once the job is stopping
+    var dispatch chan<- *db.App
+    if next != nil && !stopping && len(inFlight) < concurrency.limit() { dispatch = tasks }
+
+    select {
+    case dispatch <- next:
+      run.markDispatched(next.ID)
+      inFlight[next] = true
+      next = nil
+    case msg := <-results:
+      delete(inFlight, msg.app)
+      if msg.err != nil && cfg.Ctx.Err() != nil {
+        report.skip(msg.app)
+        continue
+      }
+
+      run.markDone(msg.app.ID)
+      concurrency.record(msg.err)
+      if msg.err == nil {
+        writer.add(msg)
+      } else {
+        cfg.Trace.Error.Printf("Error process [%s] app %s - %s", jobName(jobType), msg.ID, msg.err.Error())
+        report.failure(msg.app, msg.err)
+        // Apps failing for good are only reported, Recover would fail them again
+        if recordsExceptions(jobType) && !stats.Permanent(msg.err) { recordException(cfg, msg.app, jobType, msg.err) }
+      }
+      if cfg.LocalEnabled { bar.Increment() }
+
+      if windowDone++; windowDone >= windowSize {
+        concurrency.adjust(time.Since(windowStart))
+        windowSize, windowDone, windowStart = concurrency.limit(), 0, time.Now()
+      }
+    case <-checkpoint:
+      writer.flush()
+      run.save(current())
+    case <-lost:
+      stop("Lease lost to another invocation")
+      lost = nil
+    case <-timeout:
+      stop("Process timeout signal received")
+    case <-cfg.Stop:
+      stop("Stop requested")
+    case <-grace:
+      cfg.Trace.Info.Printf("Grace period over. Cancelling %d apps in flight.", len(inFlight))
+      break loop
+    case <-cfg.Ctx.Done():
+      cfg.Trace.Info.Printf("Job cancelled. Abandoning %d apps in flight.", len(inFlight))
+      aborted = true
+      break loop
+    }
+  }
+
+  cancel()
+  for app := range inFlight {
+    report.skip(app)
+  }
+
+  // Writes of an aborted job would fail on the cancelled context
+  if aborted {
+    for _, app := range writer.discard() {
+      run.unmarkDone(app.ID)
+      report.skip(app)
+    }
+  } else {
+    writer.flush()
+  }
+
+  // A run cut short is resumed by the next invocation
+  complete := !stopping && !aborted && cursorErr == nil
+  if complete {
+    run.complete()
+  } else {
+    run.save(current())
+  }
+  if bar != nil { bar.Finish() }
+  return report.finish(cfg, complete)
+}
+
+func appKey(app *db.App) string {
+  return fmt.Sprintf("%s:%d", app.StaticData.Domain, app.StaticData.AppID)
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sync/atomic"
+  "syscall"
+  "testing"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+  "github.com/j-leg/tracula/internal/stats"
+)
+
+// openTestConfig returns a config backed by a SQLite store in a temporary
+// directory, logging nowhere
+func openTestConfig(t *testing.T, ctx context.Context) (*config.Config, string, func()) {
+  dir, err := ioutil.TempDir("", "tracula")
+  if err != nil { t.Fatal(err) }
+
+  cfg, err := config.InitSQLiteConfig(ctx, filepath.Join(dir, "tracula.db"))
+  if err != nil {
+    os.RemoveAll(dir)
+    t.Fatal(err)
+  }
+  cfg.Trace = config.NewStdLoggers(ioutil.Discard, ioutil.Discard)
+  return cfg, dir, func() {
+    cfg.Store.Close(context.Background())
+    os.RemoveAll(dir)
+  }
+}
+
+func TestRunPool(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+  cfg.Concurrency = config.Concurrency{Initial: 4, Min: 4, Max: 4, BatchLatency: time.Minute, TaskTimeout: 50 * time.Millisecond}
+
+  apps := make([]*db.App, 20)
+  for i := range apps {
+    apps[i] = &db.App{StaticData: db.StaticAppData{AppID: i, Domain: "steam"}}
+  }
+
+  var inFlight, maxInFlight int32
+  slowAtomic := func(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
+    var err error
+    defer finaliseAtomic(ctx, ch, app, nil, &err)
+
+    current := atomic.AddInt32(&inFlight, 1)
+    defer atomic.AddInt32(&inFlight, -1)
+    for {
+      seen := atomic.LoadInt32(&maxInFlight)
+      if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) { break }
+    }
+
+    // The first app hangs until its task timeout
+    if app.StaticData.AppID == 0 {
+      <-ctx.Done()
+      err = ctx.Err()
+    }
+  }
+
+  report := runPool(cfg, db.REFRESH, len(apps), newSliceIterator(apps), slowAtomic, nil, nil, nil)
+  if report.NumSuccess != 19 || report.NumTimedOut != 1 || report.NumErrors != 0 || report.Domains["steam"].TimedOut != 1 {
+    t.Errorf("[FAIL] TestRunPool: expected 19 successes and 1 timed out, got %+v\n", report)
+  }
+
+  runs, err := cfg.Store.ListJobRuns(cfg.Ctx, db.ANYJOB, 10)
+  if err != nil || len(runs) != 1 || runs[0].RunID != report.RunID || !runs[0].Complete || len(runs[0].ErrorSamples) != 1 {
+    t.Errorf("[FAIL] TestRunPool: unexpected job runs %+v %v\n", runs, err)
+  }
+  if maxInFlight > 4 {
+    t.Errorf("[FAIL] TestRunPool: expected at most 4 atomics in flight, got %d\n", maxInFlight)
+  }
+}
+
+func TestRunPoolCancel(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  cfg, _, cleanup := openTestConfig(t, ctx)
+  defer cleanup()
+  cfg.Concurrency = config.Concurrency{Initial: 4, Min: 4, Max: 4, BatchLatency: time.Minute, TaskTimeout: time.Minute}
+
+  apps := make([]*db.App, 10)
+  for i := range apps {
+    apps[i] = &db.App{StaticData: db.StaticAppData{AppID: i, Domain: "steam"}}
+  }
+
+  // The first app hangs until the job is cancelled
+  hangingAtomic := func(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
+    var err error
+    defer finaliseAtomic(ctx, ch, app, nil, &err)
+
+    if app.StaticData.AppID == 0 {
+      <-ctx.Done()
+      err = ctx.Err()
+    }
+  }
+  time.AfterFunc(100 * time.Millisecond, cancel)
+
+  report := runPool(cfg, db.REFRESH, len(apps), newSliceIterator(apps), hangingAtomic, nil, nil, nil)
+  if report.NumSuccess != 9 || report.NumErrors != 0 || report.NumSkipped != 1 || report.Skipped[0] != "steam:0" || report.Complete {
+    t.Errorf("[FAIL] TestRunPoolCancel: expected 9 successes and steam:0 skipped, got %+v\n", report)
+  }
+
+  // The aborted run is still recorded
+  runs, err := cfg.Store.ListJobRuns(context.Background(), db.ANYJOB, 10)
+  if err != nil || len(runs) != 1 || runs[0].NumSkipped != 1 {
+    t.Errorf("[FAIL] TestRunPoolCancel: expected the aborted run to be recorded, got %+v %v\n", runs, err)
+  }
+}
+
+func TestRunPoolStop(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+  cfg.Concurrency = config.Concurrency{Initial: 4, Min: 4, Max: 4, BatchLatency: time.Minute, TaskTimeout: time.Minute, GracePeriod: 50 * time.Millisecond}
+  stop := make(chan struct{})
+  cfg.Stop = stop
+
+  apps := make([]*db.App, 10)
+  for i := range apps {
+    apps[i] = &db.App{StaticData: db.StaticAppData{AppID: i, Domain: "steam"}}
+  }
+
+  // The first app hangs past the grace period
+  hangingAtomic := func(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
+    var err error
+    defer finaliseAtomic(ctx, ch, app, nil, &err)
+
+    if app.StaticData.AppID == 0 {
+      <-ctx.Done()
+      err = ctx.Err()
+    }
+  }
+  time.AfterFunc(100 * time.Millisecond, func() { close(stop) })
+
+  report := runPool(cfg, db.REFRESH, len(apps), newSliceIterator(apps), hangingAtomic, nil, nil, nil)
+  if report.NumSuccess != 9 || report.NumSkipped != 1 || report.Skipped[0] != "steam:0" || report.Complete {
+    t.Errorf("[FAIL] TestRunPoolStop: expected 9 successes and steam:0 skipped, got %+v\n", report)
+  }
+}
+
+func TestRunPoolPermanentErrors(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+
+  gone := db.App{StaticData: db.StaticAppData{Name: "Gone", AppID: 1, Domain: "steam"}}
+  flaky := db.App{StaticData: db.StaticAppData{Name: "Flaky", AppID: 2, Domain: "steam"}}
+  for _, app := range []*db.App{&gone, &flaky} {
+    if err := cfg.Store.InsertApp(cfg.Ctx, app); err != nil { t.Fatal(err) }
+  }
+
+  failingAtomic := func(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
+    err := error(&stats.FetchError{Domain: "steam", Class: stats.ErrTransient, Err: errors.New("reset")})
+    if app.StaticData.AppID == 1 { err = &stats.FetchError{Domain: "steam", Class: stats.ErrAppNotFound, Err: errors.New("gone")} }
+    defer finaliseAtomic(ctx, ch, app, nil, &err)
+  }
+
+  // Only the app that may recover gets an exception
+  apps := []*db.App{&gone, &flaky}
+  report := runPool(cfg, db.DAILY, len(apps), newSliceIterator(apps), failingAtomic, nil, nil, nil)
+  if report.NumErrors != 2 {
+    t.Errorf("[FAIL] TestRunPoolPermanentErrors: expected 2 errors, got %+v\n", report)
+  }
+  // Recording again bumps the attempts of the exception the job left, if any
+  for _, c := range []struct {
+    app      *db.App
+    attempts int
+  }{{&gone, 1}, {&flaky, 2}} {
+    exception, err := cfg.Store.RecordException(cfg.Ctx, c.app, db.DAILY, errors.New("again"))
+    if err != nil || exception.Attempts != c.attempts {
+      t.Errorf("[FAIL] TestRunPoolPermanentErrors: app %d has exception %+v %v\n", c.app.StaticData.AppID, exception, err)
+    }
+  }
+}
+
+func TestRunPoolSignal(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+  cfg.Concurrency = config.Concurrency{Initial: 4, Min: 4, Max: 4, BatchLatency: time.Minute, TaskTimeout: time.Minute, GracePeriod: 50 * time.Millisecond}
+  stop, release := config.StopOnSignals()
+  defer release()
+  cfg.Stop = stop
+
+  apps := make([]*db.App, 10)
+  for i := range apps {
+    apps[i] = &db.App{StaticData: db.StaticAppData{AppID: i, Domain: "steam"}}
+  }
+
+  // The first app hangs past the grace period
+  hangingAtomic := func(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
+    var err error
+    defer finaliseAtomic(ctx, ch, app, nil, &err)
+
+    if app.StaticData.AppID == 0 {
+      <-ctx.Done()
+      err = ctx.Err()
+    }
+  }
+  process, err := os.FindProcess(os.Getpid())
+  if err != nil { t.Fatal(err) }
+  time.AfterFunc(100 * time.Millisecond, func() { process.Signal(syscall.SIGTERM) })
+
+  report := runPool(cfg, db.REFRESH, len(apps), newSliceIterator(apps), hangingAtomic, nil, nil, nil)
+  if report.NumSuccess != 9 || report.NumSkipped != 1 || report.Skipped[0] != "steam:0" || report.Complete {
+    t.Errorf("[FAIL] TestRunPoolSignal: expected 9 successes and steam:0 skipped, got %+v\n", report)
+  }
+}
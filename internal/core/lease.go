@@ -0,0 +1,161 @@
+package core
+
+import (
+  "errors"
+  "fmt"
+  "os"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrAlreadyRunning is returned by a job whose lease another invocation holds
+var ErrAlreadyRunning = errors.New("job already running")
+
+// SHARDSOWNER owns the job-level lease while a job runs sharded, every shard
+// of the same count takes it as this owner
+const SHARDSOWNER = "shards:%d"
+
+// jobLease keeps a job, or a shard of it, from running in two invocations at
+// once. withLease renews it for as long as the job runs, an invocation that
+// dies lets it expire.
+type jobLease struct {
+  cfg     *config.Config
+  jobType int
+  shard   db.Shard
+  owner   string
+  ttl     time.Duration
+  lostCh  chan struct{} // Closed once another owner takes the lease over
+  shards  *jobLease     // Job-level lease shared by the shards of a sharded run
+  joined  bool          // The shard joins the lease rather than taking it alone
+}
+
+// acquireLease fails with ErrAlreadyRunning if another owner holds the
+// job's lease. Stores that cannot keep leases run the job unguarded, a nil
+// lease is a no-op.
+//
+// A shard also joins the job-level lease as SHARDSOWNER of its count, so
+// unsharded runs and runs split into another count are kept out while any
+// shard runs. The last shard to leave drops it, a shard that died without
+// leaving keeps it until it expires.
+func acquireLease(cfg *config.Config, jobType int) (*jobLease, error) {
+  lease := jobLease{cfg: cfg, jobType: jobType, shard: cfg.Shard, owner: cfg.Owner, ttl: cfg.LeaseTTL, lostCh: make(chan struct{})}
+  if lease.owner == "" { lease.owner = defaultOwner() }
+  if lease.ttl <= 0 { lease.ttl = config.LEASETTL * time.Minute }
+
+  err := lease.acquire()
+  if errors.Is(err, db.ErrNotSupported) {
+    cfg.Trace.Info.Printf("Store cannot keep leases, running %s unguarded", jobName(jobType))
+    return nil, nil
+  }
+  if err != nil { return nil, err }
+
+  // The shard's own lease is taken first, it is the only one safe to drop
+  // when the job-level one is held by another layout
+  if lease.shard.Sharded() {
+    shards := &jobLease{cfg: cfg, jobType: jobType, shard: lease.shard, owner: fmt.Sprintf(SHARDSOWNER, lease.shard.Count), ttl: lease.ttl, joined: true}
+    if err = shards.acquire(); err != nil {
+      lease.release()
+      return nil, err
+    }
+    lease.shards = shards
+  }
+  return &lease, nil
+}
+
+// acquire takes the lease, failing with ErrAlreadyRunning if another owner holds it
+func (l *jobLease) acquire() error {
+  held, err := l.take()
+  if errors.Is(err, db.ErrLeaseHeld) {
+    return fmt.Errorf("%w: %s lease held by %s until %s", ErrAlreadyRunning, jobName(l.jobType), held.Owner, held.ExpiresAt.Format(DATEPATTERN))
+  }
+  return err
+}
+
+// defaultOwner is unique to the invocation, the host and process help trace it
+func defaultOwner() string {
+  host, err := os.Hostname()
+  if err != nil { host = "unknown" }
+  return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), primitive.NewObjectID().Hex())
+}
+
+// keepAlive renews the lease every third of its TTL until done is closed,
+// giving up once another owner takes it over
+func (l *jobLease) keepAlive(done <-chan struct{}) {
+  for {
+    select {
+    case <-done:
+      return
+    case <-time.After(l.ttl / 3):
+    }
+
+    err := l.renew()
+    if errors.Is(err, db.ErrLeaseHeld) {
+      l.cfg.Trace.Error.Printf("%s lease lost to another invocation", jobName(l.jobType))
+      close(l.lostCh)
+      return
+    }
+    if err != nil { l.cfg.Trace.Error.Printf("Error renewing %s lease - %s", jobName(l.jobType), err) }
+  }
+}
+
+// lost is closed once another owner takes the lease over, a nil lease is never lost
+func (l *jobLease) lost() <-chan struct{} {
+  if l == nil { return nil }
+  return l.lostCh
+}
+
+// renew extends the lease, and the job-level one of a shard, db.ErrLeaseHeld
+// means another owner took it over
+func (l *jobLease) renew() error {
+  if l == nil { return nil }
+  if err := l.shards.renew(); err != nil { return err }
+  _, err := l.take()
+  return err
+}
+
+// take takes or renews the lease in the store
+func (l *jobLease) take() (*db.Lease, error) {
+  if l.joined { return l.cfg.Store.JoinLease(l.cfg.Ctx, l.jobType, l.shard, l.owner, l.ttl) }
+  return l.cfg.Store.AcquireLease(l.cfg.Ctx, l.jobType, l.shard, l.owner, l.ttl)
+}
+
+// release drops the lease, and leaves the job-level one of a shard
+func (l *jobLease) release() {
+  if l == nil { return }
+  ctx, cancel := bookkeepingContext()
+  defer cancel()
+  var err error
+  if l.joined {
+    err = l.cfg.Store.LeaveLease(ctx, l.jobType, l.shard, l.owner)
+  } else {
+    err = l.cfg.Store.ReleaseLease(ctx, l.jobType, l.shard, l.owner)
+  }
+  if err != nil { l.cfg.Trace.Error.Printf("Error releasing %s lease, it expires on its own - %s", jobName(l.jobType), err) }
+  l.shards.release()
+}
+
+// withLease runs the job while holding the lease of its shard, renewing it
+// until the job returns, including the steps a job runs ahead of its pool.
+// Dry runs write nothing so they run alongside the job, without a lease.
+func withLease(cfg *config.Config, jobType int, job func(lease *jobLease) (*db.JobRun, error)) (*db.JobRun, error) {
+  if err := cfg.Shard.Validate(); err != nil { return nil, err }
+  if cfg.DryRun { return job(nil) }
+  lease, err := acquireLease(cfg, jobType)
+  if err != nil { return nil, err }
+  defer lease.release()
+  if lease == nil { return job(nil) }
+
+  // The renewals stop before the lease is released, so none can take it back
+  done, stopped := make(chan struct{}), make(chan struct{})
+  go func() {
+    lease.keepAlive(done)
+    close(stopped)
+  }()
+  defer func() {
+    close(done)
+    <-stopped
+  }()
+  return job(lease)
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+func TestJobLease(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+
+  if _, err := cfg.Store.AcquireLease(cfg.Ctx, db.DAILY, cfg.Shard, "other", time.Minute); err != nil { t.Fatal(err) }
+  if _, err := Daily(cfg); !errors.Is(err, ErrAlreadyRunning) {
+    t.Errorf("[FAIL] TestJobLease: expected ErrAlreadyRunning, got %v\n", err)
+  }
+
+  // Once released the job runs and leaves the lease free again
+  if err := cfg.Store.ReleaseLease(cfg.Ctx, db.DAILY, cfg.Shard, "other"); err != nil { t.Fatal(err) }
+  report, err := Daily(cfg)
+  if err != nil || !report.Complete {
+    t.Errorf("[FAIL] TestJobLease: expected a complete run, got %+v %v\n", report, err)
+  }
+  if _, err = cfg.Store.AcquireLease(cfg.Ctx, db.DAILY, cfg.Shard, "other", time.Minute); err != nil {
+    t.Errorf("[FAIL] TestJobLease: expected the lease released, got %v\n", err)
+  }
+}
+
+func TestJobLeaseRenewed(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+  cfg.LeaseTTL = 1500 * time.Millisecond
+
+  // A job outliving the TTL ahead of its pool still holds the lease
+  _, err := withLease(cfg, db.MONTHLY, func(lease *jobLease) (*db.JobRun, error) {
+    time.Sleep(2 * time.Second)
+    _, err := cfg.Store.AcquireLease(cfg.Ctx, db.MONTHLY, cfg.Shard, "other", time.Minute)
+    return nil, err
+  })
+  if !errors.Is(err, db.ErrLeaseHeld) {
+    t.Errorf("[FAIL] TestJobLeaseRenewed: expected the lease renewed, got %v\n", err)
+  }
+}
+
+func TestShardLeases(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+
+  cfg.Shard = db.Shard{Index: 0, Count: 2}
+  first, err := acquireLease(cfg, db.DAILY)
+  if err != nil { t.Fatal(err) }
+
+  // Shards of the same count run side by side, other layouts are kept out
+  cfg.Shard = db.Shard{Index: 1, Count: 2}
+  second, err := acquireLease(cfg, db.DAILY)
+  if err != nil {
+    t.Errorf("[FAIL] TestShardLeases: expected the second shard to run, got %v\n", err)
+  }
+  second.release()
+  for _, shard := range []db.Shard{{}, {Index: 2, Count: 3}} {
+    cfg.Shard = shard
+    if _, err = acquireLease(cfg, db.DAILY); !errors.Is(err, ErrAlreadyRunning) {
+      t.Errorf("[FAIL] TestShardLeases: expected ErrAlreadyRunning for %+v, got %v\n", shard, err)
+    }
+    // A shard kept out does not hold on to its own lease
+    if shard.Sharded() {
+      if _, err = cfg.Store.AcquireLease(cfg.Ctx, db.DAILY, shard, "other", time.Minute); err != nil {
+        t.Errorf("[FAIL] TestShardLeases: expected the lease of %+v released, got %v\n", shard, err)
+      }
+    }
+  }
+
+  // The last shard to finish lets other layouts run
+  first.release()
+  cfg.Shard = db.Shard{}
+  lease, err := acquireLease(cfg, db.DAILY)
+  if err != nil {
+    t.Errorf("[FAIL] TestShardLeases: expected the job-level lease dropped with the last shard, got %v\n", err)
+  }
+  lease.release()
+}
+
+func TestShardLeaseHeld(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+
+  // A shard already running elsewhere leaves the job-level lease alone
+  cfg.Shard = db.Shard{Index: 1, Count: 2}
+  if _, err := cfg.Store.AcquireLease(cfg.Ctx, db.DAILY, cfg.Shard, "other", time.Minute); err != nil { t.Fatal(err) }
+  if _, err := acquireLease(cfg, db.DAILY); !errors.Is(err, ErrAlreadyRunning) {
+    t.Errorf("[FAIL] TestShardLeaseHeld: expected ErrAlreadyRunning, got %v\n", err)
+  }
+  cfg.Shard = db.Shard{}
+  lease, err := acquireLease(cfg, db.DAILY)
+  if err != nil {
+    t.Errorf("[FAIL] TestShardLeaseHeld: expected the job-level lease free, got %v\n", err)
+  }
+  lease.release()
+}
@@ -0,0 +1,29 @@
+package core
+
+import (
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+// MigrateUp applies the pending schema migrations, logging each one
+func MigrateUp(cfg *config.Config) ([]db.MigrationStatus, error) {
+  applied, err := cfg.Store.MigrateUp(cfg.Ctx)
+  for _, m := range applied {
+    cfg.Trace.Info.Printf("Applied migration %d - %s", m.Version, m.Description)
+  }
+  if err != nil {
+    cfg.Trace.Error.Printf("Error applying migrations: %s", err)
+    return applied, err
+  }
+  if len(applied) == 0 { cfg.Trace.Info.Println("Schema is up to date") }
+  return applied, nil
+}
+
+// SchemaVersion returns the highest applied migration, 0 if none have been
+func SchemaVersion(statusList []db.MigrationStatus) int {
+  version := 0
+  for _, status := range statusList {
+    if status.Applied { version = max(version, status.Version) }
+  }
+  return version
+}
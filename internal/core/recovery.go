@@ -0,0 +1,154 @@
+package core
+
+import (
+  "context"
+  "fmt"
+  "strings"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+  "github.com/j-leg/tracula/internal/stats"
+)
+
+const (
+  MAXATTEMPTS     = 5  // Exceptions are parked after this many failed attempts
+  RECOVERYBACKOFF = 30 // Minutes before the first retry, doubled on each attempt
+)
+
+// recordException saves a failed atomic so the recovery job can retry it
+func recordException(cfg *config.Config, app *db.App, jobType int, cause error) {
+  if cfg.DryRun { return }
+  exception, err := cfg.Store.RecordException(cfg.Ctx, app, jobType, cause)
+  if err != nil {
+    cfg.Trace.Error.Printf("Error recording exception for app %s - %s", app.ID.String(), err)
+    return
+  }
+  err = scheduleException(cfg.Ctx, exception, cfg)
+  if err != nil {
+    cfg.Trace.Error.Printf("Error scheduling exception for app %s - %s", app.ID.String(), err)
+  }
+}
+
+// scheduleException backs off exponentially on the attempt count and parks
+// the exception once it reaches MAXATTEMPTS
+func scheduleException(ctx context.Context, exception *db.Exception, cfg *config.Config) error {
+  parked := exception.Attempts >= MAXATTEMPTS
+  next := exception.UpdatedAt.Add(backoff(exception.Attempts))
+  return cfg.Store.ScheduleException(ctx, exception.ID, next, parked)
+}
+
+func backoff(attempts int) time.Duration {
+  if attempts < 1 { attempts = 1 }
+  return RECOVERYBACKOFF * time.Minute * time.Duration(1<<uint(attempts-1))
+}
+
+// atomicForJob resolves the atomic that originally failed
+func atomicForJob(jobType int) (executeAtomic, error) {
+  switch jobType {
+  case db.DAILY:
+    return dailyAtomic, nil
+  case db.MONTHLY:
+    return monthlyAtomic, nil
+  case db.TRACK:
+    return trackAtomic, nil
+  case db.ENRICH:
+    return enrichAtomic, nil
+  default:
+    return nil, fmt.Errorf("Unrecoverable job type %d", jobType)
+  }
+}
+
+// recoverAtomic re-runs each due exception of an app, deleting the
+// exceptions that succeed and rescheduling the rest
+func recoverAtomic(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
+  var err error
+  var mutation *db.Mutation
+  defer finaliseAtomic(ctx, ch, app, &mutation, &err)
+
+  var exceptions []db.Exception
+  exceptions, err = cfg.Store.GetDueExceptions(ctx, app.ID)
+  if err != nil { return }
+
+  // A dry run leaves the exceptions in place and hands the retries' writes to the executor
+  if cfg.DryRun {
+    mutation, err = previewRecovery(ctx, app, exceptions, cfg)
+    return
+  }
+
+  var errorStrings []string
+  for _, exception := range exceptions {
+    jobErr := recoverException(ctx, app, &exception, cfg)
+    if jobErr != nil {
+      errorStrings = append(errorStrings, jobErr.Error())
+    }
+  }
+
+  if len(errorStrings) > 0 {
+    err = fmt.Errorf(strings.Join(errorStrings, "\n"))
+  }
+}
+
+func recoverException(ctx context.Context, app *db.App, exception *db.Exception, cfg *config.Config) error {
+  atomic, err := atomicForJob(exception.JobType)
+  if err != nil {
+    // Nothing can ever run it, so park it straight away
+    cfg.Store.ScheduleException(ctx, exception.ID, exception.NextAttempt, true)
+    return err
+  }
+
+  resultChannel := make(chan msgAtomic, 1)
+  atomic(ctx, app, cfg, resultChannel)
+  msg := <-resultChannel
+
+  // Recovery writes each retry straight away, the exception is only cleared once it lands
+  if msg.err == nil && msg.mutation != nil {
+    msg.err = writeErr(cfg, exception.JobType, app, cfg.Store.ApplyMutations(ctx, []db.Mutation{*msg.mutation})[0])
+  }
+  if msg.err == nil {
+    return cfg.Store.DeleteException(ctx, exception.ID)
+  }
+  // Another attempt would fail the same way
+  if stats.Permanent(msg.err) {
+    if err = cfg.Store.DeleteException(ctx, exception.ID); err != nil { return err }
+    return msg.err
+  }
+
+  updated, err := cfg.Store.RecordException(ctx, app, exception.JobType, msg.err)
+  if err != nil { return err }
+  if err = scheduleException(ctx, updated, cfg); err != nil { return err }
+  return msg.err
+}
+
+// previewRecovery retries the exceptions without writing, merging the writes
+// of the retries that succeed. Each job writes its own fields of the app.
+func previewRecovery(ctx context.Context, app *db.App, exceptions []db.Exception, cfg *config.Config) (*db.Mutation, error) {
+  merged := db.Mutation{AppRef: app.ID}
+  var errorStrings []string
+  for _, exception := range exceptions {
+    atomic, err := atomicForJob(exception.JobType)
+    if err != nil {
+      errorStrings = append(errorStrings, err.Error())
+      continue
+    }
+
+    resultChannel := make(chan msgAtomic, 1)
+    atomic(ctx, app, cfg, resultChannel)
+    msg := <-resultChannel
+    if msg.err != nil {
+      errorStrings = append(errorStrings, msg.err.Error())
+      continue
+    }
+    if msg.mutation != nil { mergeMutation(&merged, msg.mutation) }
+  }
+
+  if len(errorStrings) > 0 { return nil, fmt.Errorf(strings.Join(errorStrings, "\n")) }
+  return &merged, nil
+}
+
+func mergeMutation(dst *db.Mutation, src *db.Mutation) {
+  if src.Sample != nil { dst.Sample = src.Sample }
+  if src.Metric != nil { dst.Metric = src.Metric }
+  if !src.PurgeBefore.IsZero() { dst.PurgeBefore = src.PurgeBefore }
+  if src.Tracked != nil { dst.Tracked = src.Tracked }
+  if src.Metadata != nil { dst.Metadata = src.Metadata }
+}
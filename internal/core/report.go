@@ -0,0 +1,192 @@
+package core
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "strings"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+// MAXERRORSAMPLES is the number of errors kept on a job report
+const MAXERRORSAMPLES = 20
+
+// jobReport accumulates the report of a job invocation
+type jobReport struct {
+  *db.JobRun
+}
+
+func newJobReport(cfg *config.Config, jobType int, run *jobRun) *jobReport {
+  report := jobReport{&db.JobRun{
+    RunID:        run.runID(cfg),
+    JobType:      jobType,
+    Shard:        cfg.Shard,
+    Trigger:      cfg.Trigger,
+    StartedAt:    time.Now().UTC(),
+    Resumed:      run.resumed(),
+    Domains:      make(map[string]*db.DomainCounts),
+    ErrorSamples: make([]db.ErrorSample, 0),
+    Skipped:      make([]string, 0),
+    DryRun:       cfg.DryRun,
+  }}
+  if cfg.DryRun { report.Diff = newDiff() }
+  return &report
+}
+
+// jobSteps are the writes a job makes ahead of its pool of atomics, they are
+// added to the job's report
+type jobSteps struct {
+  inserted map[string]int // Apps inserted by incremental library syncs, by domain
+  archive  *ArchiveReport // Samples archived past the retention limit
+}
+
+// addSteps counts apps inserted by a sync as successes, like the apps the
+// pool inserts
+func (r *jobReport) addSteps(steps *jobSteps) {
+  if steps == nil { return }
+  for domain, numInserted := range steps.inserted {
+    r.NumSuccess += numInserted
+    r.domainCounts(domain).Success += numInserted
+  }
+  if steps.archive != nil {
+    r.NumArchived += steps.archive.Samples
+    r.NumPurged += steps.archive.Purged
+    if r.DryRun {
+      r.Diff.Archived += steps.archive.Samples
+      r.Diff.Purged += steps.archive.Purged
+    }
+  }
+}
+
+func (r *jobReport) domain(app *db.App) *db.DomainCounts {
+  return r.domainCounts(app.StaticData.Domain)
+}
+
+func (r *jobReport) domainCounts(domain string) *db.DomainCounts {
+  counts, ok := r.Domains[domain]
+  if !ok {
+    counts = &db.DomainCounts{}
+    r.Domains[domain] = counts
+  }
+  return counts
+}
+
+func (r *jobReport) success(app *db.App) {
+  r.NumSuccess++
+  r.domain(app).Success++
+}
+
+// failure counts atomics that ran out of time apart from other errors
+func (r *jobReport) failure(app *db.App, err error) {
+  if errors.Is(err, context.DeadlineExceeded) {
+    r.NumTimedOut++
+    r.domain(app).TimedOut++
+  } else {
+    r.NumErrors++
+    r.domain(app).Errors++
+  }
+  if len(r.ErrorSamples) < MAXERRORSAMPLES {
+    r.ErrorSamples = append(r.ErrorSamples, db.ErrorSample{Domain: app.StaticData.Domain, AppID: app.StaticData.AppID, Error: err.Error()})
+  }
+}
+
+func (r *jobReport) skip(app *db.App) {
+  r.NumSkipped++
+  r.domain(app).Skipped++
+  r.Skipped = append(r.Skipped, appKey(app))
+}
+
+// finish logs the report and records it, stores without a job run history
+// only log it. Dry runs log their diff and are not recorded. Aborted jobs are
+// recorded too, on a context detached from cfg.Ctx.
+func (r *jobReport) finish(cfg *config.Config, complete bool) *db.JobRun {
+  r.EndedAt = time.Now().UTC()
+  r.Complete = complete
+
+  name := jobName(r.JobType)
+  if r.Shard.Sharded() { name = fmt.Sprintf("%s shard %d/%d", name, r.Shard.Index, r.Shard.Count) }
+  cfg.Trace.Info.Printf("%s execution REPORT:\n    run: %s\n    success: %d\n    errors: %d\n    timed out: %d\n    skipped: %d\n    archived: %d\n    purged: %d\n    duration: %s",
+    name, r.RunID, r.NumSuccess, r.NumErrors, r.NumTimedOut, r.NumSkipped, r.NumArchived, r.NumPurged, r.EndedAt.Sub(r.StartedAt).Round(time.Second))
+  if len(r.Skipped) > 0 {
+    cfg.Trace.Info.Printf("%s skipped apps: %s", name, strings.Join(r.Skipped, ", "))
+  }
+
+  if r.DryRun {
+    logDiff(cfg, name, r.Diff)
+    return r.JobRun
+  }
+
+  ctx, cancel := bookkeepingContext()
+  defer cancel()
+  err := cfg.Store.RecordJobRun(ctx, r.JobRun)
+  if err != nil && !errors.Is(err, db.ErrNotSupported) {
+    cfg.Trace.Error.Printf("Error recording %s job run %s - %s", name, r.RunID, err)
+  }
+  return r.JobRun
+}
+
+// RunReport aggregates the reports of every invocation of a logical run, over
+// its shards and resumed invocations, into one. Apps skipped by an invocation
+// are picked up by the shard's next one, so only the latest invocation of each
+// shard counts skipped apps. The run is complete once every shard has
+// completed.
+func RunReport(cfg *config.Config, runID string) (*db.JobRun, error) {
+  runs, err := cfg.Store.GetJobRuns(cfg.Ctx, runID)
+  if err != nil { return nil, err }
+  if len(runs) == 0 { return nil, db.ErrNotFound }
+
+  report := &jobReport{&db.JobRun{
+    RunID:        runID,
+    JobType:      runs[0].JobType,
+    Shard:        db.Shard{Count: runs[0].Shard.Count},
+    Trigger:      runs[0].Trigger,
+    StartedAt:    runs[0].StartedAt,
+    Domains:      make(map[string]*db.DomainCounts),
+    ErrorSamples: make([]db.ErrorSample, 0),
+    Skipped:      make([]string, 0),
+  }}
+
+  // Runs are oldest first, so the latest invocation of a shard comes last
+  latest := make(map[int]db.JobRun)
+  completed := make(map[int]bool)
+  for _, run := range runs {
+    report.NumSuccess += run.NumSuccess
+    report.NumErrors += run.NumErrors
+    report.NumTimedOut += run.NumTimedOut
+    report.NumArchived += run.NumArchived
+    report.NumPurged += run.NumPurged
+    report.Resumed = report.Resumed || run.Resumed
+    if run.StartedAt.Before(report.StartedAt) { report.StartedAt = run.StartedAt }
+    if run.EndedAt.After(report.EndedAt) { report.EndedAt = run.EndedAt }
+    for domain, counts := range run.Domains {
+      total := report.domainCounts(domain)
+      total.Success += counts.Success
+      total.Errors += counts.Errors
+      total.TimedOut += counts.TimedOut
+    }
+    for _, sample := range run.ErrorSamples {
+      if len(report.ErrorSamples) >= MAXERRORSAMPLES { break }
+      report.ErrorSamples = append(report.ErrorSamples, sample)
+    }
+    latest[run.Shard.Index] = run
+    if run.Complete { completed[run.Shard.Index] = true }
+  }
+
+  for _, run := range latest {
+    report.NumSkipped += run.NumSkipped
+    report.Skipped = append(report.Skipped, run.Skipped...)
+    for domain, counts := range run.Domains {
+      report.domainCounts(domain).Skipped += counts.Skipped
+    }
+  }
+
+  numShards := report.Shard.Count
+  if numShards < 1 { numShards = 1 }
+  report.Complete = true
+  for i := 0; i < numShards; i++ {
+    report.Complete = report.Complete && completed[i]
+  }
+  return report.JobRun, nil
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+  "context"
+  "math/rand"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/stats"
+)
+
+// withRetry runs the fetch, retrying it under cfg.Retry while it fails with
+// a retryable error. Giving up early when the atomic's context ends, the last
+// error is returned.
+func withRetry(ctx context.Context, cfg *config.Config, fetch func() error) error {
+  policy := cfg.Retry
+  if policy.Attempts < 1 { policy = config.DefaultRetry() }
+
+  err := fetch()
+  for attempt := 1; attempt < policy.Attempts && stats.Retryable(err); attempt++ {
+    delay := retryDelay(policy, attempt)
+    cfg.Trace.Debug.Printf("Retrying fetch in %s after attempt %d - %s", delay.Round(time.Millisecond), attempt, err)
+
+    timer := time.NewTimer(delay)
+    select {
+    case <-ctx.Done():
+      timer.Stop()
+      return err
+    case <-timer.C:
+    }
+    err = fetch()
+  }
+  return err
+}
+
+// retryDelay doubles the base delay on each attempt up to the ceiling, the
+// jitter keeps atomics failing together from retrying together
+func retryDelay(policy config.Retry, attempt int) time.Duration {
+  delay := policy.BaseDelay
+  for i := 1; i < attempt && (policy.MaxDelay <= 0 || delay < policy.MaxDelay); i++ {
+    delay *= 2
+  }
+  if policy.MaxDelay > 0 && delay > policy.MaxDelay { delay = policy.MaxDelay }
+
+  jitter := policy.Jitter
+  if jitter > 1 { jitter = 1 }
+  if jitter > 0 { delay -= time.Duration(jitter * rand.Float64() * float64(delay)) }
+  return delay
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "testing"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/stats"
+)
+
+func TestWithRetry(t *testing.T) {
+  cfg := &config.Config{
+    Trace: config.NewStdLoggers(ioutil.Discard, ioutil.Discard),
+    Retry: config.Retry{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond, Jitter: 0.5},
+  }
+  transient := &stats.FetchError{Domain: "steam", Class: stats.ErrTransient, Err: errors.New("connection reset")}
+  notFound := &stats.FetchError{Domain: "steam", Class: stats.ErrAppNotFound, Err: errors.New("gone")}
+
+  // Retryable errors are retried until a fetch succeeds
+  attempts := 0
+  err := withRetry(context.Background(), cfg, func() error {
+    if attempts++; attempts < 3 { return transient }
+    return nil
+  })
+  if err != nil || attempts != 3 {
+    t.Errorf("[FAIL] TestWithRetry: expected success on attempt 3, got %d %v\n", attempts, err)
+  }
+
+  // Up to the policy's attempts
+  attempts = 0
+  err = withRetry(context.Background(), cfg, func() error { attempts++; return transient })
+  if err != transient || attempts != 3 {
+    t.Errorf("[FAIL] TestWithRetry: expected 3 failed attempts, got %d %v\n", attempts, err)
+  }
+
+  // Other classes are not
+  attempts = 0
+  err = withRetry(context.Background(), cfg, func() error { attempts++; return notFound })
+  if err != notFound || attempts != 1 {
+    t.Errorf("[FAIL] TestWithRetry: expected a single attempt, got %d %v\n", attempts, err)
+  }
+
+  // Nor once the atomic's context is over
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  attempts = 0
+  cfg.Retry.BaseDelay = time.Hour
+  err = withRetry(ctx, cfg, func() error { attempts++; return transient })
+  if err != transient || attempts != 1 {
+    t.Errorf("[FAIL] TestWithRetry: expected to give up on a done context, got %d %v\n", attempts, err)
+  }
+}
+
+func TestRetryDelay(t *testing.T) {
+  policy := config.Retry{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+  expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+  for i, delay := range expected {
+    if got := retryDelay(policy, i+1); got != delay {
+      t.Errorf("[FAIL] TestRetryDelay: attempt %d expected %s, got %s\n", i+1, delay, got)
+    }
+  }
+
+  policy.Jitter = 0.5
+  for i := 0; i < 100; i++ {
+    if got := retryDelay(policy, 2); got <= time.Second || got > 2*time.Second {
+      t.Errorf("[FAIL] TestRetryDelay: jittered delay %s out of range\n", got)
+    }
+  }
+}
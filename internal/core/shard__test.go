@@ -0,0 +1,112 @@
+package core
+
+import (
+  "context"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "testing"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+func TestShardedRun(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+
+  apps := make([]db.StaticAppData, 30)
+  for i := range apps {
+    apps[i] = db.StaticAppData{AppID: i, Domain: "steam"}
+  }
+  if _, _, err := cfg.Store.UpsertApps(cfg.Ctx, apps); err != nil { t.Fatal(err) }
+
+  var mutex sync.Mutex
+  seen := make(map[int]int)
+  countAtomic := func(ctx context.Context, app *db.App, cfg *config.Config, ch chan<-msgAtomic) {
+    var err error
+    defer finaliseAtomic(ctx, ch, app, nil, &err)
+    mutex.Lock()
+    seen[app.StaticData.AppID]++
+    mutex.Unlock()
+  }
+
+  // Every app lands in exactly one of the shards sharing the run id
+  cfg.RunID = "sharded"
+  for i := 0; i < 3; i++ {
+    cfg.Shard = db.Shard{Index: i, Count: 3}
+    report, err := execute(cfg, db.TRACK, countAtomic, nil, nil)
+    if err != nil || report.RunID != "sharded" || report.Shard != cfg.Shard || report.NumSuccess == len(apps) {
+      t.Errorf("[FAIL] TestShardedRun: unexpected shard report %+v %v\n", report, err)
+    }
+  }
+  for _, app := range apps {
+    if seen[app.AppID] != 1 {
+      t.Errorf("[FAIL] TestShardedRun: app %d ran %d times\n", app.AppID, seen[app.AppID])
+    }
+  }
+
+  report, err := RunReport(cfg, "sharded")
+  if err != nil || !report.Complete || report.NumSuccess != len(apps) || report.Domains["steam"].Success != len(apps) || report.Shard.Count != 3 {
+    t.Errorf("[FAIL] TestShardedRun: unexpected run report %+v %v\n", report, err)
+  }
+}
+
+func TestRunReportIncomplete(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+
+  // The second shard never completed
+  runs := []db.JobRun{
+    {RunID: "run", JobType: db.DAILY, Shard: db.Shard{Index: 0, Count: 2}, Complete: true, NumSuccess: 3},
+    {RunID: "run", JobType: db.DAILY, Shard: db.Shard{Index: 1, Count: 2}, NumSuccess: 1, NumSkipped: 1, Skipped: []string{"steam:1"}},
+  }
+  for i := range runs {
+    if err := cfg.Store.RecordJobRun(cfg.Ctx, &runs[i]); err != nil { t.Fatal(err) }
+  }
+
+  report, err := RunReport(cfg, "run")
+  if err != nil || report.Complete || report.NumSuccess != 4 || report.NumSkipped != 1 {
+    t.Errorf("[FAIL] TestRunReportIncomplete: unexpected run report %+v %v\n", report, err)
+  }
+  if _, err = RunReport(cfg, "missing"); err != db.ErrNotFound {
+    t.Errorf("[FAIL] TestRunReportIncomplete: expected ErrNotFound, got %v\n", err)
+  }
+}
+
+func TestShardedRefresh(t *testing.T) {
+  cfg, _, cleanup := openTestConfig(t, context.Background())
+  defer cleanup()
+
+  // Without an API key steam cannot list incrementally, every shard diffs the full list
+  var entries []string
+  for i := 1; i <= 30; i++ {
+    entries = append(entries, fmt.Sprintf(`{"appid":%d,"name":"App %d"}`, i, i))
+  }
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    fmt.Fprintf(w, `{"applist":{"apps":[%s]}}`, strings.Join(entries, ","))
+  }))
+  defer server.Close()
+  cfg.Fetch.BaseURLs["steam"] = server.URL
+
+  total := 0
+  for i := 0; i < 3; i++ {
+    cfg.Shard = db.Shard{Index: i, Count: 3}
+    report, err := Refresh(cfg)
+    if err != nil || report.NumSuccess == 0 || report.NumSuccess == len(entries) {
+      t.Errorf("[FAIL] TestShardedRefresh: unexpected shard report %+v %v\n", report, err)
+      continue
+    }
+    total += report.NumSuccess
+  }
+
+  stored := 0
+  err := cfg.Store.IterateStaticData(cfg.Ctx, func(*db.StaticAppData) error {
+    stored++
+    return nil
+  }, "steam")
+  if err != nil || total != len(entries) || stored != len(entries) {
+    t.Errorf("[FAIL] TestShardedRefresh: expected %d apps inserted, got %d and %d stored %v\n", len(entries), total, stored, err)
+  }
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+  "errors"
+  "fmt"
+  "time"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+  "github.com/j-leg/tracula/internal/stats"
+)
+
+// canSyncIncremental tells whether syncIncremental supports the domain
+// without running it, so every shard agrees on the domains left to a full diff
+func canSyncIncremental(cfg *config.Config, domain string) bool {
+  if !stats.Incremental(cfg.Fetch, domain) { return false }
+  _, err := cfg.Store.GetSyncState(cfg.Ctx, domain)
+  return !errors.Is(err, db.ErrNotSupported)
+}
+
+// syncIncremental upserts the apps a domain reports as modified since its
+// watermark, persisting the watermark after every page so an interrupted
+// cycle resumes where it stopped. Returns the number of apps inserted, even
+// on error. stats.ErrNotSupported is returned when the domain cannot be
+// synced incrementally.
+func syncIncremental(cfg *config.Config, domain string) (int, error) {
+  state, err := cfg.Store.GetSyncState(cfg.Ctx, domain)
+  if errors.Is(err, db.ErrNotSupported) {
+    return 0, fmt.Errorf("store cannot keep watermarks: %w", stats.ErrNotSupported)
+  }
+  if err != nil { return 0, err }
+
+  // A new cycle, anything modified from here on is picked up by the next one
+  if state.LastAppID == 0 { state.CycleStart = time.Now().UTC() }
+
+  numInserted, numUpdated := 0, 0
+  for {
+    page, err := stats.FetchAppPage(cfg.Ctx, cfg.Fetch, domain, state.IfModifiedSince, state.LastAppID)
+    if err != nil { return numInserted, err }
+
+    apps := make([]db.StaticAppData, 0, len(page.Apps))
+    for _, element := range page.Apps {
+      apps = append(apps, db.StaticAppData{Name: element.Name, AppID: element.ID, Domain: domain})
+    }
+
+    inserted, updated, err := cfg.Store.UpsertApps(cfg.Ctx, apps)
+    numInserted += inserted
+    numUpdated += updated
+    if err != nil { return numInserted, err }
+
+    if page.HaveMore {
+      state.LastAppID = page.LastAppID
+    } else {
+      state.IfModifiedSince = state.CycleStart
+      state.LastAppID = 0
+    }
+    if err = cfg.Store.SaveSyncState(cfg.Ctx, state); err != nil { return numInserted, err }
+
+    if !page.HaveMore { break }
+  }
+
+  cfg.Trace.Info.Printf("%s sync REPORT:\n    inserted: %d\n    updated: %d", domain, numInserted, numUpdated)
+  return numInserted, nil
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+  "errors"
+  "github.com/j-leg/tracula/config"
+  "github.com/j-leg/tracula/internal/db"
+)
+
+// batchWriter queues the mutations of successful atomics and applies them to
+// the store in bulk, reporting each app once its write has landed
+type batchWriter struct {
+  cfg     *config.Config
+  jobType int
+  size    int
+  pending []db.Mutation
+  apps    []*db.App
+  report  *jobReport
+}
+
+func newBatchWriter(cfg *config.Config, jobType int, report *jobReport) *batchWriter {
+  size := cfg.WriteBatch
+  if size < 1 { size = config.WRITEBATCHSIZE }
+  return &batchWriter{cfg: cfg, jobType: jobType, size: size, report: report}
+}
+
+// add queues the atomic's write, flushing once the batch is full. Atomics
+// with nothing to write are counted straight away.
+func (w *batchWriter) add(msg msgAtomic) {
+  if msg.mutation == nil {
+    w.cfg.Trace.Debug.Printf("Successful process [%d] for app %s.", w.jobType, msg.ID)
+    w.report.success(msg.app)
+    return
+  }
+
+  w.pending = append(w.pending, *msg.mutation)
+  w.apps = append(w.apps, msg.app)
+  if len(w.pending) >= w.size { w.flush() }
+}
+
+// flush applies the queued writes, failed writes are recorded as exceptions
+// like any other failed atomic. A dry run adds them to the report's diff instead.
+func (w *batchWriter) flush() {
+  if len(w.pending) == 0 { return }
+
+  var errs []error
+  if w.cfg.DryRun {
+    errs = w.report.preview(w.cfg, w.pending, w.apps)
+  } else {
+    errs = w.cfg.Store.ApplyMutations(w.cfg.Ctx, w.pending)
+  }
+  for i, err := range errs {
+    app := w.apps[i]
+    if err = writeErr(w.cfg, w.jobType, app, err); err == nil {
+      w.cfg.Trace.Debug.Printf("Successful process [%d] for app %s.", w.jobType, app.ID.String())
+      w.report.success(app)
+      continue
+    }
+
+    w.cfg.Trace.Error.Printf("Error writing [%d] app %s - %s", w.jobType, app.ID.String(), err)
+    w.report.failure(app, err)
+    if recordsExceptions(w.jobType) { recordException(w.cfg, app, w.jobType, err) }
+  }
+
+  w.pending = w.pending[:0]
+  w.apps = w.apps[:0]
+}
+
+// discard drops the queued writes, returning the apps they belonged to
+func (w *batchWriter) discard() []*db.App {
+  apps := append([]*db.App(nil), w.apps...)
+  w.pending = w.pending[:0]
+  w.apps = w.apps[:0]
+  return apps
+}
+
+// writeErr logs and drops a failed purge from the error of a write, the rest
+// of the write landed and the samples are purged by a later monthly run
+func writeErr(cfg *config.Config, jobType int, app *db.App, err error) error {
+  var purgeErr *db.PurgeError
+  if !errors.As(err, &purgeErr) { return err }
+  cfg.Trace.Error.Printf("Error purging [%d] app %s samples - %s", jobType, app.ID.String(), purgeErr.Err)
+  return nil
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+  "fmt"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+  "time"
+)
+
+// Checkpoint is the progress of a job run stopped before it completed, the
+// next invocation resumes after AfterID. Every app up to and including
+// AfterID has been processed and its write has landed, as have the apps in
+// Completed, which finished ahead of a slower app below them.
+type Checkpoint struct {
+  ID         string               `bson:"_id"`
+  JobType    int                  `bson:"job_type"`
+  RunID      string               `bson:"run_id"`
+  Shard      Shard                `bson:"shard"`
+  AfterID    primitive.ObjectID   `bson:"after_id"`
+  Completed  []primitive.ObjectID `bson:"completed"`
+  NumSuccess int                  `bson:"num_success"`
+  NumErrors  int                  `bson:"num_errors"`
+  StartedAt  time.Time            `bson:"started_at"`
+  UpdatedAt  time.Time            `bson:"updated_at"`
+}
+
+func checkpointID(jobType int, shard Shard) string {
+  return fmt.Sprintf("checkpoint:%d", jobType) + shard.suffix()
+}
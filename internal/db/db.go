@@ -3,131 +3,248 @@ package db
 import (
   "context"
   "errors"
-  "go.mongodb.org/mongo-driver/bson"
   "go.mongodb.org/mongo-driver/bson/primitive"
-  "go.mongodb.org/mongo-driver/mongo"
   "time"
-  "github.com/j-leg/tracula/config"
 )
 
 // DB Constants
 const (
-  DBTIMEOUT   = 10
-  CAPACITY    = 200000
+  DBTIMEOUT     = 10
+  ITERATORBATCH = 500 // Apps loaded per round trip when iterating
 
   DAILY    = 0
   MONTHLY  = 1
   RECOVERY = 2
   REFRESH  = 3
   TRACK    = 4
+  ENRICH   = 5
 )
 
+// App - daily samples are kept apart from the app, see Store.GetDailyMetrics
 type App struct {
-  ID           primitive.ObjectID `bson:"_id,omitempty"`
-  Metrics      []Metric           `bson:"metrics"`
-  DailyMetrics []DailyMetric      `bson:"daily_metrics"`
-  StaticData   StaticAppData      `bson:"static_data"`
-  Tracked      bool               `bson:"tracked"`
-  LastMetric   DailyMetric        `bson:"last_metric"`
+  ID         primitive.ObjectID `bson:"_id,omitempty"`
+  Metrics    []Metric           `bson:"metrics"`
+  StaticData StaticAppData      `bson:"static_data"`
+  Tracked    bool               `bson:"tracked"`
+  LastMetric DailyMetric        `bson:"last_metric"`
 }
 
 type StaticAppData struct {
-  Name   string `bson:"name"`
-  AppID  int    `bson:"app_id"`
-  Domain string `bson:"domain"`
+  Name     string       `bson:"name"`
+  AppID    int          `bson:"app_id"`
+  Domain   string       `bson:"domain"`
+  Metadata *AppMetadata `bson:"metadata,omitempty"`
 }
 
-// DailyMetric - Metric obj
-type DailyMetric struct {
-  Date        time.Time `bson:"date"`
-  PlayerCount int       `bson:"player_count"`
+// AppKey identifies an app, app ids are only unique within a domain
+type AppKey struct {
+  Domain string
+  AppID  int
 }
 
-// Metric element
-type Metric struct {
-  Date        time.Time `bson:"date"`
-  AvgPlayers  int       `bson:"avgplayers"`
-  Gain        string    `bson:"gain"`
-  GainPercent string    `bson:"gainpercent"`
-  Peak        int       `bson:"peak"`
+// Key returns the app's identity
+func (d *StaticAppData) Key() AppKey {
+  return AppKey{Domain: d.Domain, AppID: d.AppID}
 }
 
-func GetJobParams(cfg *config.Config, jobType int) (int, *mongo.Cursor, error) {
-  var filter bson.M
-  var col *mongo.Collection
-
-  switch jobType {
-  case MONTHLY, REFRESH, TRACK:
-    filter = bson.M{}
-    col = cfg.Col.Stats
-  case RECOVERY:
-    filter = bson.M{}
-    col = cfg.Col.Exceptions
-  case DAILY:
-    filter = bson.M{"tracked": true}
-    col = cfg.Col.Stats
-  default:
-    return 0, nil, errors.New("Invalid job") 
-  }
-
-  var res int64
-  var err error
-
-  res, err = col.CountDocuments(cfg.Ctx, filter)
-  if err != nil { return 0, nil, err }
-  if res > CAPACITY { return 0, nil, errors.New("Over capacity") }
-
-  cursor, err := col.Find(cfg.Ctx, filter) 
-  if err != nil { return 0, nil, err }
-
-  return int(res), cursor, nil
+// AppMetadata - descriptive data from the domain's store, refreshed by the enrich job.
+// Unavailable is set when the domain has nothing on the app.
+type AppMetadata struct {
+  Type        string    `bson:"type"`
+  Genres      []string  `bson:"genres"`
+  Developers  []string  `bson:"developers"`
+  Publishers  []string  `bson:"publishers"`
+  ReleaseDate time.Time `bson:"release_date,omitempty"`
+  ReleaseText string    `bson:"release_text"`
+  ComingSoon  bool      `bson:"coming_soon"`
+  IsFree      bool      `bson:"is_free"`
+  Price       *Price    `bson:"price,omitempty"`
+  Unavailable bool      `bson:"unavailable"`
+  UpdatedAt   time.Time `bson:"updated_at"`
 }
 
-func AddNewApp(ctx context.Context, element *App, col *mongo.Collection) error {
-  _, err := col.InsertOne(ctx, element)
-  return err
+// Price in the smallest unit of the currency
+type Price struct {
+  Currency        string `bson:"currency"`
+  Initial         int    `bson:"initial"`
+  Final           int    `bson:"final"`
+  DiscountPercent int    `bson:"discount_percent"`
 }
 
-func UpdateApp(ctx context.Context, app *App, col *mongo.Collection) error {
-	match := bson.M{"_id": app.ID}
-	var replacedDoc bson.M
-	return col.FindOneAndReplace(ctx, match, app).Decode(&replacedDoc)
+// DailyMetric - Metric obj
+type DailyMetric struct {
+  Date        time.Time `bson:"date"`
+  PlayerCount int       `bson:"player_count"`
 }
 
-func SetTrackFlag(ctx context.Context, id primitive.ObjectID, val bool, col *mongo.Collection) error {
-  filter := bson.M{"_id": id}
-  update := bson.M{"$set": bson.M{"tracked": val}}
+// Metric element - monthly figures. Gain and GainRatio compare the average
+// with the previous month's, both are 0 when NoPrevious is set.
+type Metric struct {
+  Date       time.Time `bson:"date"`
+  AvgPlayers int       `bson:"avgplayers"`
+  Gain       int       `bson:"gain"`
+  GainRatio  float64   `bson:"gain_ratio"` // Gain over the previous average, 0 if that was 0
+  NoPrevious bool      `bson:"no_previous"`
+  Peak       int       `bson:"peak"`
+}
 
-  var upDoc bson.M
-  return col.FindOneAndUpdate(ctx, filter, update).Decode(&upDoc)
+// RankedApp is an app and the figure it was ranked on
+type RankedApp struct {
+  ID         primitive.ObjectID
+  StaticData StaticAppData
+  Value      int
 }
 
-func Flush(ctx context.Context, col *mongo.Collection) error {
-  _, err := col.DeleteMany(ctx, bson.M{})
-  return err
+// Store errors
+var (
+  ErrNotFound     = errors.New("not found")
+  ErrNotSupported = errors.New("operation not supported by store")
+  ErrLeaseHeld    = errors.New("lease held by another owner")
+)
+
+// PurgeError is returned when an app's writes were applied but dropping its
+// expired samples failed. The samples are kept and purged by a later run, so
+// callers should log it rather than treat the write as failed.
+type PurgeError struct {
+  Err error
 }
 
-func GetFullStaticData(ctx context.Context, col *mongo.Collection) ([]StaticAppData, error) {
-  var match bson.M = bson.M{}
-  var resultList []StaticAppData
+func (e *PurgeError) Error() string { return "purging samples: " + e.Err.Error() }
 
-  numDocs, err := col.CountDocuments(ctx, match)
-  if err != nil { return resultList, err }
+func (e *PurgeError) Unwrap() error { return e.Err }
 
-  cursor, err := col.Find(ctx, match)
-  if err != nil { return resultList, err }
+// AppFilter selects the apps a job iterates, the zero value selects every app
+type AppFilter struct {
+  TrackedOnly   bool
+  DueExceptions bool // Only apps with an unparked exception due for another attempt
+  // Only apps of these domains whose metadata is missing or updated before
+  // MetadataStaleBefore, applied when MetadataStaleBefore is set
+  MetadataDomains     []string
+  MetadataStaleBefore time.Time
+  AfterID             primitive.ObjectID // Only apps with a greater id, to page or resume, applied when set
+  Shard               Shard              // Only apps of the shard, applied when sharded
+}
 
-  resultList = make([]StaticAppData, numDocs)
-  idx := -1 
-  for cursor.Next(ctx) {
-    var appResult App
-    idx++
+// AppIterator walks the apps selected by a filter
+type AppIterator interface {
+  Next(ctx context.Context) bool
+  // App decodes the current app
+  App() (*App, error)
+  Err() error
+  Close(ctx context.Context) error
+}
 
-    err := cursor.Decode(&appResult)
-    if err != nil { /* TODO: handle?*/ continue }
+// Store is the persistence layer used by the jobs
+type Store interface {
+  // IterateApps returns an estimate of the number of apps matching the
+  // filter and an iterator over them in id order, holding a batch at a time
+  IterateApps(ctx context.Context, filter AppFilter) (int, AppIterator, error)
+  // FindApp returns ErrNotFound if the library has no such app
+  FindApp(ctx context.Context, domain string, appID int) (*App, error)
+  // IterateStaticData calls fn with the static data of every app in the
+  // given domains, or of every app if none are given, stopping at the first error
+  IterateStaticData(ctx context.Context, fn func(*StaticAppData) error, domains ...string) error
+  // InsertApp adds the app unless one with the same domain and app id exists
+  InsertApp(ctx context.Context, app *App) error
+  // UpsertApps inserts missing apps and renames existing ones, matched on
+  // domain and app id. Returns the number inserted and modified.
+  UpsertApps(ctx context.Context, apps []StaticAppData) (int, int, error)
+  // SetMetric replaces the app's metric for the metric's month, or adds it if
+  // the month has none, leaving the other months alone
+  SetMetric(ctx context.Context, id primitive.ObjectID, metric Metric) error
+  // AppendDailyMetric adds a sample and makes it the app's last metric,
+  // unless the app already has a sample that day
+  AppendDailyMetric(ctx context.Context, id primitive.ObjectID, sample DailyMetric) error
+  // InsertDailyMetrics adds samples in bulk, the newest becomes the last
+  // metric only if it is newer than the current one
+  InsertDailyMetrics(ctx context.Context, id primitive.ObjectID, samples []DailyMetric) error
+  // GetDailyMetrics returns the app's samples dated in [from, to) in date
+  // order, a zero to leaves the range open ended
+  GetDailyMetrics(ctx context.Context, id primitive.ObjectID, from time.Time, to time.Time) ([]DailyMetric, error)
+  // GetMetrics returns the app's monthly metrics dated in [from, to) in date
+  // order, a zero to leaves the range open ended
+  GetMetrics(ctx context.Context, id primitive.ObjectID, from time.Time, to time.Time) ([]Metric, error)
+  // AppendMetric adds a monthly metric unless the app has one for that month,
+  // and drops the samples dated before purgeBefore. A failed purge is
+  // returned as a *PurgeError with the metric written.
+  AppendMetric(ctx context.Context, id primitive.ObjectID, metric Metric, purgeBefore time.Time) error
+  // IterateSamplesBefore calls fn with every sample dated before the cutoff
+  // and the key of its app, grouped by app, stopping at the first error.
+  // Samples of apps missing from the library are skipped, fn must not use the store.
+  IterateSamplesBefore(ctx context.Context, before time.Time, fn func(AppKey, DailyMetric) error) error
+  // PurgeSamplesBefore drops the samples dated before the cutoff that
+  // IterateSamplesBefore calls fn with, returning the number dropped.
+  // Samples of apps missing from the library are kept.
+  PurgeSamplesBefore(ctx context.Context, before time.Time) (int, error)
+  SetTrackFlag(ctx context.Context, id primitive.ObjectID, val bool) error
+  SetMetadata(ctx context.Context, id primitive.ObjectID, metadata *AppMetadata) error
+  // ApplyMutations writes a batch of mutations unordered, returning an error
+  // per mutation which is nil if it was applied. Applying a mutation again
+  // leaves the app as it was, so failed ones can be retried.
+  ApplyMutations(ctx context.Context, mutations []Mutation) []error
+
+  // SearchApps returns up to limit apps whose name contains the text, ignoring case, ordered by name
+  SearchApps(ctx context.Context, text string, limit int) ([]*App, error)
+  // TopByPlayerCount ranks tracked apps on their last sampled player count
+  TopByPlayerCount(ctx context.Context, limit int) ([]RankedApp, error)
+  // TopByMonthlyAverage ranks apps on their average players in the month starting at month
+  TopByMonthlyAverage(ctx context.Context, month time.Time, limit int) ([]RankedApp, error)
+
+  // RecordException upserts the exception for an (app, job) pair and bumps
+  // its attempt count. The updated exception is returned.
+  RecordException(ctx context.Context, app *App, jobType int, cause error) (*Exception, error)
+  // ScheduleException sets when the exception is next eligible for recovery,
+  // parked exceptions are never retried
+  ScheduleException(ctx context.Context, id primitive.ObjectID, next time.Time, parked bool) error
+  DeleteException(ctx context.Context, id primitive.ObjectID) error
+  // GetDueExceptions returns the unparked exceptions of an app which are due another attempt
+  GetDueExceptions(ctx context.Context, appRef primitive.ObjectID) ([]Exception, error)
+
+  // GetSyncState returns the domain's watermark, or a zero state if it has never been synced
+  GetSyncState(ctx context.Context, domain string) (*SyncState, error)
+  SaveSyncState(ctx context.Context, state *SyncState) error
+
+  // GetCheckpoint returns the checkpoint of the job shard's unfinished run,
+  // or ErrNotFound if its last run completed
+  GetCheckpoint(ctx context.Context, jobType int, shard Shard) (*Checkpoint, error)
+  SaveCheckpoint(ctx context.Context, checkpoint *Checkpoint) error
+  DeleteCheckpoint(ctx context.Context, jobType int, shard Shard) error
+
+  // AcquireLease takes the job shard's lease for owner until ttl from now, or
+  // renews it if owner already holds it. ErrLeaseHeld is returned along with
+  // the current lease if another owner holds it and it has not expired.
+  AcquireLease(ctx context.Context, jobType int, shard Shard, owner string, ttl time.Duration) (*Lease, error)
+  // ReleaseLease drops the job shard's lease if owner holds it
+  ReleaseLease(ctx context.Context, jobType int, shard Shard, owner string) error
+  // JoinLease takes the job type's lease for owner as AcquireLease does, and
+  // adds the shard to its holders. A lease taken over from an expired owner
+  // starts with the shard alone.
+  JoinLease(ctx context.Context, jobType int, shard Shard, owner string, ttl time.Duration) (*Lease, error)
+  // LeaveLease removes the shard from the holders of the job type's lease if
+  // owner holds it, dropping the lease once no holder remains
+  LeaveLease(ctx context.Context, jobType int, shard Shard, owner string) error
+
+  // RecordJobRun saves the report of a job invocation
+  RecordJobRun(ctx context.Context, run *JobRun) error
+  // ListJobRuns returns up to limit reports of the job type, or of every
+  // job for ANYJOB, newest first
+  ListJobRuns(ctx context.Context, jobType int, limit int) ([]JobRun, error)
+  // GetJobRuns returns the reports of every invocation of a logical run, oldest first
+  GetJobRuns(ctx context.Context, runID string) ([]JobRun, error)
+
+  // MigrationStatus lists every schema migration and whether it has been applied
+  MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+  // MigrateUp applies the pending migrations in order, stopping at the first
+  // failure. Returns the migrations it applied.
+  MigrateUp(ctx context.Context) ([]MigrationStatus, error)
+
+  Close(ctx context.Context) error
+}
 
-    resultList[idx] = appResult.StaticData 
+func newestSample(samples []DailyMetric) DailyMetric {
+  var newest DailyMetric
+  for _, sample := range samples {
+    if sample.Date.After(newest.Date) { newest = sample }
   }
-  cursor.Close(ctx)
-  return resultList, nil
+  return newest
 }
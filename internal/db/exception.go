@@ -0,0 +1,21 @@
+package db
+
+import (
+  "go.mongodb.org/mongo-driver/bson/primitive"
+  "time"
+)
+
+// Exception records an app that failed a job so that it can be retried
+// by the recovery job
+type Exception struct {
+  ID          primitive.ObjectID `bson:"_id,omitempty"`
+  AppRef      primitive.ObjectID `bson:"app_ref"`
+  StaticData  StaticAppData      `bson:"static_data"`
+  JobType     int                `bson:"job_type"`
+  Error       string             `bson:"error"`
+  Attempts    int                `bson:"attempts"`
+  Parked      bool               `bson:"parked"`
+  CreatedAt   time.Time          `bson:"created_at"`
+  UpdatedAt   time.Time          `bson:"updated_at"`
+  NextAttempt time.Time          `bson:"next_attempt"`
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+  "go.mongodb.org/mongo-driver/bson/primitive"
+  "time"
+)
+
+// ANYJOB lists the runs of every job type
+const ANYJOB = -1
+
+// JobRun is the report of a single invocation of a job. Invocations resuming
+// a run stopped before it completed share its RunID, as do the shards of a
+// run fanned out across parallel invocations.
+type JobRun struct {
+  ID           primitive.ObjectID       `bson:"_id" json:"id"`
+  RunID        string                   `bson:"run_id" json:"run_id"`
+  JobType      int                      `bson:"job_type" json:"job_type"`
+  Shard        Shard                    `bson:"shard" json:"shard"`
+  Trigger      string                   `bson:"trigger" json:"trigger"`
+  StartedAt    time.Time                `bson:"started_at" json:"started_at"`
+  EndedAt      time.Time                `bson:"ended_at" json:"ended_at"`
+  Resumed      bool                     `bson:"resumed" json:"resumed"`   // Picked up a run an earlier invocation stopped
+  Complete     bool                     `bson:"complete" json:"complete"` // The run went through every app
+  NumSuccess   int                      `bson:"num_success" json:"num_success"`
+  NumErrors    int                      `bson:"num_errors" json:"num_errors"`
+  NumSkipped   int                      `bson:"num_skipped" json:"num_skipped"`
+  NumTimedOut  int                      `bson:"num_timed_out" json:"num_timed_out"`
+  NumArchived  int                      `bson:"num_archived" json:"num_archived"` // Samples past retention archived ahead of the run
+  NumPurged    int                      `bson:"num_purged" json:"num_purged"`     // Samples past retention dropped ahead of the run
+  Domains      map[string]*DomainCounts `bson:"domains" json:"domains"`
+  ErrorSamples []ErrorSample            `bson:"error_samples" json:"error_samples"`
+  Skipped      []string                 `bson:"skipped" json:"skipped"` // Apps left unfinished, as domain:app id
+  DryRun       bool                     `bson:"-" json:"dry_run"`         // Dry runs are never recorded
+  Diff         *Diff                    `bson:"-" json:"diff,omitempty"`  // The writes a dry run would have made
+}
+
+// Diff lists the writes a dry run would have made, apps as domain:app id
+type Diff struct {
+  Inserted  []string       `json:"inserted"`  // New apps
+  Tracked   []string       `json:"tracked"`   // Apps that would start being tracked
+  Untracked []string       `json:"untracked"` // Apps that would stop being tracked
+  Samples   []SampleChange `json:"samples"`   // Daily samples that would be appended
+  Metrics   []MetricChange `json:"metrics"`   // Monthly metrics that would be appended
+  Metadata  []string       `json:"metadata"`  // Apps whose metadata would be refreshed
+  Archived  int            `json:"archived"`  // Samples past retention that would be archived
+  Purged    int            `json:"purged"`    // Samples past retention that would be dropped
+}
+
+// SampleChange is a daily sample a dry run would have appended
+type SampleChange struct {
+  App    string      `json:"app"`
+  Sample DailyMetric `json:"sample"`
+}
+
+// MetricChange is a monthly metric a dry run would have appended
+type MetricChange struct {
+  App    string `json:"app"`
+  Metric Metric `json:"metric"`
+}
+
+// DomainCounts breaks a job run down by domain
+type DomainCounts struct {
+  Success  int `bson:"success" json:"success"`
+  Errors   int `bson:"errors" json:"errors"`
+  Skipped  int `bson:"skipped" json:"skipped"`
+  TimedOut int `bson:"timed_out" json:"timed_out"`
+}
+
+// ErrorSample is one of the first errors of a job run
+type ErrorSample struct {
+  Domain string `bson:"domain" json:"domain"`
+  AppID  int    `bson:"app_id" json:"app_id"`
+  Error  string `bson:"error" json:"error"`
+}
@@ -0,0 +1,22 @@
+package db
+
+import (
+  "fmt"
+  "time"
+)
+
+// Lease is the lock on a job type, or on a shard of it, held by one owner
+// until it expires unless the owner renews it
+type Lease struct {
+  ID         string    `bson:"_id"`
+  JobType    int       `bson:"job_type"`
+  Shard      Shard     `bson:"shard"`
+  Owner      string    `bson:"owner"`
+  AcquiredAt time.Time `bson:"acquired_at"`
+  ExpiresAt  time.Time `bson:"expires_at"`
+  Holders    []int     `bson:"holders,omitempty"` // Indexes of the shards that joined the lease
+}
+
+func leaseID(jobType int, shard Shard) string {
+  return fmt.Sprintf("lease:%d", jobType) + shard.suffix()
+}
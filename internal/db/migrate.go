@@ -0,0 +1,335 @@
+package db
+
+import (
+  "context"
+  "database/sql"
+  "go.mongodb.org/mongo-driver/bson"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+  "go.mongodb.org/mongo-driver/mongo"
+  "go.mongodb.org/mongo-driver/mongo/options"
+  "strconv"
+  "time"
+)
+
+// MigrationStatus reports whether a schema migration has been applied
+type MigrationStatus struct {
+  Version     int
+  Description string
+  Applied     bool
+  AppliedAt   time.Time
+}
+
+// migration is a step evolving the stored data. Steps must be idempotent, a
+// step that fails part way is rerun in full. A nil step is a no-op for that store.
+type migration struct {
+  version     int
+  description string
+  mongo       func(ctx context.Context, s *MongoStore) error
+  sqlite      func(ctx context.Context, tx *sql.Tx) error
+}
+
+// migrations in the order they are applied, append only
+var migrations = []migration{
+  {
+    version:     1,
+    description: "Default fields missing from early app documents",
+    mongo:       mongoDefaultFields,
+  },
+  {
+    version:     2,
+    description: "Move embedded daily metrics into the samples collection",
+    mongo:       mongoMoveDailyMetrics,
+  },
+  {
+    version:     3,
+    description: "Index apps by domain and app id, tracked and last metric date",
+    mongo:       mongoAppIndexes,
+    sqlite:      sqliteAppIndexes,
+  },
+  {
+    version:     4,
+    description: "Convert monthly gains from formatted strings to numbers",
+    mongo:       mongoNumericGains,
+    sqlite:      sqliteNumericGains,
+  },
+  {
+    version:     5,
+    description: "Record the shard of each job run",
+    sqlite:      sqliteJobRunShards,
+  },
+  {
+    version:     6,
+    description: "Record the apps a checkpointed run completed past its watermark",
+    sqlite:      sqliteCheckpointCompleted,
+  },
+  {
+    version:     7,
+    description: "Record the samples each job run archived",
+    sqlite:      sqliteJobRunArchive,
+  },
+  {
+    version:     8,
+    description: "Record the shards holding a job-level lease",
+    sqlite:      sqliteLeaseHolders,
+  },
+}
+
+// migrationLog is implemented by each store to record applied migrations
+type migrationLog interface {
+  appliedMigrations(ctx context.Context) (map[int]time.Time, error)
+  runMigration(ctx context.Context, m *migration) error
+  recordMigration(ctx context.Context, m *migration, appliedAt time.Time) error
+}
+
+func migrationStatus(ctx context.Context, log migrationLog) ([]MigrationStatus, error) {
+  applied, err := log.appliedMigrations(ctx)
+  if err != nil { return nil, err }
+
+  statusList := make([]MigrationStatus, 0, len(migrations))
+  for _, m := range migrations {
+    appliedAt, ok := applied[m.version]
+    statusList = append(statusList, MigrationStatus{
+      Version:     m.version,
+      Description: m.description,
+      Applied:     ok,
+      AppliedAt:   appliedAt,
+    })
+  }
+  return statusList, nil
+}
+
+func migrateUp(ctx context.Context, log migrationLog) ([]MigrationStatus, error) {
+  applied, err := log.appliedMigrations(ctx)
+  if err != nil { return nil, err }
+
+  var appliedNow []MigrationStatus
+  for i := range migrations {
+    m := &migrations[i]
+    if _, ok := applied[m.version]; ok { continue }
+
+    if err = log.runMigration(ctx, m); err != nil { return appliedNow, err }
+    appliedAt := time.Now().UTC()
+    if err = log.recordMigration(ctx, m, appliedAt); err != nil { return appliedNow, err }
+    appliedNow = append(appliedNow, MigrationStatus{Version: m.version, Description: m.description, Applied: true, AppliedAt: appliedAt})
+  }
+  return appliedNow, nil
+}
+
+// mongoDefaultFields sets the fields added after the first documents were written
+func mongoDefaultFields(ctx context.Context, s *MongoStore) error {
+  defaults := bson.M{
+    "tracked":     false,
+    "metrics":     make([]Metric, 0),
+    "last_metric": DailyMetric{},
+  }
+  for field, value := range defaults {
+    filter := bson.M{field: bson.M{"$exists": false}}
+    update := bson.M{"$set": bson.M{field: value}}
+    if _, err := s.stats.UpdateMany(ctx, filter, update); err != nil { return err }
+  }
+  return nil
+}
+
+// mongoMoveDailyMetrics copies each app's embedded daily_metrics into the
+// samples collection then unsets the array. Days already present in the
+// samples collection are skipped, so an interrupted run does not duplicate them.
+func mongoMoveDailyMetrics(ctx context.Context, s *MongoStore) error {
+  filter := bson.M{"daily_metrics": bson.M{"$exists": true}}
+  opts := options.Find().SetProjection(bson.M{"daily_metrics": 1})
+  cursor, err := s.stats.Find(ctx, filter, opts)
+  if err != nil { return err }
+  defer cursor.Close(ctx)
+
+  for cursor.Next(ctx) {
+    var legacy struct {
+      ID           primitive.ObjectID `bson:"_id"`
+      DailyMetrics []DailyMetric      `bson:"daily_metrics"`
+    }
+    if err = cursor.Decode(&legacy); err != nil { return err }
+
+    existing, err := s.GetDailyMetrics(ctx, legacy.ID, time.Time{}, time.Time{})
+    if err != nil { return err }
+    seen := make(map[int64]bool, len(existing))
+    for _, sample := range existing { seen[sample.Date.Unix()] = true }
+
+    var missing []DailyMetric
+    for _, sample := range legacy.DailyMetrics {
+      if seen[sample.Date.Unix()] { continue }
+      missing = append(missing, sample)
+    }
+    if err = s.InsertDailyMetrics(ctx, legacy.ID, missing); err != nil { return err }
+
+    update := bson.M{"$unset": bson.M{"daily_metrics": ""}}
+    if _, err = s.stats.UpdateOne(ctx, bson.M{"_id": legacy.ID}, update); err != nil { return err }
+  }
+  return cursor.Err()
+}
+
+// mongoAppIndexes fails if the library already holds duplicate apps, they
+// have to be merged by hand before the unique index can be built
+func mongoAppIndexes(ctx context.Context, s *MongoStore) error {
+  indexes := []mongo.IndexModel{
+    {
+      Keys:    bson.D{{Key: "static_data.domain", Value: 1}, {Key: "static_data.app_id", Value: 1}},
+      Options: options.Index().SetUnique(true).SetName("domain_app_id"),
+    },
+    {
+      Keys:    bson.D{{Key: "tracked", Value: 1}},
+      Options: options.Index().SetName("tracked"),
+    },
+    {
+      Keys:    bson.D{{Key: "last_metric.date", Value: 1}},
+      Options: options.Index().SetName("last_metric_date"),
+    },
+  }
+  _, err := s.stats.Indexes().CreateMany(ctx, indexes)
+  return err
+}
+
+// sqliteAppIndexes adds the index the schema lacks, the unique and tracked
+// indexes are part of the schema
+func sqliteAppIndexes(ctx context.Context, tx *sql.Tx) error {
+  _, err := tx.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS apps_last_metric ON apps (last_metric_date)")
+  return err
+}
+
+// legacyGain converts a gain formatted as "-" (no previous month) or an
+// integer, the ratio is recomputed as the stored percentage was truncated
+func legacyGain(gain string, avgPlayers int) (int, float64, bool, error) {
+  if gain == "-" { return 0, 0, true, nil }
+
+  value, err := strconv.Atoi(gain)
+  if err != nil { return 0, 0, false, err }
+
+  var ratio float64
+  if previous := avgPlayers - value; previous > 0 { ratio = float64(value) / float64(previous) }
+  return value, ratio, false, nil
+}
+
+// mongoNumericGains rewrites the metrics of every app still holding a string gain
+func mongoNumericGains(ctx context.Context, s *MongoStore) error {
+  filter := bson.M{"metrics.gain": bson.M{"$type": "string"}}
+  opts := options.Find().SetProjection(bson.M{"metrics": 1})
+  cursor, err := s.stats.Find(ctx, filter, opts)
+  if err != nil { return err }
+  defer cursor.Close(ctx)
+
+  for cursor.Next(ctx) {
+    var legacy struct {
+      ID      primitive.ObjectID `bson:"_id"`
+      Metrics []bson.M           `bson:"metrics"`
+    }
+    if err = cursor.Decode(&legacy); err != nil { return err }
+
+    for _, metric := range legacy.Metrics {
+      gain, ok := metric["gain"].(string)
+      if !ok { continue }
+
+      var avgPlayers int
+      switch avg := metric["avgplayers"].(type) {
+      case int32:
+        avgPlayers = int(avg)
+      case int64:
+        avgPlayers = int(avg)
+      }
+      value, ratio, noPrevious, err := legacyGain(gain, avgPlayers)
+      if err != nil { return err }
+      metric["gain"] = value
+      metric["gain_ratio"] = ratio
+      metric["no_previous"] = noPrevious
+      delete(metric, "gainpercent")
+    }
+
+    update := bson.M{"$set": bson.M{"metrics": legacy.Metrics}}
+    if _, err = s.stats.UpdateOne(ctx, bson.M{"_id": legacy.ID}, update); err != nil { return err }
+  }
+  return cursor.Err()
+}
+
+// sqliteNumericGains rebuilds a metrics table created with text gains
+func sqliteNumericGains(ctx context.Context, tx *sql.Tx) error {
+  var numLegacy int
+  err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('metrics') WHERE name = 'gain_percent'").Scan(&numLegacy)
+  if err != nil || numLegacy == 0 { return err }
+
+  statements := []string{
+    `ALTER TABLE metrics RENAME TO metrics_legacy`,
+    `CREATE TABLE metrics (
+      app          TEXT NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+      date         INTEGER NOT NULL,
+      avg_players  INTEGER NOT NULL,
+      gain         INTEGER NOT NULL,
+      gain_ratio   REAL NOT NULL,
+      no_previous  INTEGER NOT NULL,
+      peak         INTEGER NOT NULL
+    )`,
+    `INSERT INTO metrics (app, date, avg_players, gain, gain_ratio, no_previous, peak)
+      SELECT app, date, avg_players,
+        CASE WHEN gain = '-' THEN 0 ELSE CAST(gain AS INTEGER) END,
+        CASE WHEN gain = '-' OR avg_players - CAST(gain AS INTEGER) <= 0 THEN 0
+          ELSE CAST(gain AS REAL) / (avg_players - CAST(gain AS INTEGER)) END,
+        gain = '-',
+        peak
+      FROM metrics_legacy ORDER BY rowid`,
+    `DROP TABLE metrics_legacy`,
+    `CREATE INDEX IF NOT EXISTS metrics_app ON metrics (app, date)`,
+  }
+  for _, statement := range statements {
+    if _, err = tx.ExecContext(ctx, statement); err != nil { return err }
+  }
+  return nil
+}
+
+// sqliteJobRunShards adds the shard columns to a job_runs table created without them
+func sqliteJobRunShards(ctx context.Context, tx *sql.Tx) error {
+  var numColumns int
+  err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('job_runs') WHERE name = 'shard_index'").Scan(&numColumns)
+  if err != nil || numColumns > 0 { return err }
+
+  statements := []string{
+    `ALTER TABLE job_runs ADD COLUMN shard_index INTEGER NOT NULL DEFAULT 0`,
+    `ALTER TABLE job_runs ADD COLUMN shard_count INTEGER NOT NULL DEFAULT 0`,
+    `CREATE INDEX IF NOT EXISTS job_runs_run ON job_runs (run_id)`,
+  }
+  for _, statement := range statements {
+    if _, err = tx.ExecContext(ctx, statement); err != nil { return err }
+  }
+  return nil
+}
+
+// sqliteCheckpointCompleted adds the completed column to a checkpoints table
+// created without it
+func sqliteCheckpointCompleted(ctx context.Context, tx *sql.Tx) error {
+  var numColumns int
+  err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('checkpoints') WHERE name = 'completed'").Scan(&numColumns)
+  if err != nil || numColumns > 0 { return err }
+
+  _, err = tx.ExecContext(ctx, `ALTER TABLE checkpoints ADD COLUMN completed TEXT NOT NULL DEFAULT ''`)
+  return err
+}
+
+// sqliteJobRunArchive adds the archive counts to a job_runs table created without them
+func sqliteJobRunArchive(ctx context.Context, tx *sql.Tx) error {
+  var numColumns int
+  err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('job_runs') WHERE name = 'num_archived'").Scan(&numColumns)
+  if err != nil || numColumns > 0 { return err }
+
+  statements := []string{
+    `ALTER TABLE job_runs ADD COLUMN num_archived INTEGER NOT NULL DEFAULT 0`,
+    `ALTER TABLE job_runs ADD COLUMN num_purged INTEGER NOT NULL DEFAULT 0`,
+  }
+  for _, statement := range statements {
+    if _, err = tx.ExecContext(ctx, statement); err != nil { return err }
+  }
+  return nil
+}
+
+// sqliteLeaseHolders adds the holders column to a leases table created without it
+func sqliteLeaseHolders(ctx context.Context, tx *sql.Tx) error {
+  var numColumns int
+  err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('leases') WHERE name = 'holders'").Scan(&numColumns)
+  if err != nil || numColumns > 0 { return err }
+
+  _, err = tx.ExecContext(ctx, `ALTER TABLE leases ADD COLUMN holders TEXT NOT NULL DEFAULT '[]'`)
+  return err
+}
@@ -0,0 +1,855 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "regexp"
+  "sort"
+  "go.mongodb.org/mongo-driver/bson"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+  "go.mongodb.org/mongo-driver/mongo"
+  "go.mongodb.org/mongo-driver/mongo/options"
+  "time"
+)
+
+// MongoStore keeps apps as documents in the stats collection, daily samples,
+// exceptions, job state and job runs live in their own collections
+type MongoStore struct {
+  stats      *mongo.Collection
+  samples    *mongo.Collection
+  exceptions *mongo.Collection
+  state      *mongo.Collection // Optional, incremental sync needs it
+  jobRuns    *mongo.Collection // Optional, job run history needs it
+}
+
+// NewMongoStore returns a store backed by the given collections
+func NewMongoStore(stats *mongo.Collection, samples *mongo.Collection, exceptions *mongo.Collection, state *mongo.Collection, jobRuns *mongo.Collection) *MongoStore {
+  return &MongoStore{stats: stats, samples: samples, exceptions: exceptions, state: state, jobRuns: jobRuns}
+}
+
+// mongoSample is a daily sample as stored in the samples collection, app_ref
+// is the time-series meta field
+type mongoSample struct {
+  AppRef      primitive.ObjectID `bson:"app_ref"`
+  Date        time.Time          `bson:"date"`
+  PlayerCount int                `bson:"player_count"`
+}
+
+// Server error codes
+const (
+  NAMESPACEEXISTS = 48    // Creating an existing collection
+  DUPLICATEKEY    = 11000 // Inserting a document with a taken unique key
+)
+
+// MINSAMPLESVERSION is the oldest MongoDB major version able to delete
+// time-series samples by date
+const MINSAMPLESVERSION = 7
+
+// CreateSamplesCollection creates the time-series collection daily samples
+// are kept in, indexed by app and date. Samples older than expireAfter are
+// dropped by the server, zero keeps them until purged. Purging samples by
+// date needs MongoDB 7.0, older servers are refused with ErrNotSupported.
+// Creating a collection that already exists is not an error.
+func CreateSamplesCollection(ctx context.Context, database *mongo.Database, name string, expireAfter time.Duration) (*mongo.Collection, error) {
+  major, err := serverMajorVersion(ctx, database)
+  if err != nil { return nil, err }
+  if major < MINSAMPLESVERSION {
+    return nil, fmt.Errorf("samples collection needs MongoDB %d.0, server is %d: %w", MINSAMPLESVERSION, major, ErrNotSupported)
+  }
+
+  create := bson.D{
+    {Key: "create", Value: name},
+    {Key: "timeseries", Value: bson.D{
+      {Key: "timeField", Value: "date"},
+      {Key: "metaField", Value: "app_ref"},
+      {Key: "granularity", Value: "hours"},
+    }},
+  }
+  if expireAfter > 0 {
+    create = append(create, bson.E{Key: "expireAfterSeconds", Value: int64(expireAfter.Seconds())})
+  }
+
+  err = database.RunCommand(ctx, create).Err()
+  if cmdErr, ok := err.(mongo.CommandError); ok && cmdErr.Code == NAMESPACEEXISTS { err = nil }
+  if err != nil { return nil, err }
+
+  col := database.Collection(name)
+  index := mongo.IndexModel{Keys: bson.D{{Key: "app_ref", Value: 1}, {Key: "date", Value: 1}}}
+  if _, err = col.Indexes().CreateOne(ctx, index); err != nil { return nil, err }
+  return col, nil
+}
+
+// serverMajorVersion returns the major version of the server behind the database
+func serverMajorVersion(ctx context.Context, database *mongo.Database) (int, error) {
+  var info struct {
+    VersionArray []int32 `bson:"versionArray"`
+  }
+  if err := database.RunCommand(ctx, bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info); err != nil { return 0, err }
+  if len(info.VersionArray) == 0 { return 0, errors.New("server did not report its version") }
+  return int(info.VersionArray[0]), nil
+}
+
+type mongoAppIterator struct {
+  cursor *mongo.Cursor
+}
+
+func (it *mongoAppIterator) Next(ctx context.Context) bool { return it.cursor.Next(ctx) }
+
+func (it *mongoAppIterator) App() (*App, error) {
+  var app App
+  if err := it.cursor.Decode(&app); err != nil { return nil, err }
+  return &app, nil
+}
+
+func (it *mongoAppIterator) Err() error { return it.cursor.Err() }
+
+func (it *mongoAppIterator) Close(ctx context.Context) error { return it.cursor.Close(ctx) }
+
+func (s *MongoStore) IterateApps(ctx context.Context, filter AppFilter) (int, AppIterator, error) {
+  match, err := s.appFilter(ctx, filter)
+  if err != nil { return 0, nil, err }
+
+  // Leave out samples not yet moved into the samples collection
+  opts := options.Find().
+    SetProjection(bson.M{"daily_metrics": 0}).
+    SetSort(bson.M{"_id": 1}).
+    SetBatchSize(ITERATORBATCH)
+  cursor, err := s.stats.Find(ctx, match, opts)
+  if err != nil { return 0, nil, err }
+
+  return filter.Shard.share(s.estimateApps(ctx, match)), newShardIterator(&mongoAppIterator{cursor: cursor}, filter.Shard), nil
+}
+
+// estimateApps is only used for progress, so a failed count reports 0
+// rather than stopping the job
+func (s *MongoStore) estimateApps(ctx context.Context, match bson.M) int {
+  var res int64
+  var err error
+  if len(match) == 0 {
+    res, err = s.stats.EstimatedDocumentCount(ctx)
+  } else {
+    res, err = s.stats.CountDocuments(ctx, match)
+  }
+  if err != nil { return 0 }
+  return int(res)
+}
+
+func (s *MongoStore) appFilter(ctx context.Context, filter AppFilter) (bson.M, error) {
+  match := bson.M{}
+  idMatch := bson.M{}
+  if filter.TrackedOnly {
+    match["tracked"] = true
+  }
+  if filter.DueExceptions {
+    appRefs, err := s.dueExceptionAppRefs(ctx)
+    if err != nil { return nil, err }
+    idMatch["$in"] = appRefs
+  }
+  if !filter.AfterID.IsZero() {
+    idMatch["$gt"] = filter.AfterID
+  }
+  if len(idMatch) > 0 { match["_id"] = idMatch }
+  if !filter.MetadataStaleBefore.IsZero() {
+    domains := filter.MetadataDomains
+    if domains == nil { domains = make([]string, 0) }
+    match["static_data.domain"] = bson.M{"$in": domains}
+    match["$or"] = bson.A{
+      bson.M{"static_data.metadata.updated_at": bson.M{"$exists": false}},
+      bson.M{"static_data.metadata.updated_at": bson.M{"$lt": filter.MetadataStaleBefore}},
+    }
+  }
+  return match, nil
+}
+
+func (s *MongoStore) FindApp(ctx context.Context, domain string, appID int) (*App, error) {
+  filter := bson.M{"static_data.domain": domain, "static_data.app_id": appID}
+
+  var app App
+  opts := options.FindOne().SetProjection(bson.M{"daily_metrics": 0})
+  err := s.stats.FindOne(ctx, filter, opts).Decode(&app)
+  if err == mongo.ErrNoDocuments { return nil, ErrNotFound }
+  if err != nil { return nil, err }
+  return &app, nil
+}
+
+func (s *MongoStore) IterateStaticData(ctx context.Context, fn func(*StaticAppData) error, domains ...string) error {
+  var match bson.M = bson.M{}
+  if len(domains) > 0 { match["static_data.domain"] = bson.M{"$in": domains} }
+
+  // Only the static data is needed, skip the metric histories
+  opts := options.Find().
+    SetProjection(bson.M{"static_data": 1}).
+    SetSort(bson.M{"_id": 1}).
+    SetBatchSize(ITERATORBATCH)
+  cursor, err := s.stats.Find(ctx, match, opts)
+  if err != nil { return err }
+  defer cursor.Close(ctx)
+
+  for cursor.Next(ctx) {
+    var appResult App
+    if err = cursor.Decode(&appResult); err != nil { return err }
+    if err = fn(&appResult.StaticData); err != nil { return err }
+  }
+  return cursor.Err()
+}
+
+func (s *MongoStore) InsertApp(ctx context.Context, app *App) error {
+  model := insertAppModel(app)
+  _, err := s.stats.UpdateOne(ctx, model.Filter, model.Update, options.Update().SetUpsert(true))
+  return err
+}
+
+// insertAppModel upserts on the app's identity so an app already in the
+// library is left untouched
+func insertAppModel(app *App) *mongo.UpdateOneModel {
+  if app.ID.IsZero() { app.ID = primitive.NewObjectID() }
+  filter := bson.M{"static_data.domain": app.StaticData.Domain, "static_data.app_id": app.StaticData.AppID}
+  update := bson.M{"$setOnInsert": app}
+  return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true)
+}
+
+func (s *MongoStore) UpsertApps(ctx context.Context, apps []StaticAppData) (int, int, error) {
+  if len(apps) == 0 { return 0, 0, nil }
+
+  models := make([]mongo.WriteModel, 0, len(apps))
+  for _, staticData := range apps {
+    filter := bson.M{"static_data.domain": staticData.Domain, "static_data.app_id": staticData.AppID}
+    update := bson.M{
+      "$set": bson.M{"static_data.name": staticData.Name},
+      "$setOnInsert": bson.M{
+        "metrics":     make([]Metric, 0),
+        "tracked":     false,
+        "last_metric": DailyMetric{},
+      },
+    }
+    models = append(models, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+  }
+
+  opts := options.BulkWrite().SetOrdered(false)
+  res, err := s.stats.BulkWrite(ctx, models, opts)
+  if res == nil { return 0, 0, err }
+  return int(res.UpsertedCount), int(res.ModifiedCount), err
+}
+
+// SetMetric only pushes the metric if its month is missing, like
+// AppendMetric, so a month pushed concurrently is replaced instead of duplicated
+func (s *MongoStore) SetMetric(ctx context.Context, id primitive.ObjectID, metric Metric) error {
+  replace := bson.M{"$set": bson.M{"metrics.$": metric}}
+  err := s.updateOne(ctx, bson.M{"_id": id, "metrics.date": metric.Date}, replace)
+  if !errors.Is(err, ErrNotFound) { return err }
+
+  err = s.updateOne(ctx, bson.M{"_id": id, "metrics.date": bson.M{"$ne": metric.Date}}, bson.M{"$push": bson.M{"metrics": metric}})
+  if !errors.Is(err, ErrNotFound) { return err }
+
+  // Either the app is missing or the month was pushed in between
+  return s.updateOne(ctx, bson.M{"_id": id, "metrics.date": metric.Date}, replace)
+}
+
+func (s *MongoStore) AppendDailyMetric(ctx context.Context, id primitive.ObjectID, sample DailyMetric) error {
+  sampled, err := s.sampledDays(ctx, []Mutation{{AppRef: id, Sample: &sample}})
+  if err != nil || sampled[0] { return err }
+
+  filter := bson.M{"_id": id}
+  update := bson.M{"$set": bson.M{"last_metric": sample}}
+  if err = s.updateOne(ctx, filter, update); err != nil { return err }
+
+  _, err = s.samples.InsertOne(ctx, mongoSample{AppRef: id, Date: sample.Date, PlayerCount: sample.PlayerCount})
+  return err
+}
+
+func (s *MongoStore) InsertDailyMetrics(ctx context.Context, id primitive.ObjectID, samples []DailyMetric) error {
+  if len(samples) == 0 { return nil }
+
+  docs := make([]interface{}, 0, len(samples))
+  for _, sample := range samples {
+    docs = append(docs, mongoSample{AppRef: id, Date: sample.Date, PlayerCount: sample.PlayerCount})
+  }
+  if _, err := s.samples.InsertMany(ctx, docs); err != nil { return err }
+
+  // Only move the last metric forward, a concurrent daily sample may be newer
+  newest := newestSample(samples)
+  filter := bson.M{"_id": id, "last_metric.date": bson.M{"$lt": newest.Date}}
+  update := bson.M{"$set": bson.M{"last_metric": newest}}
+  _, err := s.stats.UpdateOne(ctx, filter, update)
+  return err
+}
+
+func (s *MongoStore) GetDailyMetrics(ctx context.Context, id primitive.ObjectID, from time.Time, to time.Time) ([]DailyMetric, error) {
+  dateRange := bson.M{"$gte": from}
+  if !to.IsZero() { dateRange["$lt"] = to }
+  filter := bson.M{"app_ref": id, "date": dateRange}
+  opts := options.Find().SetSort(bson.M{"date": 1})
+
+  samples := make([]DailyMetric, 0)
+  cursor, err := s.samples.Find(ctx, filter, opts)
+  if err != nil { return samples, err }
+  defer cursor.Close(ctx)
+
+  for cursor.Next(ctx) {
+    var sample mongoSample
+    if err = cursor.Decode(&sample); err != nil { return samples, err }
+    samples = append(samples, DailyMetric{Date: sample.Date, PlayerCount: sample.PlayerCount})
+  }
+  return samples, cursor.Err()
+}
+
+func (s *MongoStore) GetMetrics(ctx context.Context, id primitive.ObjectID, from time.Time, to time.Time) ([]Metric, error) {
+  var app App
+  opts := options.FindOne().SetProjection(bson.M{"metrics": 1})
+  err := s.stats.FindOne(ctx, bson.M{"_id": id}, opts).Decode(&app)
+  if err == mongo.ErrNoDocuments { return nil, ErrNotFound }
+  if err != nil { return nil, err }
+
+  metrics := make([]Metric, 0, len(app.Metrics))
+  for _, metric := range app.Metrics {
+    if metric.Date.Before(from) || (!to.IsZero() && !metric.Date.Before(to)) { continue }
+    metrics = append(metrics, metric)
+  }
+  sort.Slice(metrics, func(i int, j int) bool { return metrics[i].Date.Before(metrics[j].Date) })
+  return metrics, nil
+}
+
+// AppendMetric only pushes a metric whose month is missing, so a write
+// retried after a failed purge does not duplicate it
+func (s *MongoStore) AppendMetric(ctx context.Context, id primitive.ObjectID, metric Metric, purgeBefore time.Time) error {
+  filter := bson.M{"_id": id, "metrics.date": bson.M{"$ne": metric.Date}}
+  update := bson.M{"$push": bson.M{"metrics": metric}}
+  err := s.updateOne(ctx, filter, update)
+  if errors.Is(err, ErrNotFound) {
+    // Either the app is missing or the month was already pushed
+    err = s.stats.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+    if err == mongo.ErrNoDocuments { err = ErrNotFound }
+  }
+  if err != nil { return err }
+
+  if _, err = s.samples.DeleteMany(ctx, bson.M{"app_ref": id, "date": bson.M{"$lt": purgeBefore}}); err != nil {
+    return &PurgeError{Err: err}
+  }
+  return nil
+}
+
+func (s *MongoStore) IterateSamplesBefore(ctx context.Context, before time.Time, fn func(AppKey, DailyMetric) error) error {
+  opts := options.Find().
+    SetSort(bson.D{{Key: "app_ref", Value: 1}, {Key: "date", Value: 1}}).
+    SetBatchSize(ITERATORBATCH)
+  cursor, err := s.samples.Find(ctx, bson.M{"date": bson.M{"$lt": before}}, opts)
+  if err != nil { return err }
+  defer cursor.Close(ctx)
+
+  // Samples come grouped by app, so its key is only looked up once
+  var appRef primitive.ObjectID
+  var key *AppKey
+  for cursor.Next(ctx) {
+    var sample mongoSample
+    if err = cursor.Decode(&sample); err != nil { return err }
+
+    if sample.AppRef != appRef {
+      appRef, key = sample.AppRef, nil
+      var app App
+      findOpts := options.FindOne().SetProjection(bson.M{"static_data": 1})
+      err = s.stats.FindOne(ctx, bson.M{"_id": appRef}, findOpts).Decode(&app)
+      if err != nil && err != mongo.ErrNoDocuments { return err }
+      if err == nil {
+        appKey := app.StaticData.Key()
+        key = &appKey
+      }
+    }
+    if key == nil { continue }
+
+    if err = fn(*key, DailyMetric{Date: sample.Date, PlayerCount: sample.PlayerCount}); err != nil { return err }
+  }
+  return cursor.Err()
+}
+
+// PurgeSamplesBefore keeps the samples of apps missing from the library,
+// which IterateSamplesBefore skips and so were never archived. Purging by
+// date needs MongoDB 7.0 or later, like AppendMetric.
+func (s *MongoStore) PurgeSamplesBefore(ctx context.Context, before time.Time) (int, error) {
+  filter := bson.M{"date": bson.M{"$lt": before}}
+  refs, err := s.samples.Distinct(ctx, "app_ref", filter)
+  if err != nil || len(refs) == 0 { return 0, err }
+
+  opts := options.Find().SetProjection(bson.M{"_id": 1})
+  cursor, err := s.stats.Find(ctx, bson.M{"_id": bson.M{"$in": refs}}, opts)
+  if err != nil { return 0, err }
+  var apps []struct {
+    ID primitive.ObjectID `bson:"_id"`
+  }
+  if err = cursor.All(ctx, &apps); err != nil { return 0, err }
+  if len(apps) == 0 { return 0, nil }
+
+  ids := make([]primitive.ObjectID, len(apps))
+  for i, app := range apps { ids[i] = app.ID }
+  filter["app_ref"] = bson.M{"$in": ids}
+  res, err := s.samples.DeleteMany(ctx, filter)
+  if err != nil { return 0, err }
+  return int(res.DeletedCount), nil
+}
+
+func (s *MongoStore) SetTrackFlag(ctx context.Context, id primitive.ObjectID, val bool) error {
+  filter := bson.M{"_id": id}
+  update := bson.M{"$set": bson.M{"tracked": val}}
+  return s.updateOne(ctx, filter, update)
+}
+
+func (s *MongoStore) SetMetadata(ctx context.Context, id primitive.ObjectID, metadata *AppMetadata) error {
+  filter := bson.M{"_id": id}
+  update := bson.M{"$set": bson.M{"static_data.metadata": metadata}}
+  return s.updateOne(ctx, filter, update)
+}
+
+func (s *MongoStore) ApplyMutations(ctx context.Context, mutations []Mutation) []error {
+  errs := make([]error, len(mutations))
+
+  // Samples already taken that day were written by an earlier attempt of the
+  // same atomic, they are dropped along with the last metric they would set
+  sampled, err := s.sampledDays(ctx, mutations)
+  var appModels []mongo.WriteModel
+  var appIndex []int
+  for i := range mutations {
+    mutation := mutations[i]
+    if mutation.Insert != nil {
+      appModels = append(appModels, insertAppModel(mutation.Insert))
+      appIndex = append(appIndex, i)
+      continue
+    }
+    if mutation.Sample != nil {
+      if err != nil {
+        errs[i] = err
+        continue
+      }
+      if sampled[i] { mutation.Sample = nil }
+    }
+
+    if update := mutationUpdate(&mutation); len(update) > 0 {
+      appModels = append(appModels, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": mutation.AppRef}).SetUpdate(update))
+      appIndex = append(appIndex, i)
+    }
+    // The metric is only pushed if its month is missing
+    if mutation.Metric != nil {
+      filter := bson.M{"_id": mutation.AppRef, "metrics.date": bson.M{"$ne": mutation.Metric.Date}}
+      update := bson.M{"$push": bson.M{"metrics": mutation.Metric}}
+      appModels = append(appModels, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update))
+      appIndex = append(appIndex, i)
+    }
+  }
+  bulkWrite(ctx, s.stats, appModels, appIndex, errs)
+
+  // Samples are only written once their app write succeeded
+  var sampleModels []mongo.WriteModel
+  var sampleIndex []int
+  var purgeModels []mongo.WriteModel
+  var purgeIndex []int
+  for i, mutation := range mutations {
+    if errs[i] != nil || mutation.Insert != nil { continue }
+    if mutation.Sample != nil && !sampled[i] {
+      sample := mongoSample{AppRef: mutation.AppRef, Date: mutation.Sample.Date, PlayerCount: mutation.Sample.PlayerCount}
+      sampleModels = append(sampleModels, mongo.NewInsertOneModel().SetDocument(sample))
+      sampleIndex = append(sampleIndex, i)
+    }
+    if !mutation.PurgeBefore.IsZero() {
+      filter := bson.M{"app_ref": mutation.AppRef, "date": bson.M{"$lt": mutation.PurgeBefore}}
+      purgeModels = append(purgeModels, mongo.NewDeleteManyModel().SetFilter(filter))
+      purgeIndex = append(purgeIndex, i)
+    }
+  }
+  bulkWrite(ctx, s.samples, sampleModels, sampleIndex, errs)
+
+  // A failed purge leaves the rest of the mutation applied
+  purgeErrs := make([]error, len(mutations))
+  bulkWrite(ctx, s.samples, purgeModels, purgeIndex, purgeErrs)
+  for i, err := range purgeErrs {
+    if err != nil && errs[i] == nil { errs[i] = &PurgeError{Err: err} }
+  }
+  return errs
+}
+
+// sampledDays reports which mutations carry a sample for a day their app
+// already has a sample on
+func (s *MongoStore) sampledDays(ctx context.Context, mutations []Mutation) (map[int]bool, error) {
+  type appDay struct {
+    app primitive.ObjectID
+    day time.Time
+  }
+  apps := map[time.Time][]primitive.ObjectID{}
+  for _, mutation := range mutations {
+    if mutation.Insert != nil || mutation.Sample == nil { continue }
+    day := sampleDay(mutation.Sample.Date)
+    apps[day] = append(apps[day], mutation.AppRef)
+  }
+
+  taken := map[appDay]bool{}
+  for day, refs := range apps {
+    filter := bson.M{"app_ref": bson.M{"$in": refs}, "date": bson.M{"$gte": day, "$lt": day.AddDate(0, 0, 1)}}
+    cursor, err := s.samples.Find(ctx, filter, options.Find().SetProjection(bson.M{"app_ref": 1}))
+    if err != nil { return nil, err }
+    var found []mongoSample
+    err = cursor.All(ctx, &found)
+    if err != nil { return nil, err }
+    for _, sample := range found {
+      taken[appDay{sample.AppRef, day}] = true
+    }
+  }
+
+  sampled := map[int]bool{}
+  for i, mutation := range mutations {
+    if mutation.Insert != nil || mutation.Sample == nil { continue }
+    if taken[appDay{mutation.AppRef, sampleDay(mutation.Sample.Date)}] { sampled[i] = true }
+  }
+  return sampled, nil
+}
+
+// mutationUpdate builds the update document for the app fields a mutation
+// sets, the metric is pushed by its own guarded update
+func mutationUpdate(mutation *Mutation) bson.M {
+  set := bson.M{}
+  if mutation.Sample != nil { set["last_metric"] = mutation.Sample }
+  if mutation.Tracked != nil { set["tracked"] = *mutation.Tracked }
+  if mutation.Metadata != nil { set["static_data.metadata"] = mutation.Metadata }
+
+  update := bson.M{}
+  if len(set) > 0 { update["$set"] = set }
+  return update
+}
+
+// bulkWrite runs the models unordered, index maps each model to the mutation
+// it came from so failures are recorded against that mutation. An error that
+// is not tied to a model fails every mutation, though some may have been
+// applied. Retrying them is safe as every mutation write is idempotent.
+func bulkWrite(ctx context.Context, col *mongo.Collection, models []mongo.WriteModel, index []int, errs []error) {
+  if len(models) == 0 { return }
+
+  _, err := col.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+  if err == nil { return }
+
+  if bulkErr, ok := err.(mongo.BulkWriteException); ok {
+    for _, writeErr := range bulkErr.WriteErrors {
+      errs[index[writeErr.Index]] = writeErr
+    }
+    if bulkErr.WriteConcernError == nil { return }
+  }
+  for _, i := range index {
+    if errs[i] == nil { errs[i] = err }
+  }
+}
+
+// updateOne applies the update and reports ErrNotFound if nothing matched
+func (s *MongoStore) updateOne(ctx context.Context, filter bson.M, update bson.M) error {
+  res, err := s.stats.UpdateOne(ctx, filter, update)
+  if err != nil { return err }
+  if res.MatchedCount == 0 { return ErrNotFound }
+  return nil
+}
+
+func (s *MongoStore) SearchApps(ctx context.Context, text string, limit int) ([]*App, error) {
+  filter := bson.M{"static_data.name": bson.M{"$regex": regexp.QuoteMeta(text), "$options": "i"}}
+  opts := options.Find().
+    SetProjection(bson.M{"daily_metrics": 0}).
+    SetSort(bson.M{"static_data.name": 1}).
+    SetLimit(int64(limit))
+
+  apps := make([]*App, 0)
+  cursor, err := s.stats.Find(ctx, filter, opts)
+  if err != nil { return apps, err }
+  err = cursor.All(ctx, &apps)
+  return apps, err
+}
+
+func (s *MongoStore) TopByPlayerCount(ctx context.Context, limit int) ([]RankedApp, error) {
+  opts := options.Find().
+    SetProjection(bson.M{"static_data": 1, "last_metric": 1}).
+    SetSort(bson.M{"last_metric.player_count": -1}).
+    SetLimit(int64(limit))
+
+  ranked := make([]RankedApp, 0, limit)
+  cursor, err := s.stats.Find(ctx, bson.M{"tracked": true}, opts)
+  if err != nil { return ranked, err }
+  defer cursor.Close(ctx)
+
+  for cursor.Next(ctx) {
+    var app App
+    if err = cursor.Decode(&app); err != nil { return ranked, err }
+    ranked = append(ranked, RankedApp{ID: app.ID, StaticData: app.StaticData, Value: app.LastMetric.PlayerCount})
+  }
+  return ranked, cursor.Err()
+}
+
+func (s *MongoStore) TopByMonthlyAverage(ctx context.Context, month time.Time, limit int) ([]RankedApp, error) {
+  pipeline := bson.A{
+    bson.M{"$match": bson.M{"metrics.date": month}},
+    bson.M{"$project": bson.M{"static_data": 1, "metrics": 1}},
+    bson.M{"$unwind": "$metrics"},
+    bson.M{"$match": bson.M{"metrics.date": month}},
+    bson.M{"$sort": bson.M{"metrics.avgplayers": -1}},
+    bson.M{"$limit": limit},
+  }
+
+  ranked := make([]RankedApp, 0, limit)
+  cursor, err := s.stats.Aggregate(ctx, pipeline)
+  if err != nil { return ranked, err }
+  defer cursor.Close(ctx)
+
+  for cursor.Next(ctx) {
+    var result struct {
+      ID         primitive.ObjectID `bson:"_id"`
+      StaticData StaticAppData      `bson:"static_data"`
+      Metric     Metric             `bson:"metrics"`
+    }
+    if err = cursor.Decode(&result); err != nil { return ranked, err }
+    ranked = append(ranked, RankedApp{ID: result.ID, StaticData: result.StaticData, Value: result.Metric.AvgPlayers})
+  }
+  return ranked, cursor.Err()
+}
+
+func (s *MongoStore) RecordException(ctx context.Context, app *App, jobType int, cause error) (*Exception, error) {
+  now := time.Now().UTC()
+  filter := bson.M{"app_ref": app.ID, "job_type": jobType}
+  update := bson.M{
+    "$inc": bson.M{"attempts": 1},
+    "$set": bson.M{"error": cause.Error(), "updated_at": now, "static_data": app.StaticData},
+    "$setOnInsert": bson.M{"created_at": now, "parked": false, "next_attempt": now},
+  }
+  opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+  var exception Exception
+  err := s.exceptions.FindOneAndUpdate(ctx, filter, update, opts).Decode(&exception)
+  if err != nil { return nil, err }
+  return &exception, nil
+}
+
+func (s *MongoStore) ScheduleException(ctx context.Context, id primitive.ObjectID, next time.Time, parked bool) error {
+  filter := bson.M{"_id": id}
+  update := bson.M{"$set": bson.M{"next_attempt": next, "parked": parked}}
+  _, err := s.exceptions.UpdateOne(ctx, filter, update)
+  return err
+}
+
+func (s *MongoStore) DeleteException(ctx context.Context, id primitive.ObjectID) error {
+  _, err := s.exceptions.DeleteOne(ctx, bson.M{"_id": id})
+  return err
+}
+
+func (s *MongoStore) GetDueExceptions(ctx context.Context, appRef primitive.ObjectID) ([]Exception, error) {
+  var exceptions []Exception
+
+  cursor, err := s.exceptions.Find(ctx, dueExceptionFilter(bson.M{"app_ref": appRef}))
+  if err != nil { return exceptions, err }
+
+  err = cursor.All(ctx, &exceptions)
+  return exceptions, err
+}
+
+// dueExceptionAppRefs returns the distinct apps with at least one due exception
+func (s *MongoStore) dueExceptionAppRefs(ctx context.Context) ([]interface{}, error) {
+  refs, err := s.exceptions.Distinct(ctx, "app_ref", dueExceptionFilter(bson.M{}))
+  if refs == nil { refs = make([]interface{}, 0) }
+  return refs, err
+}
+
+func dueExceptionFilter(filter bson.M) bson.M {
+  filter["parked"] = false
+  filter["next_attempt"] = bson.M{"$lte": time.Now().UTC()}
+  return filter
+}
+
+func (s *MongoStore) GetSyncState(ctx context.Context, domain string) (*SyncState, error) {
+  if s.state == nil { return nil, ErrNotSupported }
+  state := SyncState{ID: syncStateID(domain), Domain: domain}
+
+  err := s.state.FindOne(ctx, bson.M{"_id": state.ID}).Decode(&state)
+  if err == mongo.ErrNoDocuments { return &state, nil }
+  if err != nil { return nil, err }
+  return &state, nil
+}
+
+func (s *MongoStore) SaveSyncState(ctx context.Context, state *SyncState) error {
+  if s.state == nil { return ErrNotSupported }
+  state.ID = syncStateID(state.Domain)
+  state.UpdatedAt = time.Now().UTC()
+
+  opts := options.Replace().SetUpsert(true)
+  _, err := s.state.ReplaceOne(ctx, bson.M{"_id": state.ID}, state, opts)
+  return err
+}
+
+func (s *MongoStore) GetCheckpoint(ctx context.Context, jobType int, shard Shard) (*Checkpoint, error) {
+  if s.state == nil { return nil, ErrNotSupported }
+
+  var checkpoint Checkpoint
+  err := s.state.FindOne(ctx, bson.M{"_id": checkpointID(jobType, shard)}).Decode(&checkpoint)
+  if err == mongo.ErrNoDocuments { return nil, ErrNotFound }
+  if err != nil { return nil, err }
+  return &checkpoint, nil
+}
+
+func (s *MongoStore) SaveCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+  if s.state == nil { return ErrNotSupported }
+  checkpoint.ID = checkpointID(checkpoint.JobType, checkpoint.Shard)
+  checkpoint.UpdatedAt = time.Now().UTC()
+
+  opts := options.Replace().SetUpsert(true)
+  _, err := s.state.ReplaceOne(ctx, bson.M{"_id": checkpoint.ID}, checkpoint, opts)
+  return err
+}
+
+func (s *MongoStore) DeleteCheckpoint(ctx context.Context, jobType int, shard Shard) error {
+  if s.state == nil { return ErrNotSupported }
+  _, err := s.state.DeleteOne(ctx, bson.M{"_id": checkpointID(jobType, shard)})
+  return err
+}
+
+// AcquireLease upserts the lease if it is free, an upsert that finds it held
+// collides with it on _id
+func (s *MongoStore) AcquireLease(ctx context.Context, jobType int, shard Shard, owner string, ttl time.Duration) (*Lease, error) {
+  return s.takeLease(ctx, jobType, shard, owner, ttl, nil)
+}
+
+func (s *MongoStore) JoinLease(ctx context.Context, jobType int, shard Shard, owner string, ttl time.Duration) (*Lease, error) {
+  holder := bson.A{shard.Index}
+  holders := bson.M{"$cond": bson.A{
+    bson.M{"$eq": bson.A{"$owner", owner}},
+    bson.M{"$setUnion": bson.A{bson.M{"$ifNull": bson.A{"$holders", bson.A{}}}, holder}},
+    holder,
+  }}
+  return s.takeLease(ctx, jobType, Shard{}, owner, ttl, holders)
+}
+
+// takeLease upserts the lease unless another owner holds it, setting the
+// holders to the given expression if any
+func (s *MongoStore) takeLease(ctx context.Context, jobType int, shard Shard, owner string, ttl time.Duration, holders interface{}) (*Lease, error) {
+  if s.state == nil { return nil, ErrNotSupported }
+
+  id := leaseID(jobType, shard)
+  now := time.Now().UTC()
+  filter := bson.M{"_id": id, "$or": bson.A{bson.M{"owner": owner}, bson.M{"expires_at": bson.M{"$lte": now}}}}
+  fields := bson.M{
+    "job_type":    jobType,
+    "shard":       shard,
+    "owner":       owner,
+    "acquired_at": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$owner", owner}}, "$acquired_at", now}},
+    "expires_at":  now.Add(ttl),
+  }
+  if holders != nil { fields["holders"] = holders }
+  update := mongo.Pipeline{{{Key: "$set", Value: fields}}}
+  opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+  var lease Lease
+  err := s.state.FindOneAndUpdate(ctx, filter, update, opts).Decode(&lease)
+  if isDuplicateKey(err) {
+    if err = s.state.FindOne(ctx, bson.M{"_id": id}).Decode(&lease); err != nil { return nil, err }
+    return &lease, ErrLeaseHeld
+  }
+  if err != nil { return nil, err }
+  return &lease, nil
+}
+
+func isDuplicateKey(err error) bool {
+  switch e := err.(type) {
+  case mongo.CommandError:
+    return e.Code == DUPLICATEKEY
+  case mongo.WriteException:
+    for _, writeErr := range e.WriteErrors {
+      if writeErr.Code == DUPLICATEKEY { return true }
+    }
+  }
+  return false
+}
+
+func (s *MongoStore) ReleaseLease(ctx context.Context, jobType int, shard Shard, owner string) error {
+  if s.state == nil { return ErrNotSupported }
+  _, err := s.state.DeleteOne(ctx, bson.M{"_id": leaseID(jobType, shard), "owner": owner})
+  return err
+}
+
+func (s *MongoStore) LeaveLease(ctx context.Context, jobType int, shard Shard, owner string) error {
+  if s.state == nil { return ErrNotSupported }
+
+  // Another shard joining in between keeps the holders non-empty
+  id := leaseID(jobType, Shard{})
+  _, err := s.state.UpdateOne(ctx, bson.M{"_id": id, "owner": owner}, bson.M{"$pull": bson.M{"holders": shard.Index}})
+  if err != nil { return err }
+  _, err = s.state.DeleteOne(ctx, bson.M{"_id": id, "owner": owner, "holders": bson.M{"$size": 0}})
+  return err
+}
+
+func (s *MongoStore) RecordJobRun(ctx context.Context, run *JobRun) error {
+  if s.jobRuns == nil { return ErrNotSupported }
+  if run.ID.IsZero() { run.ID = primitive.NewObjectID() }
+  _, err := s.jobRuns.InsertOne(ctx, run)
+  return err
+}
+
+func (s *MongoStore) ListJobRuns(ctx context.Context, jobType int, limit int) ([]JobRun, error) {
+  if s.jobRuns == nil { return nil, ErrNotSupported }
+
+  filter := bson.M{}
+  if jobType != ANYJOB { filter["job_type"] = jobType }
+  opts := options.Find().SetSort(bson.D{{Key: "started_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit))
+  cursor, err := s.jobRuns.Find(ctx, filter, opts)
+  if err != nil { return nil, err }
+
+  runs := make([]JobRun, 0)
+  err = cursor.All(ctx, &runs)
+  return runs, err
+}
+
+func (s *MongoStore) GetJobRuns(ctx context.Context, runID string) ([]JobRun, error) {
+  if s.jobRuns == nil { return nil, ErrNotSupported }
+
+  opts := options.Find().SetSort(bson.D{{Key: "started_at", Value: 1}, {Key: "_id", Value: 1}})
+  cursor, err := s.jobRuns.Find(ctx, bson.M{"run_id": runID}, opts)
+  if err != nil { return nil, err }
+
+  runs := make([]JobRun, 0)
+  err = cursor.All(ctx, &runs)
+  return runs, err
+}
+
+func (s *MongoStore) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+  return migrationStatus(ctx, s)
+}
+
+func (s *MongoStore) MigrateUp(ctx context.Context) ([]MigrationStatus, error) {
+  return migrateUp(ctx, s)
+}
+
+// Applied migrations are recorded in the state collection
+func migrationID(version int) string { return fmt.Sprintf("migration:%d", version) }
+
+func (s *MongoStore) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+  if s.state == nil { return nil, ErrNotSupported }
+
+  filter := bson.M{"_id": bson.M{"$regex": "^migration:"}}
+  cursor, err := s.state.Find(ctx, filter)
+  if err != nil { return nil, err }
+  defer cursor.Close(ctx)
+
+  applied := make(map[int]time.Time)
+  for cursor.Next(ctx) {
+    var record struct {
+      Version   int       `bson:"version"`
+      AppliedAt time.Time `bson:"applied_at"`
+    }
+    if err = cursor.Decode(&record); err != nil { return nil, err }
+    applied[record.Version] = record.AppliedAt
+  }
+  return applied, cursor.Err()
+}
+
+func (s *MongoStore) runMigration(ctx context.Context, m *migration) error {
+  if m.mongo == nil { return nil }
+  return m.mongo(ctx, s)
+}
+
+func (s *MongoStore) recordMigration(ctx context.Context, m *migration, appliedAt time.Time) error {
+  record := bson.M{"version": m.version, "description": m.description, "applied_at": appliedAt}
+  opts := options.Replace().SetUpsert(true)
+  _, err := s.state.ReplaceOne(ctx, bson.M{"_id": migrationID(m.version)}, record, opts)
+  return err
+}
+
+// Close is a no-op, the caller owns the mongo client
+func (s *MongoStore) Close(ctx context.Context) error {
+  return nil
+}
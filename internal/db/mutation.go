@@ -0,0 +1,23 @@
+package db
+
+import (
+  "go.mongodb.org/mongo-driver/bson/primitive"
+  "time"
+)
+
+// Mutation is a pending change to a single app. Jobs queue them and the store
+// applies them in bulk with ApplyMutations, every set field is applied.
+type Mutation struct {
+  AppRef      primitive.ObjectID
+  Insert      *App         // Inserts a new app, the other fields are ignored
+  Sample      *DailyMetric // Appended to the samples and made the last metric, unless the app has a sample that day
+  Metric      *Metric      // Appended to the monthly metrics
+  PurgeBefore time.Time    // Samples dated before are dropped, applied when set, failures are a *PurgeError
+  Tracked     *bool
+  Metadata    *AppMetadata
+}
+
+// sampleDay is the UTC day a sample is taken on, apps get one sample a day
+func sampleDay(date time.Time) time.Time {
+  return date.UTC().Truncate(24 * time.Hour)
+}
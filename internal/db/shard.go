@@ -0,0 +1,72 @@
+package db
+
+import (
+  "context"
+  "fmt"
+  "hash/fnv"
+)
+
+// Shard selects the apps one of Count parallel invocations of a job runs
+// over, partitioned on a hash of domain and app id. The zero value selects
+// every app. The hash is checked as apps are read, so every shard still
+// reads the whole library from the store and skips the apps of the others.
+type Shard struct {
+  Index int `bson:"index" json:"index"`
+  Count int `bson:"count" json:"count"`
+}
+
+// Sharded reports whether the shard is one of several
+func (s Shard) Sharded() bool { return s.Count > 1 }
+
+// Validate rejects an index outside [0, Count)
+func (s Shard) Validate() error {
+  if s.Count < 0 || (s.Count > 0 && (s.Index < 0 || s.Index >= s.Count)) || (s.Count == 0 && s.Index != 0) {
+    return fmt.Errorf("invalid shard %d of %d", s.Index, s.Count)
+  }
+  return nil
+}
+
+// Contains reports whether the app belongs to the shard, the same app always
+// lands in the same shard for a given count
+func (s Shard) Contains(key AppKey) bool {
+  if !s.Sharded() { return true }
+  hash := fnv.New32a()
+  fmt.Fprintf(hash, "%s:%d", key.Domain, key.AppID)
+  return int(hash.Sum32()%uint32(s.Count)) == s.Index
+}
+
+// suffix distinguishes the state a shard keeps, such as its checkpoint and
+// lease, from the other shards'. Unsharded jobs keep their unsuffixed ids.
+func (s Shard) suffix() string {
+  if !s.Sharded() { return "" }
+  return fmt.Sprintf(":%d/%d", s.Index, s.Count)
+}
+
+// share estimates the shard's part of total apps, for progress only
+func (s Shard) share(total int) int {
+  if !s.Sharded() { return total }
+  return total / s.Count
+}
+
+// shardIterator skips the apps of other shards
+type shardIterator struct {
+  AppIterator
+  shard Shard
+  app   *App
+  err   error
+}
+
+func newShardIterator(it AppIterator, shard Shard) AppIterator {
+  if !shard.Sharded() { return it }
+  return &shardIterator{AppIterator: it, shard: shard}
+}
+
+func (it *shardIterator) Next(ctx context.Context) bool {
+  for it.AppIterator.Next(ctx) {
+    it.app, it.err = it.AppIterator.App()
+    if it.err != nil || it.shard.Contains(it.app.StaticData.Key()) { return true }
+  }
+  return false
+}
+
+func (it *shardIterator) App() (*App, error) { return it.app, it.err }
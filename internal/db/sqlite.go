@@ -0,0 +1,1046 @@
+package db
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "strings"
+  "time"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SQLITEDRIVER is registered by sqlite_driver.go, which needs cgo and is left
+// out of builds tagged nosqlite
+const SQLITEDRIVER = "sqlite3"
+
+var sqliteSchema = []string{
+  `CREATE TABLE IF NOT EXISTS apps (
+    id                  TEXT PRIMARY KEY,
+    domain              TEXT NOT NULL,
+    app_id              INTEGER NOT NULL,
+    name                TEXT NOT NULL,
+    tracked             INTEGER NOT NULL DEFAULT 0,
+    last_metric_date    INTEGER NOT NULL DEFAULT -62135596800,
+    last_metric_count   INTEGER NOT NULL DEFAULT 0,
+    metadata            TEXT,
+    metadata_updated_at INTEGER,
+    UNIQUE (domain, app_id)
+  )`,
+  `CREATE INDEX IF NOT EXISTS apps_tracked ON apps (tracked)`,
+  `CREATE TABLE IF NOT EXISTS daily_metrics (
+    app          TEXT NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+    date         INTEGER NOT NULL,
+    player_count INTEGER NOT NULL
+  )`,
+  `CREATE INDEX IF NOT EXISTS daily_metrics_app ON daily_metrics (app, date)`,
+  `CREATE TABLE IF NOT EXISTS metrics (
+    app          TEXT NOT NULL REFERENCES apps (id) ON DELETE CASCADE,
+    date         INTEGER NOT NULL,
+    avg_players  INTEGER NOT NULL,
+    gain         INTEGER NOT NULL,
+    gain_ratio   REAL NOT NULL,
+    no_previous  INTEGER NOT NULL,
+    peak         INTEGER NOT NULL
+  )`,
+  `CREATE INDEX IF NOT EXISTS metrics_app ON metrics (app, date)`,
+  `CREATE TABLE IF NOT EXISTS exceptions (
+    id           TEXT PRIMARY KEY,
+    app_ref      TEXT NOT NULL,
+    domain       TEXT NOT NULL,
+    app_id       INTEGER NOT NULL,
+    name         TEXT NOT NULL,
+    job_type     INTEGER NOT NULL,
+    error        TEXT NOT NULL,
+    attempts     INTEGER NOT NULL,
+    parked       INTEGER NOT NULL,
+    created_at   INTEGER NOT NULL,
+    updated_at   INTEGER NOT NULL,
+    next_attempt INTEGER NOT NULL,
+    UNIQUE (app_ref, job_type)
+  )`,
+  `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version     INTEGER PRIMARY KEY,
+    description TEXT NOT NULL,
+    applied_at  INTEGER NOT NULL
+  )`,
+  `CREATE TABLE IF NOT EXISTS sync_state (
+    id                TEXT PRIMARY KEY,
+    domain            TEXT NOT NULL,
+    if_modified_since INTEGER NOT NULL,
+    last_appid        INTEGER NOT NULL,
+    cycle_start       INTEGER NOT NULL,
+    updated_at        INTEGER NOT NULL
+  )`,
+  `CREATE TABLE IF NOT EXISTS checkpoints (
+    id          TEXT PRIMARY KEY,
+    job_type    INTEGER NOT NULL,
+    run_id      TEXT NOT NULL,
+    after_id    TEXT NOT NULL,
+    completed   TEXT NOT NULL DEFAULT '',
+    num_success INTEGER NOT NULL,
+    num_errors  INTEGER NOT NULL,
+    started_at  INTEGER NOT NULL,
+    updated_at  INTEGER NOT NULL
+  )`,
+  `CREATE TABLE IF NOT EXISTS job_runs (
+    id            TEXT PRIMARY KEY,
+    run_id        TEXT NOT NULL,
+    job_type      INTEGER NOT NULL,
+    shard_index   INTEGER NOT NULL DEFAULT 0,
+    shard_count   INTEGER NOT NULL DEFAULT 0,
+    trigger       TEXT NOT NULL,
+    started_at    INTEGER NOT NULL,
+    ended_at      INTEGER NOT NULL,
+    resumed       INTEGER NOT NULL,
+    complete      INTEGER NOT NULL,
+    num_success   INTEGER NOT NULL,
+    num_errors    INTEGER NOT NULL,
+    num_skipped   INTEGER NOT NULL,
+    num_timed_out INTEGER NOT NULL,
+    num_archived  INTEGER NOT NULL DEFAULT 0,
+    num_purged    INTEGER NOT NULL DEFAULT 0,
+    domains       TEXT NOT NULL,
+    error_samples TEXT NOT NULL,
+    skipped       TEXT NOT NULL
+  )`,
+  `CREATE INDEX IF NOT EXISTS job_runs_started ON job_runs (job_type, started_at)`,
+  `CREATE INDEX IF NOT EXISTS job_runs_run ON job_runs (run_id)`,
+  `CREATE TABLE IF NOT EXISTS leases (
+    id          TEXT PRIMARY KEY,
+    job_type    INTEGER NOT NULL,
+    owner       TEXT NOT NULL,
+    acquired_at INTEGER NOT NULL,
+    expires_at  INTEGER NOT NULL,
+    holders     TEXT NOT NULL DEFAULT '[]'
+  )`,
+}
+
+// SQLiteStore keeps everything in a single SQLite database file, for local
+// and single box deployments
+type SQLiteStore struct {
+  db *sql.DB
+}
+
+// OpenSQLite opens (creating if needed) the database at path. It fails with
+// ErrNotSupported in builds without the SQLite driver.
+func OpenSQLite(path string) (*SQLiteStore, error) {
+  if !sqliteDriverRegistered() { return nil, fmt.Errorf("sqlite driver not built in, it needs cgo and no nosqlite tag: %w", ErrNotSupported) }
+
+  db, err := sql.Open(SQLITEDRIVER, "file:"+path+"?_busy_timeout=5000&_foreign_keys=on")
+  if err != nil { return nil, err }
+
+  // SQLite allows a single writer, serialise access rather than fail on locks
+  db.SetMaxOpenConns(1)
+
+  for _, statement := range sqliteSchema {
+    if _, err = db.Exec(statement); err != nil {
+      db.Close()
+      return nil, err
+    }
+  }
+  return &SQLiteStore{db: db}, nil
+}
+
+func sqliteDriverRegistered() bool {
+  for _, driver := range sql.Drivers() {
+    if driver == SQLITEDRIVER { return true }
+  }
+  return false
+}
+
+// Times are stored as unix seconds, the zero time is -62135596800
+func toUnix(t time.Time) int64 { return t.Unix() }
+
+func fromUnix(sec int64) time.Time { return time.Unix(sec, 0).UTC() }
+
+func toBool(val int) bool { return val != 0 }
+
+func fromBool(val bool) int {
+  if val { return 1 }
+  return 0
+}
+
+// sqliteAppIterator loads a page of apps at a time in id order, so no
+// statement is held open between calls
+type sqliteAppIterator struct {
+  store  *SQLiteStore
+  where  string
+  args   []interface{}
+  page   []*App
+  idx    int
+  lastID string
+  done   bool
+  err    error
+}
+
+func (it *sqliteAppIterator) Next(ctx context.Context) bool {
+  it.idx++
+  if it.idx < len(it.page) { return true }
+  if it.done || it.err != nil { return false }
+
+  query := "SELECT id FROM apps WHERE id > ?" + it.where + " ORDER BY id LIMIT ?"
+  args := append([]interface{}{it.lastID}, it.args...)
+  ids, err := it.store.selectIDs(ctx, query, append(args, ITERATORBATCH)...)
+  if err != nil {
+    it.err = err
+    return false
+  }
+  if len(ids) < ITERATORBATCH { it.done = true }
+  if len(ids) == 0 { return false }
+
+  it.page = it.page[:0]
+  for _, id := range ids {
+    app, err := it.store.loadApp(ctx, id)
+    if err != nil {
+      it.err = err
+      return false
+    }
+    it.page = append(it.page, app)
+  }
+  it.idx = 0
+  it.lastID = ids[len(ids)-1]
+  return true
+}
+
+func (it *sqliteAppIterator) App() (*App, error) { return it.page[it.idx], nil }
+
+func (it *sqliteAppIterator) Err() error { return it.err }
+
+func (it *sqliteAppIterator) Close(ctx context.Context) error { return nil }
+
+func (s *SQLiteStore) IterateApps(ctx context.Context, filter AppFilter) (int, AppIterator, error) {
+  var conditions []string
+  var args []interface{}
+
+  if filter.TrackedOnly {
+    conditions = append(conditions, "tracked = 1")
+  }
+  if filter.DueExceptions {
+    conditions = append(conditions, "id IN (SELECT app_ref FROM exceptions WHERE parked = 0 AND next_attempt <= ?)")
+    args = append(args, toUnix(time.Now().UTC()))
+  }
+  if !filter.MetadataStaleBefore.IsZero() {
+    placeholders := make([]string, 0, len(filter.MetadataDomains))
+    for _, domain := range filter.MetadataDomains {
+      placeholders = append(placeholders, "?")
+      args = append(args, domain)
+    }
+    conditions = append(conditions, "domain IN ("+strings.Join(placeholders, ", ")+")")
+    conditions = append(conditions, "(metadata_updated_at IS NULL OR metadata_updated_at < ?)")
+    args = append(args, toUnix(filter.MetadataStaleBefore))
+  }
+
+  if !filter.AfterID.IsZero() {
+    conditions = append(conditions, "id > ?")
+    args = append(args, filter.AfterID.Hex())
+  }
+
+  var where string
+  if len(conditions) > 0 { where = " AND " + strings.Join(conditions, " AND ") }
+
+  var count int
+  err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM apps WHERE 1 = 1"+where, args...).Scan(&count)
+  if err != nil { return 0, nil, err }
+
+  it := &sqliteAppIterator{store: s, where: where, args: args, idx: -1}
+  return filter.Shard.share(count), newShardIterator(it, filter.Shard), nil
+}
+
+func (s *SQLiteStore) selectIDs(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+  rows, err := s.db.QueryContext(ctx, query, args...)
+  if err != nil { return nil, err }
+  defer rows.Close()
+
+  var ids []string
+  for rows.Next() {
+    var id string
+    if err = rows.Scan(&id); err != nil { return nil, err }
+    ids = append(ids, id)
+  }
+  return ids, rows.Err()
+}
+
+// loadApp assembles an app from its row and its metric rows
+func (s *SQLiteStore) loadApp(ctx context.Context, id string) (*App, error) {
+  var app App
+  var hexID string
+  var tracked int
+  var lastDate int64
+  var metadata sql.NullString
+
+  row := s.db.QueryRowContext(ctx, `SELECT id, domain, app_id, name, tracked, last_metric_date, last_metric_count, metadata
+    FROM apps WHERE id = ?`, id)
+  err := row.Scan(&hexID, &app.StaticData.Domain, &app.StaticData.AppID, &app.StaticData.Name,
+    &tracked, &lastDate, &app.LastMetric.PlayerCount, &metadata)
+  if err == sql.ErrNoRows { return nil, ErrNotFound }
+  if err != nil { return nil, err }
+
+  if app.ID, err = primitive.ObjectIDFromHex(hexID); err != nil { return nil, err }
+  app.Tracked = toBool(tracked)
+  app.LastMetric.Date = fromUnix(lastDate)
+  if metadata.Valid {
+    app.StaticData.Metadata = &AppMetadata{}
+    if err = json.Unmarshal([]byte(metadata.String), app.StaticData.Metadata); err != nil { return nil, err }
+  }
+
+  app.Metrics = make([]Metric, 0)
+  rows, err := s.db.QueryContext(ctx, `SELECT date, avg_players, gain, gain_ratio, no_previous, peak
+    FROM metrics WHERE app = ? ORDER BY date, rowid`, id)
+  if err != nil { return nil, err }
+  defer rows.Close()
+  for rows.Next() {
+    metric, err := scanMetric(rows)
+    if err != nil { return nil, err }
+    app.Metrics = append(app.Metrics, *metric)
+  }
+  return &app, rows.Err()
+}
+
+func (s *SQLiteStore) FindApp(ctx context.Context, domain string, appID int) (*App, error) {
+  var id string
+  err := s.db.QueryRowContext(ctx, "SELECT id FROM apps WHERE domain = ? AND app_id = ?", domain, appID).Scan(&id)
+  if err == sql.ErrNoRows { return nil, ErrNotFound }
+  if err != nil { return nil, err }
+  return s.loadApp(ctx, id)
+}
+
+// IterateStaticData pages through the apps so no statement is held open while fn runs
+func (s *SQLiteStore) IterateStaticData(ctx context.Context, fn func(*StaticAppData) error, domains ...string) error {
+  var where string
+  var args []interface{}
+  if len(domains) > 0 {
+    for _, domain := range domains { args = append(args, domain) }
+    where = " AND domain IN (?" + strings.Repeat(", ?", len(domains)-1) + ")"
+  }
+
+  for lastID := ""; ; {
+    pageArgs := append([]interface{}{lastID}, args...)
+    rows, err := s.db.QueryContext(ctx, "SELECT id, domain, app_id, name FROM apps WHERE id > ?"+where+
+      " ORDER BY id LIMIT ?", append(pageArgs, ITERATORBATCH)...)
+    if err != nil { return err }
+
+    var page []StaticAppData
+    for rows.Next() {
+      var staticData StaticAppData
+      if err = rows.Scan(&lastID, &staticData.Domain, &staticData.AppID, &staticData.Name); err != nil {
+        rows.Close()
+        return err
+      }
+      page = append(page, staticData)
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil { return err }
+
+    for i := range page {
+      if err = fn(&page[i]); err != nil { return err }
+    }
+    if len(page) < ITERATORBATCH { return nil }
+  }
+}
+
+// withTx runs fn in a transaction, committing only if it succeeds
+func (s *SQLiteStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+  tx, err := s.db.BeginTx(ctx, nil)
+  if err != nil { return err }
+  if err = fn(tx); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
+
+func (s *SQLiteStore) InsertApp(ctx context.Context, app *App) error {
+  return s.withTx(ctx, func(tx *sql.Tx) error {
+    return applyMutation(ctx, tx, &Mutation{Insert: app})
+  })
+}
+
+// insertApp leaves an app already in the library untouched
+func insertApp(ctx context.Context, tx *sql.Tx, app *App) error {
+  if app.ID.IsZero() { app.ID = primitive.NewObjectID() }
+  res, err := tx.ExecContext(ctx, `INSERT INTO apps (id, domain, app_id, name) VALUES (?, ?, ?, ?)
+    ON CONFLICT (domain, app_id) DO NOTHING`,
+    app.ID.Hex(), app.StaticData.Domain, app.StaticData.AppID, app.StaticData.Name)
+  if err != nil { return err }
+  if affected, _ := res.RowsAffected(); affected == 0 { return nil }
+  return writeAppData(ctx, tx, app)
+}
+
+func (s *SQLiteStore) UpsertApps(ctx context.Context, apps []StaticAppData) (int, int, error) {
+  numInserted, numUpdated := 0, 0
+  err := s.withTx(ctx, func(tx *sql.Tx) error {
+    for _, staticData := range apps {
+      res, err := tx.ExecContext(ctx, `INSERT INTO apps (id, domain, app_id, name) VALUES (?, ?, ?, ?)
+        ON CONFLICT (domain, app_id) DO NOTHING`,
+        primitive.NewObjectID().Hex(), staticData.Domain, staticData.AppID, staticData.Name)
+      if err != nil { return err }
+      if affected, _ := res.RowsAffected(); affected > 0 {
+        numInserted++
+        continue
+      }
+
+      res, err = tx.ExecContext(ctx, `UPDATE apps SET name = ? WHERE domain = ? AND app_id = ? AND name != ?`,
+        staticData.Name, staticData.Domain, staticData.AppID, staticData.Name)
+      if err != nil { return err }
+      if affected, _ := res.RowsAffected(); affected > 0 { numUpdated++ }
+    }
+    return nil
+  })
+  if err != nil { return 0, 0, err }
+  return numInserted, numUpdated, nil
+}
+
+func (s *SQLiteStore) SetMetric(ctx context.Context, id primitive.ObjectID, metric Metric) error {
+  return s.withTx(ctx, func(tx *sql.Tx) error {
+    var exists int
+    err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM apps WHERE id = ?", id.Hex()).Scan(&exists)
+    if err != nil { return err }
+    if exists == 0 { return ErrNotFound }
+
+    _, err = tx.ExecContext(ctx, "DELETE FROM metrics WHERE app = ? AND date = ?", id.Hex(), toUnix(metric.Date))
+    if err != nil { return err }
+    return insertMetric(ctx, tx, id.Hex(), &metric)
+  })
+}
+
+// writeAppData writes everything about an app except its static data
+func writeAppData(ctx context.Context, tx *sql.Tx, app *App) error {
+  id := app.ID.Hex()
+
+  var metadata sql.NullString
+  var metadataUpdatedAt sql.NullInt64
+  if app.StaticData.Metadata != nil {
+    serial, err := json.Marshal(app.StaticData.Metadata)
+    if err != nil { return err }
+    metadata = sql.NullString{String: string(serial), Valid: true}
+    metadataUpdatedAt = sql.NullInt64{Int64: toUnix(app.StaticData.Metadata.UpdatedAt), Valid: true}
+  }
+
+  _, err := tx.ExecContext(ctx, `UPDATE apps SET tracked = ?, last_metric_date = ?, last_metric_count = ?,
+    metadata = ?, metadata_updated_at = ? WHERE id = ?`,
+    fromBool(app.Tracked), toUnix(app.LastMetric.Date), app.LastMetric.PlayerCount, metadata, metadataUpdatedAt, id)
+  if err != nil { return err }
+
+  for _, metric := range app.Metrics {
+    if err = insertMetric(ctx, tx, id, &metric); err != nil { return err }
+  }
+  return nil
+}
+
+func insertMetric(ctx context.Context, tx *sql.Tx, id string, metric *Metric) error {
+  _, err := tx.ExecContext(ctx, `INSERT INTO metrics (app, date, avg_players, gain, gain_ratio, no_previous, peak)
+    VALUES (?, ?, ?, ?, ?, ?, ?)`,
+    id, toUnix(metric.Date), metric.AvgPlayers, metric.Gain, metric.GainRatio, fromBool(metric.NoPrevious), metric.Peak)
+  return err
+}
+
+// appendMetric inserts the metric unless the app has one for that month
+func appendMetric(ctx context.Context, tx *sql.Tx, id string, metric *Metric) error {
+  _, err := tx.ExecContext(ctx, `INSERT INTO metrics (app, date, avg_players, gain, gain_ratio, no_previous, peak)
+    SELECT ?, ?, ?, ?, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM metrics WHERE app = ? AND date = ?)`,
+    id, toUnix(metric.Date), metric.AvgPlayers, metric.Gain, metric.GainRatio, fromBool(metric.NoPrevious), metric.Peak,
+    id, toUnix(metric.Date))
+  return err
+}
+
+// updateApp runs an update against the apps table, reporting ErrNotFound if nothing matched
+func updateApp(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) error {
+  res, err := tx.ExecContext(ctx, query, args...)
+  if err != nil { return err }
+  if affected, _ := res.RowsAffected(); affected == 0 { return ErrNotFound }
+  return nil
+}
+
+func (s *SQLiteStore) AppendDailyMetric(ctx context.Context, id primitive.ObjectID, sample DailyMetric) error {
+  return s.withTx(ctx, func(tx *sql.Tx) error {
+    return applyMutation(ctx, tx, &Mutation{AppRef: id, Sample: &sample})
+  })
+}
+
+func (s *SQLiteStore) InsertDailyMetrics(ctx context.Context, id primitive.ObjectID, samples []DailyMetric) error {
+  return s.withTx(ctx, func(tx *sql.Tx) error {
+    for _, sample := range samples {
+      _, err := tx.ExecContext(ctx, "INSERT INTO daily_metrics (app, date, player_count) VALUES (?, ?, ?)",
+        id.Hex(), toUnix(sample.Date), sample.PlayerCount)
+      if err != nil { return err }
+    }
+    if len(samples) == 0 { return nil }
+
+    newest := newestSample(samples)
+    _, err := tx.ExecContext(ctx, `UPDATE apps SET last_metric_date = ?, last_metric_count = ?
+      WHERE id = ? AND last_metric_date < ?`,
+      toUnix(newest.Date), newest.PlayerCount, id.Hex(), toUnix(newest.Date))
+    return err
+  })
+}
+
+func (s *SQLiteStore) GetDailyMetrics(ctx context.Context, id primitive.ObjectID, from time.Time, to time.Time) ([]DailyMetric, error) {
+  query := "SELECT date, player_count FROM daily_metrics WHERE app = ? AND date >= ?"
+  args := []interface{}{id.Hex(), toUnix(from)}
+  if !to.IsZero() {
+    query += " AND date < ?"
+    args = append(args, toUnix(to))
+  }
+
+  samples := make([]DailyMetric, 0)
+  rows, err := s.db.QueryContext(ctx, query+" ORDER BY date, rowid", args...)
+  if err != nil { return samples, err }
+  defer rows.Close()
+
+  for rows.Next() {
+    var date int64
+    var sample DailyMetric
+    if err = rows.Scan(&date, &sample.PlayerCount); err != nil { return samples, err }
+    sample.Date = fromUnix(date)
+    samples = append(samples, sample)
+  }
+  return samples, rows.Err()
+}
+
+func (s *SQLiteStore) GetMetrics(ctx context.Context, id primitive.ObjectID, from time.Time, to time.Time) ([]Metric, error) {
+  var exists int
+  err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM apps WHERE id = ?", id.Hex()).Scan(&exists)
+  if err != nil { return nil, err }
+  if exists == 0 { return nil, ErrNotFound }
+
+  query := "SELECT date, avg_players, gain, gain_ratio, no_previous, peak FROM metrics WHERE app = ? AND date >= ?"
+  args := []interface{}{id.Hex(), toUnix(from)}
+  if !to.IsZero() {
+    query += " AND date < ?"
+    args = append(args, toUnix(to))
+  }
+
+  metrics := make([]Metric, 0)
+  rows, err := s.db.QueryContext(ctx, query+" ORDER BY date, rowid", args...)
+  if err != nil { return metrics, err }
+  defer rows.Close()
+
+  for rows.Next() {
+    metric, err := scanMetric(rows)
+    if err != nil { return metrics, err }
+    metrics = append(metrics, *metric)
+  }
+  return metrics, rows.Err()
+}
+
+func scanMetric(scanner interface{ Scan(...interface{}) error }) (*Metric, error) {
+  var date int64
+  var noPrevious int
+  var metric Metric
+  err := scanner.Scan(&date, &metric.AvgPlayers, &metric.Gain, &metric.GainRatio, &noPrevious, &metric.Peak)
+  if err != nil { return nil, err }
+  metric.Date = fromUnix(date)
+  metric.NoPrevious = toBool(noPrevious)
+  return &metric, nil
+}
+
+// AppendMetric goes through ApplyMutations so a failed purge keeps the metric
+func (s *SQLiteStore) AppendMetric(ctx context.Context, id primitive.ObjectID, metric Metric, purgeBefore time.Time) error {
+  return s.ApplyMutations(ctx, []Mutation{{AppRef: id, Metric: &metric, PurgeBefore: purgeBefore}})[0]
+}
+
+func (s *SQLiteStore) IterateSamplesBefore(ctx context.Context, before time.Time, fn func(AppKey, DailyMetric) error) error {
+  rows, err := s.db.QueryContext(ctx, `SELECT apps.domain, apps.app_id, daily_metrics.date, daily_metrics.player_count
+    FROM daily_metrics JOIN apps ON apps.id = daily_metrics.app
+    WHERE daily_metrics.date < ? ORDER BY daily_metrics.app, daily_metrics.date, daily_metrics.rowid`, toUnix(before))
+  if err != nil { return err }
+  defer rows.Close()
+
+  for rows.Next() {
+    var key AppKey
+    var date int64
+    var sample DailyMetric
+    if err = rows.Scan(&key.Domain, &key.AppID, &date, &sample.PlayerCount); err != nil { return err }
+    sample.Date = fromUnix(date)
+    if err = fn(key, sample); err != nil { return err }
+  }
+  return rows.Err()
+}
+
+// PurgeSamplesBefore drops every sample IterateSamplesBefore sees, the
+// samples of a deleted app are dropped with it
+func (s *SQLiteStore) PurgeSamplesBefore(ctx context.Context, before time.Time) (int, error) {
+  res, err := s.db.ExecContext(ctx, "DELETE FROM daily_metrics WHERE date < ?", toUnix(before))
+  if err != nil { return 0, err }
+  numPurged, err := res.RowsAffected()
+  return int(numPurged), err
+}
+
+func (s *SQLiteStore) SetTrackFlag(ctx context.Context, id primitive.ObjectID, val bool) error {
+  return s.withTx(ctx, func(tx *sql.Tx) error {
+    return applyMutation(ctx, tx, &Mutation{AppRef: id, Tracked: &val})
+  })
+}
+
+func (s *SQLiteStore) SetMetadata(ctx context.Context, id primitive.ObjectID, metadata *AppMetadata) error {
+  return s.withTx(ctx, func(tx *sql.Tx) error {
+    return applyMutation(ctx, tx, &Mutation{AppRef: id, Metadata: metadata})
+  })
+}
+
+// ApplyMutations writes the batch in a single transaction, each mutation in
+// its own savepoint so a failure only rolls back that mutation
+func (s *SQLiteStore) ApplyMutations(ctx context.Context, mutations []Mutation) []error {
+  errs := make([]error, len(mutations))
+  err := s.withTx(ctx, func(tx *sql.Tx) error {
+    for i := range mutations {
+      if _, err := tx.ExecContext(ctx, "SAVEPOINT mutation"); err != nil { return err }
+      // A failed purge keeps the rest of the mutation
+      var purgeErr *PurgeError
+      if errs[i] = applyMutation(ctx, tx, &mutations[i]); errs[i] != nil && !errors.As(errs[i], &purgeErr) {
+        if _, err := tx.ExecContext(ctx, "ROLLBACK TO mutation"); err != nil { return err }
+      }
+      if _, err := tx.ExecContext(ctx, "RELEASE mutation"); err != nil { return err }
+    }
+    return nil
+  })
+
+  // Nothing was committed
+  if err != nil {
+    for i := range errs { errs[i] = err }
+  }
+  return errs
+}
+
+// applyMutation updates the app row first so a missing app is reported as
+// ErrNotFound before anything else is written
+func applyMutation(ctx context.Context, tx *sql.Tx, mutation *Mutation) error {
+  if mutation.Insert != nil { return insertApp(ctx, tx, mutation.Insert) }
+  id := mutation.AppRef.Hex()
+
+  // A sample already taken that day was written by an earlier attempt
+  sample := mutation.Sample
+  if sample != nil {
+    day := sampleDay(sample.Date)
+    var taken int
+    err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM daily_metrics WHERE app = ? AND date >= ? AND date < ?",
+      id, toUnix(day), toUnix(day.AddDate(0, 0, 1))).Scan(&taken)
+    if err != nil { return err }
+    if taken > 0 { sample = nil }
+  }
+
+  var sets []string
+  var args []interface{}
+  if sample != nil {
+    sets = append(sets, "last_metric_date = ?", "last_metric_count = ?")
+    args = append(args, toUnix(sample.Date), sample.PlayerCount)
+  }
+  if mutation.Tracked != nil {
+    sets = append(sets, "tracked = ?")
+    args = append(args, fromBool(*mutation.Tracked))
+  }
+  if mutation.Metadata != nil {
+    serial, err := json.Marshal(mutation.Metadata)
+    if err != nil { return err }
+    sets = append(sets, "metadata = ?", "metadata_updated_at = ?")
+    args = append(args, string(serial), toUnix(mutation.Metadata.UpdatedAt))
+  }
+
+  if len(sets) > 0 {
+    err := updateApp(ctx, tx, "UPDATE apps SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, id)...)
+    if err != nil { return err }
+  } else {
+    var exists int
+    err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM apps WHERE id = ?", id).Scan(&exists)
+    if err != nil { return err }
+    if exists == 0 { return ErrNotFound }
+  }
+
+  if sample != nil {
+    _, err := tx.ExecContext(ctx, "INSERT INTO daily_metrics (app, date, player_count) VALUES (?, ?, ?)",
+      id, toUnix(sample.Date), sample.PlayerCount)
+    if err != nil { return err }
+  }
+  if mutation.Metric != nil {
+    if err := appendMetric(ctx, tx, id, mutation.Metric); err != nil { return err }
+  }
+  if !mutation.PurgeBefore.IsZero() {
+    _, err := tx.ExecContext(ctx, "DELETE FROM daily_metrics WHERE app = ? AND date < ?", id, toUnix(mutation.PurgeBefore))
+    if err != nil { return &PurgeError{Err: err} }
+  }
+  return nil
+}
+
+func (s *SQLiteStore) SearchApps(ctx context.Context, text string, limit int) ([]*App, error) {
+  // LIKE ignores case for ASCII, escape its wildcards in the search text
+  pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text) + "%"
+  ids, err := s.selectIDs(ctx, `SELECT id FROM apps WHERE name LIKE ? ESCAPE '\' ORDER BY name LIMIT ?`, pattern, limit)
+  if err != nil { return nil, err }
+
+  apps := make([]*App, 0, len(ids))
+  for _, id := range ids {
+    app, err := s.loadApp(ctx, id)
+    if err != nil { return apps, err }
+    apps = append(apps, app)
+  }
+  return apps, nil
+}
+
+func (s *SQLiteStore) TopByPlayerCount(ctx context.Context, limit int) ([]RankedApp, error) {
+  return s.selectRanked(ctx, `SELECT id, domain, app_id, name, last_metric_count FROM apps
+    WHERE tracked = 1 ORDER BY last_metric_count DESC LIMIT ?`, limit)
+}
+
+func (s *SQLiteStore) TopByMonthlyAverage(ctx context.Context, month time.Time, limit int) ([]RankedApp, error) {
+  return s.selectRanked(ctx, `SELECT apps.id, apps.domain, apps.app_id, apps.name, metrics.avg_players
+    FROM metrics JOIN apps ON apps.id = metrics.app
+    WHERE metrics.date = ? ORDER BY metrics.avg_players DESC LIMIT ?`, toUnix(month), limit)
+}
+
+func (s *SQLiteStore) selectRanked(ctx context.Context, query string, args ...interface{}) ([]RankedApp, error) {
+  ranked := make([]RankedApp, 0)
+  rows, err := s.db.QueryContext(ctx, query, args...)
+  if err != nil { return ranked, err }
+  defer rows.Close()
+
+  for rows.Next() {
+    var hexID string
+    var result RankedApp
+    err = rows.Scan(&hexID, &result.StaticData.Domain, &result.StaticData.AppID, &result.StaticData.Name, &result.Value)
+    if err != nil { return ranked, err }
+    if result.ID, err = primitive.ObjectIDFromHex(hexID); err != nil { return ranked, err }
+    ranked = append(ranked, result)
+  }
+  return ranked, rows.Err()
+}
+
+const exceptionColumns = `id, app_ref, domain, app_id, name, job_type, error, attempts, parked,
+  created_at, updated_at, next_attempt`
+
+func scanException(scanner interface{ Scan(...interface{}) error }) (*Exception, error) {
+  var exception Exception
+  var id, appRef string
+  var parked int
+  var createdAt, updatedAt, nextAttempt int64
+
+  err := scanner.Scan(&id, &appRef, &exception.StaticData.Domain, &exception.StaticData.AppID,
+    &exception.StaticData.Name, &exception.JobType, &exception.Error, &exception.Attempts, &parked,
+    &createdAt, &updatedAt, &nextAttempt)
+  if err != nil { return nil, err }
+
+  if exception.ID, err = primitive.ObjectIDFromHex(id); err != nil { return nil, err }
+  if exception.AppRef, err = primitive.ObjectIDFromHex(appRef); err != nil { return nil, err }
+  exception.Parked = toBool(parked)
+  exception.CreatedAt = fromUnix(createdAt)
+  exception.UpdatedAt = fromUnix(updatedAt)
+  exception.NextAttempt = fromUnix(nextAttempt)
+  return &exception, nil
+}
+
+func (s *SQLiteStore) RecordException(ctx context.Context, app *App, jobType int, cause error) (*Exception, error) {
+  now := toUnix(time.Now().UTC())
+  var exception *Exception
+
+  err := s.withTx(ctx, func(tx *sql.Tx) error {
+    _, err := tx.ExecContext(ctx, `INSERT INTO exceptions (`+exceptionColumns+`)
+      VALUES (?, ?, ?, ?, ?, ?, ?, 1, 0, ?, ?, ?)
+      ON CONFLICT (app_ref, job_type) DO UPDATE SET attempts = attempts + 1, error = excluded.error,
+        updated_at = excluded.updated_at, domain = excluded.domain, app_id = excluded.app_id, name = excluded.name`,
+      primitive.NewObjectID().Hex(), app.ID.Hex(), app.StaticData.Domain, app.StaticData.AppID,
+      app.StaticData.Name, jobType, cause.Error(), now, now, now)
+    if err != nil { return err }
+
+    row := tx.QueryRowContext(ctx, "SELECT "+exceptionColumns+" FROM exceptions WHERE app_ref = ? AND job_type = ?",
+      app.ID.Hex(), jobType)
+    exception, err = scanException(row)
+    return err
+  })
+  return exception, err
+}
+
+func (s *SQLiteStore) ScheduleException(ctx context.Context, id primitive.ObjectID, next time.Time, parked bool) error {
+  _, err := s.db.ExecContext(ctx, "UPDATE exceptions SET next_attempt = ?, parked = ? WHERE id = ?",
+    toUnix(next), fromBool(parked), id.Hex())
+  return err
+}
+
+func (s *SQLiteStore) DeleteException(ctx context.Context, id primitive.ObjectID) error {
+  _, err := s.db.ExecContext(ctx, "DELETE FROM exceptions WHERE id = ?", id.Hex())
+  return err
+}
+
+func (s *SQLiteStore) GetDueExceptions(ctx context.Context, appRef primitive.ObjectID) ([]Exception, error) {
+  var exceptions []Exception
+
+  rows, err := s.db.QueryContext(ctx, "SELECT "+exceptionColumns+
+    " FROM exceptions WHERE app_ref = ? AND parked = 0 AND next_attempt <= ?",
+    appRef.Hex(), toUnix(time.Now().UTC()))
+  if err != nil { return exceptions, err }
+  defer rows.Close()
+
+  for rows.Next() {
+    exception, err := scanException(rows)
+    if err != nil { return exceptions, err }
+    exceptions = append(exceptions, *exception)
+  }
+  return exceptions, rows.Err()
+}
+
+func (s *SQLiteStore) GetSyncState(ctx context.Context, domain string) (*SyncState, error) {
+  state := SyncState{ID: syncStateID(domain), Domain: domain}
+  var ifModifiedSince, cycleStart, updatedAt int64
+
+  row := s.db.QueryRowContext(ctx, `SELECT if_modified_since, last_appid, cycle_start, updated_at
+    FROM sync_state WHERE id = ?`, state.ID)
+  err := row.Scan(&ifModifiedSince, &state.LastAppID, &cycleStart, &updatedAt)
+  if err == sql.ErrNoRows { return &state, nil }
+  if err != nil { return nil, err }
+
+  state.IfModifiedSince = fromUnix(ifModifiedSince)
+  state.CycleStart = fromUnix(cycleStart)
+  state.UpdatedAt = fromUnix(updatedAt)
+  return &state, nil
+}
+
+func (s *SQLiteStore) SaveSyncState(ctx context.Context, state *SyncState) error {
+  state.ID = syncStateID(state.Domain)
+  state.UpdatedAt = time.Now().UTC()
+
+  _, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO sync_state
+    (id, domain, if_modified_since, last_appid, cycle_start, updated_at) VALUES (?, ?, ?, ?, ?, ?)`,
+    state.ID, state.Domain, toUnix(state.IfModifiedSince), state.LastAppID, toUnix(state.CycleStart),
+    toUnix(state.UpdatedAt))
+  return err
+}
+
+func (s *SQLiteStore) GetCheckpoint(ctx context.Context, jobType int, shard Shard) (*Checkpoint, error) {
+  checkpoint := Checkpoint{ID: checkpointID(jobType, shard), JobType: jobType, Shard: shard}
+  var afterID, completed string
+  var startedAt, updatedAt int64
+
+  row := s.db.QueryRowContext(ctx, `SELECT run_id, after_id, completed, num_success, num_errors, started_at, updated_at
+    FROM checkpoints WHERE id = ?`, checkpoint.ID)
+  err := row.Scan(&checkpoint.RunID, &afterID, &completed, &checkpoint.NumSuccess, &checkpoint.NumErrors, &startedAt, &updatedAt)
+  if err == sql.ErrNoRows { return nil, ErrNotFound }
+  if err != nil { return nil, err }
+
+  if afterID != "" {
+    if checkpoint.AfterID, err = primitive.ObjectIDFromHex(afterID); err != nil { return nil, err }
+  }
+  // Completed ids are kept comma separated
+  if completed != "" {
+    for _, hex := range strings.Split(completed, ",") {
+      id, err := primitive.ObjectIDFromHex(hex)
+      if err != nil { return nil, err }
+      checkpoint.Completed = append(checkpoint.Completed, id)
+    }
+  }
+  checkpoint.StartedAt = fromUnix(startedAt)
+  checkpoint.UpdatedAt = fromUnix(updatedAt)
+  return &checkpoint, nil
+}
+
+func (s *SQLiteStore) SaveCheckpoint(ctx context.Context, checkpoint *Checkpoint) error {
+  checkpoint.ID = checkpointID(checkpoint.JobType, checkpoint.Shard)
+  checkpoint.UpdatedAt = time.Now().UTC()
+
+  var afterID string
+  if !checkpoint.AfterID.IsZero() { afterID = checkpoint.AfterID.Hex() }
+  completed := make([]string, len(checkpoint.Completed))
+  for i, id := range checkpoint.Completed { completed[i] = id.Hex() }
+  _, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO checkpoints
+    (id, job_type, run_id, after_id, completed, num_success, num_errors, started_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+    checkpoint.ID, checkpoint.JobType, checkpoint.RunID, afterID, strings.Join(completed, ","), checkpoint.NumSuccess, checkpoint.NumErrors,
+    toUnix(checkpoint.StartedAt), toUnix(checkpoint.UpdatedAt))
+  return err
+}
+
+func (s *SQLiteStore) DeleteCheckpoint(ctx context.Context, jobType int, shard Shard) error {
+  _, err := s.db.ExecContext(ctx, "DELETE FROM checkpoints WHERE id = ?", checkpointID(jobType, shard))
+  return err
+}
+
+func (s *SQLiteStore) AcquireLease(ctx context.Context, jobType int, shard Shard, owner string, ttl time.Duration) (*Lease, error) {
+  var lease *Lease
+  err := s.withTx(ctx, func(tx *sql.Tx) (err error) {
+    lease, err = takeLease(ctx, tx, jobType, shard, owner, ttl)
+    return err
+  })
+  if err != nil && err != ErrLeaseHeld { return nil, err }
+  return lease, err
+}
+
+func (s *SQLiteStore) JoinLease(ctx context.Context, jobType int, shard Shard, owner string, ttl time.Duration) (*Lease, error) {
+  var lease *Lease
+  err := s.withTx(ctx, func(tx *sql.Tx) (err error) {
+    if lease, err = takeLease(ctx, tx, jobType, Shard{}, owner, ttl); err != nil { return err }
+    for _, index := range lease.Holders {
+      if index == shard.Index { return nil }
+    }
+    lease.Holders = append(lease.Holders, shard.Index)
+    return saveHolders(ctx, tx, lease.ID, lease.Holders)
+  })
+  if err != nil && err != ErrLeaseHeld { return nil, err }
+  return lease, err
+}
+
+// takeLease upserts the lease unless another owner holds it, returning it
+// along with ErrLeaseHeld if one does. Taking it over drops the holders.
+func takeLease(ctx context.Context, tx *sql.Tx, jobType int, shard Shard, owner string, ttl time.Duration) (*Lease, error) {
+  lease := Lease{ID: leaseID(jobType, shard), JobType: jobType, Shard: shard}
+  now := time.Now().UTC()
+
+  // The SET expressions read the row as it was, so acquired_at is kept on renewal
+  res, err := tx.ExecContext(ctx, `INSERT INTO leases (id, job_type, owner, acquired_at, expires_at) VALUES (?, ?, ?, ?, ?)
+    ON CONFLICT (id) DO UPDATE SET
+      acquired_at = CASE WHEN owner = excluded.owner THEN acquired_at ELSE excluded.acquired_at END,
+      holders = CASE WHEN owner = excluded.owner THEN holders ELSE '[]' END,
+      owner = excluded.owner,
+      expires_at = excluded.expires_at
+    WHERE owner = excluded.owner OR expires_at <= ?`,
+    lease.ID, jobType, owner, toUnix(now), toUnix(now.Add(ttl)), toUnix(now))
+  if err != nil { return nil, err }
+  numAcquired, err := res.RowsAffected()
+  if err != nil { return nil, err }
+
+  var acquiredAt, expiresAt int64
+  var holders string
+  row := tx.QueryRowContext(ctx, "SELECT owner, acquired_at, expires_at, holders FROM leases WHERE id = ?", lease.ID)
+  if err = row.Scan(&lease.Owner, &acquiredAt, &expiresAt, &holders); err != nil { return nil, err }
+  if err = json.Unmarshal([]byte(holders), &lease.Holders); err != nil { return nil, err }
+  lease.AcquiredAt = fromUnix(acquiredAt)
+  lease.ExpiresAt = fromUnix(expiresAt)
+  if numAcquired == 0 { return &lease, ErrLeaseHeld }
+  return &lease, nil
+}
+
+func saveHolders(ctx context.Context, tx *sql.Tx, id string, holders []int) error {
+  encoded, err := json.Marshal(holders)
+  if err != nil { return err }
+  _, err = tx.ExecContext(ctx, "UPDATE leases SET holders = ? WHERE id = ?", string(encoded), id)
+  return err
+}
+
+func (s *SQLiteStore) ReleaseLease(ctx context.Context, jobType int, shard Shard, owner string) error {
+  _, err := s.db.ExecContext(ctx, "DELETE FROM leases WHERE id = ? AND owner = ?", leaseID(jobType, shard), owner)
+  return err
+}
+
+func (s *SQLiteStore) LeaveLease(ctx context.Context, jobType int, shard Shard, owner string) error {
+  id := leaseID(jobType, Shard{})
+  return s.withTx(ctx, func(tx *sql.Tx) error {
+    var encoded string
+    err := tx.QueryRowContext(ctx, "SELECT holders FROM leases WHERE id = ? AND owner = ?", id, owner).Scan(&encoded)
+    if err == sql.ErrNoRows { return nil }
+    if err != nil { return err }
+
+    var holders, kept []int
+    if err = json.Unmarshal([]byte(encoded), &holders); err != nil { return err }
+    for _, index := range holders {
+      if index != shard.Index { kept = append(kept, index) }
+    }
+    if len(kept) > 0 { return saveHolders(ctx, tx, id, kept) }
+    _, err = tx.ExecContext(ctx, "DELETE FROM leases WHERE id = ?", id)
+    return err
+  })
+}
+
+func (s *SQLiteStore) RecordJobRun(ctx context.Context, run *JobRun) error {
+  if run.ID.IsZero() { run.ID = primitive.NewObjectID() }
+
+  // The breakdowns are kept as JSON, they are only ever read back whole
+  domains, err := json.Marshal(run.Domains)
+  if err != nil { return err }
+  errorSamples, err := json.Marshal(run.ErrorSamples)
+  if err != nil { return err }
+  skipped, err := json.Marshal(run.Skipped)
+  if err != nil { return err }
+
+  _, err = s.db.ExecContext(ctx, `INSERT INTO job_runs (id, run_id, job_type, shard_index, shard_count, trigger,
+    started_at, ended_at, resumed, complete, num_success, num_errors, num_skipped, num_timed_out, num_archived,
+    num_purged, domains, error_samples, skipped) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+    run.ID.Hex(), run.RunID, run.JobType, run.Shard.Index, run.Shard.Count, run.Trigger,
+    toUnix(run.StartedAt), toUnix(run.EndedAt), fromBool(run.Resumed), fromBool(run.Complete),
+    run.NumSuccess, run.NumErrors, run.NumSkipped, run.NumTimedOut, run.NumArchived, run.NumPurged,
+    string(domains), string(errorSamples), string(skipped))
+  return err
+}
+
+const selectJobRuns = `SELECT id, run_id, job_type, shard_index, shard_count, trigger, started_at, ended_at,
+  resumed, complete, num_success, num_errors, num_skipped, num_timed_out, num_archived, num_purged, domains,
+  error_samples, skipped FROM job_runs`
+
+func (s *SQLiteStore) ListJobRuns(ctx context.Context, jobType int, limit int) ([]JobRun, error) {
+  query := selectJobRuns
+  var args []interface{}
+  if jobType != ANYJOB {
+    query += " WHERE job_type = ?"
+    args = append(args, jobType)
+  }
+  args = append(args, limit)
+  return s.selectJobRuns(ctx, query+" ORDER BY started_at DESC, id DESC LIMIT ?", args...)
+}
+
+func (s *SQLiteStore) GetJobRuns(ctx context.Context, runID string) ([]JobRun, error) {
+  return s.selectJobRuns(ctx, selectJobRuns+" WHERE run_id = ? ORDER BY started_at, id", runID)
+}
+
+func (s *SQLiteStore) selectJobRuns(ctx context.Context, query string, args ...interface{}) ([]JobRun, error) {
+  rows, err := s.db.QueryContext(ctx, query, args...)
+  if err != nil { return nil, err }
+  defer rows.Close()
+
+  runs := make([]JobRun, 0)
+  for rows.Next() {
+    var run JobRun
+    var id, domains, errorSamples, skipped string
+    var startedAt, endedAt int64
+    var resumed, complete int
+    err = rows.Scan(&id, &run.RunID, &run.JobType, &run.Shard.Index, &run.Shard.Count, &run.Trigger, &startedAt, &endedAt,
+      &resumed, &complete, &run.NumSuccess, &run.NumErrors, &run.NumSkipped, &run.NumTimedOut, &run.NumArchived, &run.NumPurged,
+      &domains, &errorSamples, &skipped)
+    if err != nil { return runs, err }
+
+    if run.ID, err = primitive.ObjectIDFromHex(id); err != nil { return runs, err }
+    run.StartedAt = fromUnix(startedAt)
+    run.EndedAt = fromUnix(endedAt)
+    run.Resumed = toBool(resumed)
+    run.Complete = toBool(complete)
+    if err = json.Unmarshal([]byte(domains), &run.Domains); err != nil { return runs, err }
+    if err = json.Unmarshal([]byte(errorSamples), &run.ErrorSamples); err != nil { return runs, err }
+    if err = json.Unmarshal([]byte(skipped), &run.Skipped); err != nil { return runs, err }
+    runs = append(runs, run)
+  }
+  return runs, rows.Err()
+}
+
+func (s *SQLiteStore) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+  return migrationStatus(ctx, s)
+}
+
+func (s *SQLiteStore) MigrateUp(ctx context.Context) ([]MigrationStatus, error) {
+  return migrateUp(ctx, s)
+}
+
+func (s *SQLiteStore) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+  rows, err := s.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+  if err != nil { return nil, err }
+  defer rows.Close()
+
+  applied := make(map[int]time.Time)
+  for rows.Next() {
+    var version int
+    var appliedAt int64
+    if err = rows.Scan(&version, &appliedAt); err != nil { return nil, err }
+    applied[version] = fromUnix(appliedAt)
+  }
+  return applied, rows.Err()
+}
+
+func (s *SQLiteStore) runMigration(ctx context.Context, m *migration) error {
+  if m.sqlite == nil { return nil }
+  return s.withTx(ctx, func(tx *sql.Tx) error { return m.sqlite(ctx, tx) })
+}
+
+func (s *SQLiteStore) recordMigration(ctx context.Context, m *migration, appliedAt time.Time) error {
+  _, err := s.db.ExecContext(ctx, `INSERT OR REPLACE INTO schema_migrations (version, description, applied_at)
+    VALUES (?, ?, ?)`, m.version, m.description, toUnix(appliedAt))
+  return err
+}
+
+func (s *SQLiteStore) Close(ctx context.Context) error {
+  return s.db.Close()
+}
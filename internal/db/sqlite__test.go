@@ -0,0 +1,339 @@
+package db
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+  "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func openTestStore(t *testing.T) (*SQLiteStore, func()) {
+  dir, err := ioutil.TempDir("", "tracula")
+  if err != nil { t.Fatal(err) }
+
+  store, err := OpenSQLite(filepath.Join(dir, "tracula.db"))
+  if err != nil {
+    os.RemoveAll(dir)
+    t.Fatal(err)
+  }
+  return store, func() {
+    store.Close(context.Background())
+    os.RemoveAll(dir)
+  }
+}
+
+func TestSQLiteApps(t *testing.T) {
+  store, cleanup := openTestStore(t)
+  defer cleanup()
+  ctx := context.Background()
+
+  inserted, updated, err := store.UpsertApps(ctx, []StaticAppData{
+    {Name: "Counter-Strike", AppID: 10, Domain: "steam"},
+    {Name: "Old School RuneScape", AppID: 10, Domain: "osrs"},
+  })
+  if err != nil || inserted != 2 || updated != 0 {
+    t.Fatalf("[FAIL] TestSQLiteApps: upsert %d %d %v\n", inserted, updated, err)
+  }
+  inserted, updated, err = store.UpsertApps(ctx, []StaticAppData{
+    {Name: "Counter-Strike 1.6", AppID: 10, Domain: "steam"},
+    {Name: "Old School RuneScape", AppID: 10, Domain: "osrs"},
+  })
+  if err != nil || inserted != 0 || updated != 1 {
+    t.Fatalf("[FAIL] TestSQLiteApps: second upsert %d %d %v\n", inserted, updated, err)
+  }
+
+  var names []string
+  err = store.IterateStaticData(ctx, func(staticData *StaticAppData) error {
+    names = append(names, staticData.Name)
+    return nil
+  }, "osrs")
+  if err != nil || len(names) != 1 || names[0] != "Old School RuneScape" {
+    t.Errorf("[FAIL] TestSQLiteApps: unexpected static data %v %v\n", names, err)
+  }
+
+  app, err := store.FindApp(ctx, "steam", 10)
+  if err != nil || app.StaticData.Name != "Counter-Strike 1.6" || !app.LastMetric.Date.IsZero() {
+    t.Fatalf("[FAIL] TestSQLiteApps: find %+v %v\n", app, err)
+  }
+  if _, err = store.FindApp(ctx, "steam", 20); !errors.Is(err, ErrNotFound) {
+    t.Errorf("[FAIL] TestSQLiteApps: expected ErrNotFound, got %v\n", err)
+  }
+
+  if err = store.SetTrackFlag(ctx, app.ID, true); err != nil { t.Fatal(err) }
+  now := time.Now().UTC().Truncate(time.Second)
+  old := DailyMetric{Date: now.AddDate(0, 0, -100), PlayerCount: 5}
+  recent := DailyMetric{Date: now, PlayerCount: 7}
+  for _, sample := range []DailyMetric{old, recent} {
+    if err = store.AppendDailyMetric(ctx, app.ID, sample); err != nil { t.Fatal(err) }
+  }
+
+  count, it, err := store.IterateApps(ctx, AppFilter{TrackedOnly: true})
+  if err != nil || count != 1 {
+    t.Fatalf("[FAIL] TestSQLiteApps: iterate %d %v\n", count, err)
+  }
+  var found []*App
+  for it.Next(ctx) {
+    tracked, _ := it.App()
+    found = append(found, tracked)
+  }
+  if it.Err() != nil || len(found) != 1 || found[0].LastMetric.PlayerCount != 7 {
+    t.Fatalf("[FAIL] TestSQLiteApps: unexpected iteration %+v %v\n", found, it.Err())
+  }
+
+  samples, err := store.GetDailyMetrics(ctx, app.ID, now.AddDate(0, 0, -1), time.Time{})
+  if err != nil || len(samples) != 1 || samples[0].PlayerCount != 7 {
+    t.Errorf("[FAIL] TestSQLiteApps: unexpected samples %+v %v\n", samples, err)
+  }
+
+  metric := Metric{Date: now, AvgPlayers: 6, NoPrevious: true, Peak: 7}
+  if err = store.AppendMetric(ctx, app.ID, metric, now.AddDate(0, 0, -90)); err != nil { t.Fatal(err) }
+  app, _ = store.FindApp(ctx, "steam", 10)
+  samples, _ = store.GetDailyMetrics(ctx, app.ID, time.Time{}, time.Time{})
+  if len(app.Metrics) != 1 || len(samples) != 1 || !samples[0].Date.Equal(now) {
+    t.Errorf("[FAIL] TestSQLiteApps: unexpected metrics after append %+v %+v\n", app, samples)
+  }
+
+  // Appending the month again, as a retried write does, keeps a single metric
+  if err = store.AppendMetric(ctx, app.ID, metric, now.AddDate(0, 0, -90)); err != nil { t.Fatal(err) }
+  if app, _ = store.FindApp(ctx, "steam", 10); len(app.Metrics) != 1 {
+    t.Errorf("[FAIL] TestSQLiteApps: duplicated metric on retry %+v\n", app.Metrics)
+  }
+
+  // Setting the month replaces its metric in place
+  metric.Peak = 9
+  if err = store.SetMetric(ctx, app.ID, metric); err != nil { t.Fatal(err) }
+  if app, _ = store.FindApp(ctx, "steam", 10); len(app.Metrics) != 1 || app.Metrics[0].Peak != 9 {
+    t.Errorf("[FAIL] TestSQLiteApps: unexpected metrics after set %+v\n", app.Metrics)
+  }
+}
+
+func TestSQLiteExceptions(t *testing.T) {
+  store, cleanup := openTestStore(t)
+  defer cleanup()
+  ctx := context.Background()
+
+  app := App{StaticData: StaticAppData{Name: "Counter-Strike", AppID: 10, Domain: "steam"}}
+  if err := store.InsertApp(ctx, &app); err != nil { t.Fatal(err) }
+
+  exception, err := store.RecordException(ctx, &app, DAILY, errors.New("timeout"))
+  if err != nil || exception.Attempts != 1 {
+    t.Fatalf("[FAIL] TestSQLiteExceptions: record %+v %v\n", exception, err)
+  }
+  exception, err = store.RecordException(ctx, &app, DAILY, errors.New("timeout again"))
+  if err != nil || exception.Attempts != 2 || exception.Error != "timeout again" {
+    t.Fatalf("[FAIL] TestSQLiteExceptions: second record %+v %v\n", exception, err)
+  }
+
+  count, _, err := store.IterateApps(ctx, AppFilter{DueExceptions: true})
+  if err != nil || count != 1 {
+    t.Errorf("[FAIL] TestSQLiteExceptions: expected a due app, got %d %v\n", count, err)
+  }
+
+  if err = store.ScheduleException(ctx, exception.ID, time.Now().Add(time.Hour), false); err != nil { t.Fatal(err) }
+  due, err := store.GetDueExceptions(ctx, app.ID)
+  if err != nil || len(due) != 0 {
+    t.Errorf("[FAIL] TestSQLiteExceptions: expected no due exceptions, got %+v %v\n", due, err)
+  }
+
+  if err = store.DeleteException(ctx, exception.ID); err != nil { t.Fatal(err) }
+}
+
+func TestSQLiteSyncState(t *testing.T) {
+  store, cleanup := openTestStore(t)
+  defer cleanup()
+  ctx := context.Background()
+
+  state, err := store.GetSyncState(ctx, "steam")
+  if err != nil || state.LastAppID != 0 || !state.IfModifiedSince.IsZero() {
+    t.Fatalf("[FAIL] TestSQLiteSyncState: unexpected initial state %+v %v\n", state, err)
+  }
+
+  state.LastAppID = 42
+  state.CycleStart = time.Now().UTC().Truncate(time.Second)
+  if err = store.SaveSyncState(ctx, state); err != nil { t.Fatal(err) }
+
+  saved, err := store.GetSyncState(ctx, "steam")
+  if err != nil || saved.LastAppID != 42 || !saved.CycleStart.Equal(state.CycleStart) {
+    t.Errorf("[FAIL] TestSQLiteSyncState: unexpected saved state %+v %v\n", saved, err)
+  }
+}
+
+func TestSQLiteApplyMutations(t *testing.T) {
+  store, cleanup := openTestStore(t)
+  defer cleanup()
+  ctx := context.Background()
+
+  app := App{StaticData: StaticAppData{Name: "Counter-Strike", AppID: 10, Domain: "steam"}}
+  tracked := true
+  sample := DailyMetric{Date: time.Now().UTC().Truncate(time.Second), PlayerCount: 12}
+  mutations := []Mutation{
+    {Insert: &app},
+    {AppRef: primitive.NewObjectID(), Tracked: &tracked},
+  }
+  errs := store.ApplyMutations(ctx, mutations)
+  if errs[0] != nil || !errors.Is(errs[1], ErrNotFound) {
+    t.Fatalf("[FAIL] TestSQLiteApplyMutations: unexpected errors %v\n", errs)
+  }
+
+  errs = store.ApplyMutations(ctx, []Mutation{{AppRef: app.ID, Sample: &sample, Tracked: &tracked}})
+  if errs[0] != nil { t.Fatal(errs[0]) }
+
+  found, err := store.FindApp(ctx, "steam", 10)
+  if err != nil || !found.Tracked || found.LastMetric.PlayerCount != 12 {
+    t.Errorf("[FAIL] TestSQLiteApplyMutations: mutation not applied %+v %v\n", found, err)
+  }
+
+  // Retrying the write, as recovery does after an ambiguous failure, adds nothing
+  retry := DailyMetric{Date: sample.Date, PlayerCount: 13}
+  metric := Metric{Date: sample.Date, AvgPlayers: 12, NoPrevious: true}
+  for i := 0; i < 2; i++ {
+    errs = store.ApplyMutations(ctx, []Mutation{{AppRef: app.ID, Sample: &retry, Metric: &metric}})
+    if errs[0] != nil { t.Fatal(errs[0]) }
+  }
+  samples, _ := store.GetDailyMetrics(ctx, app.ID, time.Time{}, time.Time{})
+  found, _ = store.FindApp(ctx, "steam", 10)
+  if len(samples) != 1 || len(found.Metrics) != 1 || found.LastMetric.PlayerCount != 12 {
+    t.Errorf("[FAIL] TestSQLiteApplyMutations: retried write duplicated %+v %+v\n", samples, found)
+  }
+
+  // Inserting an app the library already has is a no-op
+  duplicate := App{StaticData: StaticAppData{Name: "Counter-Strike", AppID: 10, Domain: "steam"}}
+  if errs = store.ApplyMutations(ctx, []Mutation{{Insert: &duplicate}}); errs[0] != nil { t.Fatal(errs[0]) }
+  count, _, err := store.IterateApps(ctx, AppFilter{})
+  if err != nil || count != 1 {
+    t.Errorf("[FAIL] TestSQLiteApplyMutations: expected a single app, got %d %v\n", count, err)
+  }
+}
+
+func TestSQLiteMigrateUp(t *testing.T) {
+  store, cleanup := openTestStore(t)
+  defer cleanup()
+  ctx := context.Background()
+
+  applied, err := store.MigrateUp(ctx)
+  if err != nil || len(applied) != len(migrations) {
+    t.Fatalf("[FAIL] TestSQLiteMigrateUp: unexpected first run %+v %v\n", applied, err)
+  }
+  applied, err = store.MigrateUp(ctx)
+  if err != nil || len(applied) != 0 {
+    t.Errorf("[FAIL] TestSQLiteMigrateUp: expected nothing left to apply, got %+v %v\n", applied, err)
+  }
+
+  statusList, err := store.MigrationStatus(ctx)
+  if err != nil { t.Fatal(err) }
+  for _, status := range statusList {
+    if !status.Applied || status.AppliedAt.IsZero() {
+      t.Errorf("[FAIL] TestSQLiteMigrateUp: migration not recorded %+v\n", status)
+    }
+  }
+}
+
+func TestSQLiteNumericGains(t *testing.T) {
+  store, cleanup := openTestStore(t)
+  defer cleanup()
+  ctx := context.Background()
+
+  app := App{StaticData: StaticAppData{Name: "Counter-Strike", AppID: 10, Domain: "steam"}}
+  if err := store.InsertApp(ctx, &app); err != nil { t.Fatal(err) }
+
+  // Recreate the text gains of databases written before migration 4
+  legacy := []string{
+    `DROP TABLE metrics`,
+    `CREATE TABLE metrics (app TEXT NOT NULL, date INTEGER NOT NULL, avg_players INTEGER NOT NULL,
+      gain TEXT NOT NULL, gain_percent TEXT NOT NULL, peak INTEGER NOT NULL)`,
+    `INSERT INTO metrics VALUES ('` + app.ID.Hex() + `', 1, 100, '-', '-', 120)`,
+    `INSERT INTO metrics VALUES ('` + app.ID.Hex() + `', 2, 150, '50', '0.00%', 160)`,
+  }
+  for _, statement := range legacy {
+    if _, err := store.db.Exec(statement); err != nil { t.Fatal(err) }
+  }
+
+  if _, err := store.MigrateUp(ctx); err != nil { t.Fatal(err) }
+
+  found, err := store.FindApp(ctx, "steam", 10)
+  if err != nil || len(found.Metrics) != 2 { t.Fatalf("[FAIL] TestSQLiteNumericGains: %+v %v\n", found, err) }
+  first, second := found.Metrics[0], found.Metrics[1]
+  if !first.NoPrevious || first.Gain != 0 {
+    t.Errorf("[FAIL] TestSQLiteNumericGains: unexpected first month %+v\n", first)
+  }
+  if second.NoPrevious || second.Gain != 50 || second.GainRatio != 0.5 {
+    t.Errorf("[FAIL] TestSQLiteNumericGains: unexpected second month %+v\n", second)
+  }
+}
+
+func TestSQLiteLeases(t *testing.T) {
+  store, cleanup := openTestStore(t)
+  defer cleanup()
+  ctx := context.Background()
+
+  lease, err := store.AcquireLease(ctx, DAILY, Shard{}, "a", time.Minute)
+  if err != nil || lease.Owner != "a" { t.Fatalf("[FAIL] TestSQLiteLeases: unexpected lease %+v %v\n", lease, err) }
+
+  held, err := store.AcquireLease(ctx, DAILY, Shard{}, "b", time.Minute)
+  if err != ErrLeaseHeld || held.Owner != "a" {
+    t.Errorf("[FAIL] TestSQLiteLeases: expected the lease held by a, got %+v %v\n", held, err)
+  }
+  if _, err = store.AcquireLease(ctx, MONTHLY, Shard{}, "b", time.Minute); err != nil {
+    t.Errorf("[FAIL] TestSQLiteLeases: expected leases per job type, got %v\n", err)
+  }
+  if _, err = store.AcquireLease(ctx, DAILY, Shard{Index: 1, Count: 2}, "b", time.Minute); err != nil {
+    t.Errorf("[FAIL] TestSQLiteLeases: expected leases per shard, got %v\n", err)
+  }
+
+  // Renewing keeps the acquisition time, an expired lease can be taken over
+  renewed, err := store.AcquireLease(ctx, DAILY, Shard{}, "a", -time.Minute)
+  if err != nil || !renewed.AcquiredAt.Equal(lease.AcquiredAt) {
+    t.Errorf("[FAIL] TestSQLiteLeases: unexpected renewed lease %+v %v\n", renewed, err)
+  }
+  if lease, err = store.AcquireLease(ctx, DAILY, Shard{}, "b", time.Minute); err != nil || lease.Owner != "b" {
+    t.Errorf("[FAIL] TestSQLiteLeases: expected b to take over the expired lease, got %+v %v\n", lease, err)
+  }
+
+  // Only the owner releases the lease
+  if err = store.ReleaseLease(ctx, DAILY, Shard{}, "a"); err != nil { t.Fatal(err) }
+  if _, err = store.AcquireLease(ctx, DAILY, Shard{}, "a", time.Minute); err != ErrLeaseHeld {
+    t.Errorf("[FAIL] TestSQLiteLeases: expected the lease still held by b, got %v\n", err)
+  }
+  if err = store.ReleaseLease(ctx, DAILY, Shard{}, "b"); err != nil { t.Fatal(err) }
+  if _, err = store.AcquireLease(ctx, DAILY, Shard{}, "a", time.Minute); err != nil {
+    t.Errorf("[FAIL] TestSQLiteLeases: expected the released lease to be free, got %v\n", err)
+  }
+
+  // The shards joining a lease share it until the last one leaves
+  for _, index := range []int{0, 1, 1} {
+    if lease, err = store.JoinLease(ctx, REFRESH, Shard{Index: index, Count: 2}, "shards", time.Minute); err != nil { t.Fatal(err) }
+  }
+  if len(lease.Holders) != 2 { t.Errorf("[FAIL] TestSQLiteLeases: expected 2 holders, got %+v\n", lease) }
+  if _, err = store.JoinLease(ctx, REFRESH, Shard{Index: 0, Count: 3}, "other", time.Minute); err != ErrLeaseHeld {
+    t.Errorf("[FAIL] TestSQLiteLeases: expected the joined lease held, got %v\n", err)
+  }
+  if err = store.LeaveLease(ctx, REFRESH, Shard{Index: 0, Count: 2}, "shards"); err != nil { t.Fatal(err) }
+  if _, err = store.AcquireLease(ctx, REFRESH, Shard{}, "other", time.Minute); err != ErrLeaseHeld {
+    t.Errorf("[FAIL] TestSQLiteLeases: expected the lease kept for the remaining holder, got %v\n", err)
+  }
+  if err = store.LeaveLease(ctx, REFRESH, Shard{Index: 1, Count: 2}, "shards"); err != nil { t.Fatal(err) }
+  if _, err = store.AcquireLease(ctx, REFRESH, Shard{}, "other", time.Minute); err != nil {
+    t.Errorf("[FAIL] TestSQLiteLeases: expected the lease dropped with its last holder, got %v\n", err)
+  }
+}
+
+func TestShardContains(t *testing.T) {
+  shards := []Shard{{Index: 0, Count: 3}, {Index: 1, Count: 3}, {Index: 2, Count: 3}}
+  for appID := 0; appID < 100; appID++ {
+    key := AppKey{Domain: "steam", AppID: appID}
+    numShards := 0
+    for _, shard := range shards {
+      if shard.Contains(key) { numShards++ }
+    }
+    if numShards != 1 || !(Shard{}).Contains(key) {
+      t.Errorf("[FAIL] TestShardContains: app %d in %d shards\n", appID, numShards)
+    }
+  }
+  if (Shard{Index: 3, Count: 3}).Validate() == nil || (Shard{Index: 1}).Validate() == nil {
+    t.Errorf("[FAIL] TestShardContains: expected out of range shards to be invalid\n")
+  }
+}
@@ -0,0 +1,8 @@
+//go:build cgo && !nosqlite
+// +build cgo,!nosqlite
+
+package db
+
+// The driver links SQLite through cgo, builds that only use MongoDB can leave
+// it out with the nosqlite tag
+import _ "github.com/mattn/go-sqlite3" // Registers the sqlite3 driver
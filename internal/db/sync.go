@@ -0,0 +1,21 @@
+package db
+
+import (
+  "time"
+)
+
+// SyncState is the watermark of a domain's incremental app sync.
+// A cycle lists every app modified since IfModifiedSince, page by page from
+// LastAppID; once complete the next cycle starts from CycleStart.
+type SyncState struct {
+  ID              string    `bson:"_id"`
+  Domain          string    `bson:"domain"`
+  IfModifiedSince time.Time `bson:"if_modified_since"`
+  LastAppID       int       `bson:"last_appid"`
+  CycleStart      time.Time `bson:"cycle_start"`
+  UpdatedAt       time.Time `bson:"updated_at"`
+}
+
+func syncStateID(domain string) string {
+  return "sync:" + domain
+}
@@ -0,0 +1,64 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// AppEntry is an app returned by an incremental listing
+type AppEntry struct {
+	ID           int
+	Name         string
+	LastModified time.Time
+}
+
+// AppPage is one page of an incremental app listing
+type AppPage struct {
+	Apps      []AppEntry
+	LastAppID int  // Continuation point for the next page
+	HaveMore  bool // False once the listing is exhausted
+}
+
+// IncrementalProvider is implemented by providers that can list only the
+// apps modified since a point in time, one page at a time
+type IncrementalProvider interface {
+	Provider
+	// FetchAppPage returns the page after lastAppID of apps modified since the
+	// given time, a zero time lists everything. ErrNotSupported is returned
+	// when the provider cannot list incrementally with the given options.
+	FetchAppPage(ctx context.Context, opts *Options, since time.Time, lastAppID int) (*AppPage, error)
+	// Incremental reports whether FetchAppPage can list with the given
+	// options, without making a request
+	Incremental(opts *Options) bool
+}
+
+// Incremental reports whether the provider registered for the domain can
+// list its apps incrementally with the given options
+func Incremental(opts *Options, domain string) bool {
+	provider, err := Lookup(domain)
+	if err != nil {
+		return false
+	}
+	incrementalProvider, ok := provider.(IncrementalProvider)
+	return ok && incrementalProvider.Incremental(resolveOptions(opts))
+}
+
+// FetchAppPage returns a page of modified apps using the provider
+// registered for the domain
+func FetchAppPage(ctx context.Context, opts *Options, domain string, since time.Time, lastAppID int) (*AppPage, error) {
+	provider, err := Lookup(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	incrementalProvider, ok := provider.(IncrementalProvider)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", domain, ErrNotSupported)
+	}
+
+	if err = wait(ctx, provider); err != nil {
+		return nil, err
+	}
+	return incrementalProvider.FetchAppPage(ctx, resolveOptions(opts), since, lastAppID)
+}
@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Classes of fetch errors, check for them with errors.Is
+var (
+	ErrTransient   = errors.New("transient failure")   // Network failures, timeouts and server errors
+	ErrRateLimited = errors.New("rate limited")        // The domain asked for fewer requests
+	ErrAppNotFound = errors.New("app not found")       // The domain does not know the app, or removed it
+	ErrParse       = errors.New("unexpected response") // The response did not have the expected shape
+	ErrNoStats     = errors.New("app has no stats")    // The app exists but the domain keeps no player count for it
+)
+
+// FetchError is a fetch failure of a known class. It unwraps to the
+// underlying error, such as a StatusError.
+type FetchError struct {
+	Domain string
+	Class  error // One of ErrTransient, ErrRateLimited, ErrAppNotFound, ErrParse or ErrNoStats
+	Err    error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Domain, e.Class, e.Err)
+}
+
+func (e *FetchError) Unwrap() error { return e.Err }
+
+func (e *FetchError) Is(target error) bool { return target == e.Class }
+
+// Retryable reports whether the fetch may succeed if tried again shortly
+func Retryable(err error) bool {
+	return errors.Is(err, ErrTransient) || errors.Is(err, ErrRateLimited)
+}
+
+// Permanent reports whether the fetch fails for good, the app is gone or the
+// domain keeps no stats for it, so trying it again later is pointless
+func Permanent(err error) bool {
+	return errors.Is(err, ErrAppNotFound) || errors.Is(err, ErrNoStats)
+}
+
+// classify wraps a provider error in a FetchError of its class. Errors of no
+// known class, and failures of the caller's context, are returned as is.
+func classify(ctx context.Context, domain string, err error) error {
+	var fetchErr *FetchError
+	if err == nil || ctx.Err() != nil || errors.As(err, &fetchErr) {
+		return err
+	}
+
+	class := errorClass(err)
+	if class == nil {
+		return err
+	}
+	return &FetchError{Domain: domain, Class: class, Err: err}
+}
+
+func errorClass(err error) error {
+	for _, class := range []error{ErrTransient, ErrRateLimited, ErrAppNotFound, ErrParse, ErrNoStats} {
+		if errors.Is(err, class) {
+			return class
+		}
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests:
+			return ErrRateLimited
+		case statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone:
+			return ErrAppNotFound
+		case statusErr.StatusCode >= 500:
+			return ErrTransient
+		}
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var numErr *strconv.NumError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.As(err, &numErr) {
+		return ErrParse
+	}
+
+	// The request timed out or the connection failed, including mid body
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrTransient
+	}
+	return nil
+}
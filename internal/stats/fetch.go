@@ -1,43 +1,82 @@
 package stats
 
 import (
+  "context"
+  "errors"
   "fmt"
+  "net"
+  "net/http"
   "strings"
-  "errors"
 )
 
-// Fetch returns a pointer to a DailyMetric struct if retrieval process succeeded,
-// otherwise an error is returned
-func Fetch(domain string, id int) (int, error) {
-  var err error
-  var res int
-
-  switch domain {
-    case "steam":
-      res, err = fetchSteam(id)
-    case "osrs":
-      res, err = fetchOsrs()
-    default:
-      err = errors.New(fmt.Sprintf("Unknown domain: %s", domain))
+// StatusError is returned when a domain responds with an unexpected status
+type StatusError struct {
+  Domain     string
+  StatusCode int
+}
+
+func (e *StatusError) Error() string {
+  return fmt.Sprintf("%s responded with status %d", e.Domain, e.StatusCode)
+}
+
+// IsThrottled reports whether an error indicates the domain is shedding load:
+// rate limited, failing server side or timing out
+func IsThrottled(err error) bool {
+  var statusErr *StatusError
+  if errors.As(err, &statusErr) {
+    return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
   }
+  var netErr net.Error
+  return errors.As(err, &netErr) && netErr.Timeout()
+}
 
+// Fetch returns the current player count for an app using the provider
+// registered for its domain, otherwise an error is returned. Failures of a
+// known class are returned as a FetchError.
+func Fetch(ctx context.Context, opts *Options, domain string, id int) (int, error) {
+  provider, err := Lookup(domain)
   if err != nil { return -1, err }
+
+  if !provider.Capabilities().PlayerCount {
+    return -1, fmt.Errorf("%s: %w", domain, ErrNotSupported)
+  }
+
+  if err = wait(ctx, provider); err != nil { return -1, err }
+
+  res, err := provider.FetchCount(ctx, resolveOptions(opts), id)
+  if err != nil { return -1, classify(ctx, domain, err) }
   return res, nil
 }
 
-// FetchApps returns a set of appIds
-func FetchApps() (map[string]map[int]string, error) {
+// FetchApps returns a set of appIds for every registered domain that
+// supports app listing, or only the given domains if any are passed
+func FetchApps(ctx context.Context, opts *Options, domains ...string) (map[string]map[int]string, error) {
 	var domainAppMap map[string]map[int]string = make(map[string]map[int]string)
 
-	var err error
 	var errorStrings []string
+	var selected map[string]bool
+	if len(domains) > 0 {
+		selected = make(map[string]bool)
+		for _, domain := range domains { selected[domain] = true }
+	}
 
 	// Add to the map for each domain
-	res, err := fetchSteamApps()
-	if err != nil {
-		errorStrings = append(errorStrings, "Steam: "+err.Error())
-	} else {
-		domainAppMap["steam"] = res
+	for _, provider := range Providers() {
+		if !provider.Capabilities().AppList { continue }
+		if selected != nil && !selected[provider.Domain()] { continue }
+
+		err := wait(ctx, provider)
+		if err != nil {
+			errorStrings = append(errorStrings, provider.Domain()+": "+err.Error())
+			continue
+		}
+
+		res, err := provider.FetchApps(ctx, resolveOptions(opts))
+		if err != nil {
+			errorStrings = append(errorStrings, provider.Domain()+": "+err.Error())
+			continue
+		}
+		domainAppMap[provider.Domain()] = res
 	}
 
 	if len(errorStrings) == 0 {
@@ -1,20 +1,195 @@
 package stats
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 )
 
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body><p class="player-count">There are currently 123,456 people playing!</p></body></html>`)
+	})
+	mux.HandleFunc(POPULATIONPATH, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get(IDENTIFIER) {
+		case "429", "500", "404":
+			code, _ := strconv.Atoi(r.URL.Query().Get(IDENTIFIER))
+			w.WriteHeader(code)
+			return
+		case "42":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"response":{"result":42}}`)
+			return
+		case "999":
+			fmt.Fprint(w, `{"response":`)
+			return
+		}
+		fmt.Fprintf(w, `{"response":{"player_count":%s,"result":1}}`, r.URL.Query().Get(IDENTIFIER))
+	})
+	mux.HandleFunc(APPPATH, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"applist":{"count":2,"apps":[{"appid":10,"name":"Counter-Strike"},{"appid":20,"name":"Team Fortress Classic"}]}}`)
+	})
+	mux.HandleFunc(STOREAPPPATH, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Query().Get("last_appid") == "0" {
+			fmt.Fprint(w, `{"response":{"apps":[{"appid":10,"name":"Counter-Strike","last_modified":1666823513}],"have_more_results":true,"last_appid":10}}`)
+			return
+		}
+		fmt.Fprint(w, `{"response":{"apps":[{"appid":20,"name":"Team Fortress Classic","last_modified":1579634708}]}}`)
+	})
+	mux.HandleFunc(APPDETAILSPATH, func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("appids")
+		if id != "730" {
+			fmt.Fprintf(w, `{"%s":{"success":false}}`, id)
+			return
+		}
+		fmt.Fprint(w, `{"730":{"success":true,"data":{"type":"game","is_free":false,
+			"developers":["Valve"],"publishers":["Valve"],
+			"genres":[{"id":"1","description":"Action"},{"id":"37","description":"Free to Play"}],
+			"release_date":{"coming_soon":false,"date":"21 Aug, 2012"},
+			"price_overview":{"currency":"USD","initial":1499,"final":999,"discount_percent":33}}}}`)
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTestOptions(server *httptest.Server) *Options {
+	opts := DefaultOptions()
+	opts.Client = server.Client()
+	opts.BaseURLs["steam"] = server.URL
+	opts.BaseURLs["osrs"] = server.URL + "/"
+	opts.BaseURLs["steam_store"] = server.URL
+	return opts
+}
+
 func TestFetch(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	opts := newTestOptions(server)
 
 	id := 939
 	domain := "osrs"
 
-	res, err := Fetch(time.Now(), domain, id)
-	if err != nil || res == nil {
-		t.Errorf("[FAIL] TestFetch: %s\n", err)
+	res, err := Fetch(context.Background(), opts, domain, id)
+	if err != nil || res != 123456 {
+		t.Errorf("[FAIL] TestFetch: %d, %s\n", res, err)
+	}
+
+	res, err = Fetch(context.Background(), opts, "steam", 730)
+	if err != nil || res != 730 {
+		t.Errorf("[FAIL] TestFetch: %d, %s\n", res, err)
+	}
+
+	_, err = Fetch(context.Background(), opts, "steam", 429)
+	if !IsThrottled(err) {
+		t.Errorf("[FAIL] TestFetch: expected throttled error, got %v\n", err)
+	}
+}
+
+func TestFetchErrorClasses(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	opts := newTestOptions(server)
+
+	cases := []struct {
+		id        int
+		class     error
+		retryable bool
+		permanent bool
+	}{
+		{429, ErrRateLimited, true, false},
+		{500, ErrTransient, true, false},
+		{404, ErrAppNotFound, false, true},
+		{42, ErrNoStats, false, true},
+		{999, ErrParse, false, false},
+	}
+	for _, c := range cases {
+		_, err := Fetch(context.Background(), opts, "steam", c.id)
+		var fetchErr *FetchError
+		if !errors.Is(err, c.class) || !errors.As(err, &fetchErr) || Retryable(err) != c.retryable || Permanent(err) != c.permanent {
+			t.Errorf("[FAIL] TestFetchErrorClasses: app %d expected %v, got %v\n", c.id, c.class, err)
+		}
+	}
+
+	// A domain that cannot be reached is transient
+	opts.BaseURLs["steam"] = "http://127.0.0.1:1"
+	if _, err := Fetch(context.Background(), opts, "steam", 730); !errors.Is(err, ErrTransient) {
+		t.Errorf("[FAIL] TestFetchErrorClasses: expected a transient error, got %v\n", err)
 	}
+}
+
+func TestFetchApps(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
 
-	fmt.Printf("result: %v+\n", res)
+	res, err := FetchApps(context.Background(), newTestOptions(server))
+	if err != nil {
+		t.Fatalf("[FAIL] TestFetchApps: %s\n", err)
+	}
+	if len(res["steam"]) != 2 || res["steam"][10] != "Counter-Strike" {
+		t.Errorf("[FAIL] TestFetchApps: unexpected steam apps %v\n", res["steam"])
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	opts := newTestOptions(server)
+
+	res, err := FetchMetadata(context.Background(), opts, "steam", 730)
+	if err != nil {
+		t.Fatalf("[FAIL] TestFetchMetadata: %s\n", err)
+	}
+	if res.Type != "game" || len(res.Genres) != 2 || res.Price == nil || res.Price.Final != 999 {
+		t.Errorf("[FAIL] TestFetchMetadata: unexpected metadata %+v\n", res)
+	}
+	if res.ReleaseDate.Year() != 2012 || res.ReleaseDate.Month() != time.August {
+		t.Errorf("[FAIL] TestFetchMetadata: unexpected release date %s\n", res.ReleaseDate)
+	}
+
+	_, err = FetchMetadata(context.Background(), opts, "steam", 1)
+	if !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("[FAIL] TestFetchMetadata: expected ErrNoMetadata, got %v\n", err)
+	}
+
+	_, err = FetchMetadata(context.Background(), opts, "osrs", 1)
+	if !errors.Is(err, ErrNotSupported) {
+		t.Errorf("[FAIL] TestFetchMetadata: expected ErrNotSupported, got %v\n", err)
+	}
+}
+
+func TestFetchAppPage(t *testing.T) {
+	server := newTestServer()
+	defer server.Close()
+	opts := newTestOptions(server)
+
+	_, err := FetchAppPage(context.Background(), opts, "steam", time.Time{}, 0)
+	if !errors.Is(err, ErrNotSupported) {
+		t.Errorf("[FAIL] TestFetchAppPage: expected ErrNotSupported without a key, got %v\n", err)
+	}
+
+	if Incremental(opts, "steam") {
+		t.Errorf("[FAIL] TestFetchAppPage: expected no incremental listing without a key\n")
+	}
+	opts.SteamAPIKey = "key"
+	if !Incremental(opts, "steam") || Incremental(opts, "osrs") {
+		t.Errorf("[FAIL] TestFetchAppPage: expected only steam to list incrementally with a key\n")
+	}
+	page, err := FetchAppPage(context.Background(), opts, "steam", time.Time{}, 0)
+	if err != nil || !page.HaveMore || page.LastAppID != 10 || len(page.Apps) != 1 {
+		t.Fatalf("[FAIL] TestFetchAppPage: unexpected first page %+v, %v\n", page, err)
+	}
+
+	page, err = FetchAppPage(context.Background(), opts, "steam", time.Now(), page.LastAppID)
+	if err != nil || page.HaveMore || page.Apps[0].ID != 20 {
+		t.Errorf("[FAIL] TestFetchAppPage: unexpected last page %+v, %v\n", page, err)
+	}
 }
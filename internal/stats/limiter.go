@@ -0,0 +1,86 @@
+package stats
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket budget for outbound requests to a domain.
+// A zero PerSecond leaves the domain unlimited.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+type limiterSet struct {
+	mu        sync.Mutex
+	overrides map[string]RateLimit
+	limiters  map[string]*rate.Limiter
+}
+
+var limiters = &limiterSet{
+	overrides: make(map[string]RateLimit),
+	limiters:  make(map[string]*rate.Limiter),
+}
+
+// METADATASUFFIX is appended to a domain to key its metadata rate limit
+const METADATASUFFIX = "/metadata"
+
+// SetRateLimit overrides the rate limit declared by a domain's provider.
+// Use the domain followed by METADATASUFFIX for its metadata endpoint.
+func SetRateLimit(domain string, limit RateLimit) {
+	limiters.mu.Lock()
+	defer limiters.mu.Unlock()
+
+	limiters.overrides[domain] = limit
+	delete(limiters.limiters, domain)
+}
+
+// wait blocks until the provider's domain has budget for another request
+func wait(ctx context.Context, p Provider) error {
+	return waitFor(ctx, p.Domain(), p.Capabilities().RateLimit)
+}
+
+// waitMetadata blocks until the provider's metadata endpoint has budget,
+// it is limited separately from the domain as a whole
+func waitMetadata(ctx context.Context, p Provider) error {
+	return waitFor(ctx, p.Domain()+METADATASUFFIX, p.Capabilities().MetadataRateLimit)
+}
+
+func waitFor(ctx context.Context, key string, fallback RateLimit) error {
+	limiter := limiterFor(key, fallback)
+	if limiter == nil {
+		return nil
+	}
+	return limiter.Wait(ctx)
+}
+
+func limiterFor(key string, fallback RateLimit) *rate.Limiter {
+	limiters.mu.Lock()
+	defer limiters.mu.Unlock()
+
+	if limiter, ok := limiters.limiters[key]; ok {
+		return limiter
+	}
+
+	limit, ok := limiters.overrides[key]
+	if !ok {
+		limit = fallback
+	}
+
+	var limiter *rate.Limiter
+	if limit.PerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(limit.PerSecond), max(limit.Burst, 1))
+	}
+	limiters.limiters[key] = limiter
+	return limiter
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,65 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoMetadata is returned when a domain has no metadata for an app,
+// e.g. a Steam app without a store page
+var ErrNoMetadata = errors.New("no metadata available")
+
+// Metadata describes an app beyond its name
+type Metadata struct {
+	Type        string
+	Genres      []string
+	Developers  []string
+	Publishers  []string
+	ReleaseDate time.Time // Zero when unreleased or unparseable
+	ReleaseText string    // Release date as published by the domain
+	ComingSoon  bool
+	IsFree      bool
+	Price       *Price // Nil when the app is free or has no price
+}
+
+// Price in the smallest unit of the currency
+type Price struct {
+	Currency        string
+	Initial         int
+	Final           int
+	DiscountPercent int
+}
+
+// FetchMetadata returns the metadata for an app using the provider
+// registered for its domain. Failures of a known class are returned as a
+// FetchError.
+func FetchMetadata(ctx context.Context, opts *Options, domain string, id int) (*Metadata, error) {
+	provider, err := Lookup(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataProvider, ok := provider.(MetadataProvider)
+	if !ok || !provider.Capabilities().Metadata {
+		return nil, fmt.Errorf("%s: %w", domain, ErrNotSupported)
+	}
+
+	if err = waitMetadata(ctx, provider); err != nil {
+		return nil, err
+	}
+	metadata, err := metadataProvider.FetchMetadata(ctx, resolveOptions(opts), id)
+	return metadata, classify(ctx, domain, err)
+}
+
+// MetadataDomains returns the registered domains that supply metadata
+func MetadataDomains() []string {
+	res := make([]string, 0)
+	for _, provider := range Providers() {
+		if _, ok := provider.(MetadataProvider); ok && provider.Capabilities().Metadata {
+			res = append(res, provider.Domain())
+		}
+	}
+	return res
+}
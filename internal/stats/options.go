@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Default settings for outbound requests
+const (
+	USERAGENT      = "tracula"
+	REQUESTTIMEOUT = 15
+)
+
+// Options configures how providers reach their domains
+type Options struct {
+	Client      *http.Client
+	BaseURLs    map[string]string // Base URL overrides keyed by domain
+	UserAgent   string
+	Timeout     time.Duration // Per request, applied through the request context
+	SteamAPIKey string        // Optional Steam Web API key
+}
+
+// DefaultOptions returns options pointing at the public domains
+func DefaultOptions() *Options {
+	return &Options{
+		Client:    &http.Client{},
+		BaseURLs:  make(map[string]string),
+		UserAgent: USERAGENT,
+		Timeout:   REQUESTTIMEOUT * time.Second,
+	}
+}
+
+// BaseURL returns the override for the key if set, otherwise the fallback
+func (o *Options) BaseURL(key string, fallback string) string {
+	if url, ok := o.BaseURLs[key]; ok && url != "" {
+		return url
+	}
+	return fallback
+}
+
+// Get issues a GET request with the configured client, user agent and timeout.
+// The caller is responsible for closing the response body.
+func (o *Options) Get(ctx context.Context, url string) (*http.Response, error) {
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var cancel context.CancelFunc = func() {}
+	if o.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if o.UserAgent != "" {
+		req.Header.Set("User-Agent", o.UserAgent)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the request timeout once the body has been consumed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func resolveOptions(opts *Options) *Options {
+	if opts == nil {
+		return DefaultOptions()
+	}
+	return opts
+}
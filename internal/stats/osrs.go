@@ -1,29 +1,52 @@
 package stats
 
 import (
+  "context"
+  "fmt"
   "github.com/PuerkitoBio/goquery"
   "net/http"
   "strconv"
   "strings"
-  "time"
 )
 
-// Steamcharts constants
+// OSRS constants
 const (
-	DOMAIN  = "https://oldschool.runescape.com/"
-	TIMEOUT = 15
+	DOMAIN = "https://oldschool.runescape.com/"
 )
 
-func fetchOsrs() (int, error) {
-	client := &http.Client{
-		Timeout: TIMEOUT * time.Second,
+// osrsProvider only exposes the single game population, so any app id
+// registered under the domain resolves to the same count
+type osrsProvider struct{}
+
+func (p *osrsProvider) Domain() string { return "osrs" }
+
+func (p *osrsProvider) Capabilities() Capabilities {
+	return Capabilities{
+		PlayerCount: true,
+		AppList:     false,
+		RateLimit:   RateLimit{PerSecond: 1, Burst: 1},
 	}
+}
+
+func (p *osrsProvider) FetchCount(ctx context.Context, opts *Options, id int) (int, error) {
+	return fetchOsrs(ctx, opts)
+}
 
+func (p *osrsProvider) FetchApps(ctx context.Context, opts *Options) (map[int]string, error) {
+	return nil, ErrNotSupported
+}
+
+func fetchOsrs(ctx context.Context, opts *Options) (int, error) {
 	res := 0
-	resp, err := client.Get(DOMAIN)
+	resp, err := opts.Get(ctx, opts.BaseURL("osrs", DOMAIN))
 	if err != nil {
 		return res, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return res, &StatusError{Domain: "osrs", StatusCode: resp.StatusCode}
+	}
 
 	document, err := goquery.NewDocumentFromReader(resp.Body)
 	if err != nil {
@@ -32,6 +55,9 @@ func fetchOsrs() (int, error) {
 
 	elem := document.Find(".player-count")
 	words := strings.Fields(elem.Text())
+	if len(words) < 4 {
+		return res, fmt.Errorf("%w: player count text %q", ErrParse, elem.Text())
+	}
 	playerCountStr := strings.ReplaceAll(words[3], ",", "")
 
 	res, err = strconv.Atoi(playerCountStr)
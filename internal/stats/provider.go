@@ -0,0 +1,101 @@
+package stats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrNotSupported is returned when a provider is asked for something its
+// capabilities do not cover
+var ErrNotSupported = errors.New("operation not supported by provider")
+
+// Capabilities describes what a provider is able to supply
+type Capabilities struct {
+	PlayerCount       bool      // FetchCount returns the current player count for an app
+	AppList           bool      // FetchApps returns the apps offered by the domain
+	Metadata          bool      // The provider implements MetadataProvider
+	RateLimit         RateLimit // Default outbound request budget for the domain
+	MetadataRateLimit RateLimit // Default budget for metadata requests
+}
+
+// Provider is a source of population data for a single domain
+type Provider interface {
+	// Domain is the key stored in StaticAppData.Domain
+	Domain() string
+	Capabilities() Capabilities
+	// FetchCount returns the current player count for the given app
+	FetchCount(ctx context.Context, opts *Options, id int) (int, error)
+	// FetchApps returns the domain's apps as an id -> name map
+	FetchApps(ctx context.Context, opts *Options) (map[int]string, error)
+}
+
+// MetadataProvider is implemented by providers that can describe an app
+// beyond its name, e.g. genres, developers and pricing
+type MetadataProvider interface {
+	Provider
+	// FetchMetadata returns ErrNoMetadata if the domain has nothing on the app
+	FetchMetadata(ctx context.Context, opts *Options, id int) (*Metadata, error)
+}
+
+type registry struct {
+	mu        sync.RWMutex
+	providers map[string]Provider
+}
+
+var defaultRegistry = &registry{providers: make(map[string]Provider)}
+
+func init() {
+	Register(&steamProvider{})
+	Register(&osrsProvider{})
+}
+
+// Register adds a provider to the registry, keyed by its domain.
+// A domain can only be registered once.
+func Register(p Provider) error {
+	if p == nil {
+		return errors.New("nil provider")
+	}
+	domain := p.Domain()
+	if domain == "" {
+		return errors.New("provider has an empty domain")
+	}
+
+	defaultRegistry.mu.Lock()
+	defer defaultRegistry.mu.Unlock()
+
+	if _, ok := defaultRegistry.providers[domain]; ok {
+		return fmt.Errorf("provider already registered for domain: %s", domain)
+	}
+	defaultRegistry.providers[domain] = p
+	return nil
+}
+
+// Lookup returns the provider registered for the domain
+func Lookup(domain string) (Provider, error) {
+	defaultRegistry.mu.RLock()
+	defer defaultRegistry.mu.RUnlock()
+
+	p, ok := defaultRegistry.providers[domain]
+	if !ok {
+		return nil, fmt.Errorf("Unknown domain: %s", domain)
+	}
+	return p, nil
+}
+
+// Providers returns every registered provider ordered by domain
+func Providers() []Provider {
+	defaultRegistry.mu.RLock()
+	defer defaultRegistry.mu.RUnlock()
+
+	var res []Provider
+	for _, p := range defaultRegistry.providers {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Domain() < res[j].Domain()
+	})
+	return res
+}
@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"context"
+	"testing"
+)
+
+type stubProvider struct {
+	domain string
+	count  int
+}
+
+func (p *stubProvider) Domain() string { return p.domain }
+
+func (p *stubProvider) Capabilities() Capabilities {
+	return Capabilities{PlayerCount: true}
+}
+
+func (p *stubProvider) FetchCount(ctx context.Context, opts *Options, id int) (int, error) {
+	return p.count, nil
+}
+
+func (p *stubProvider) FetchApps(ctx context.Context, opts *Options) (map[int]string, error) {
+	return nil, ErrNotSupported
+}
+
+// unregister drops a provider registered by a test from the global registry
+func unregister(domain string) {
+	defaultRegistry.mu.Lock()
+	defer defaultRegistry.mu.Unlock()
+	delete(defaultRegistry.providers, domain)
+}
+
+func TestRegister(t *testing.T) {
+	p := &stubProvider{domain: "stub", count: 42}
+	if err := Register(p); err != nil {
+		t.Fatalf("[FAIL] TestRegister: %s\n", err)
+	}
+	defer unregister("stub")
+	if err := Register(p); err == nil {
+		t.Errorf("[FAIL] TestRegister: duplicate domain accepted\n")
+	}
+
+	res, err := Fetch(context.Background(), nil, "stub", 1)
+	if err != nil || res != 42 {
+		t.Errorf("[FAIL] TestRegister: fetch returned %d, %v\n", res, err)
+	}
+
+	if _, err := Fetch(context.Background(), nil, "unknown", 1); err == nil {
+		t.Errorf("[FAIL] TestRegister: unknown domain accepted\n")
+	}
+
+	for _, provider := range Providers() {
+		if provider.Domain() == "stub" {
+			return
+		}
+	}
+	t.Errorf("[FAIL] TestRegister: provider missing from registry\n")
+}
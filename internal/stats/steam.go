@@ -1,9 +1,12 @@
 package stats
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 )
@@ -15,17 +18,20 @@ const (
 	POPULATIONINTERFACE = "ISteamUserStats"
 	POPULATIONFUNCTION  = "GetNumberOfCurrentPlayers"
 	POPULATIONVERSION   = "v1"
-	IDENTIFIER          = "?appid="
-	POPULATIONBASE      = STEAMDOMAIN + "/" + POPULATIONINTERFACE + "/" + POPULATIONFUNCTION + "/" + POPULATIONVERSION + "/" + IDENTIFIER
+	IDENTIFIER          = "appid"
+	POPULATIONPATH      = "/" + POPULATIONINTERFACE + "/" + POPULATIONFUNCTION + "/" + POPULATIONVERSION + "/"
 	// Apps
 	APPINTERFACE = "ISteamApps"
 	APPFUNCTION  = "GetAppList"
 	APPVERSION   = "v2"
-	APPBASE      = STEAMDOMAIN + "/" + APPINTERFACE + "/" + APPFUNCTION + "/" + APPVERSION
+	APPPATH      = "/" + APPINTERFACE + "/" + APPFUNCTION + "/" + APPVERSION
+	// Incremental apps, requires an API key
+	STOREINTERFACE = "IStoreService"
+	STOREVERSION   = "v1"
+	STOREAPPPATH   = "/" + STOREINTERFACE + "/" + APPFUNCTION + "/" + STOREVERSION + "/"
+	STOREPAGESIZE  = 10000
 )
 
-var myClient = &http.Client{Timeout: 10 * time.Second}
-
 // ResponseContainer json response from steam API
 type ResponseContainer struct {
 	Data DataContainer `json:"response"`
@@ -37,16 +43,61 @@ type DataContainer struct {
 	Result int `json:"result"`
 }
 
-func fetchSteam(id int) (int, error) {
-	url := POPULATIONBASE + strconv.Itoa(id)
+// STEAMRESULTOK is the result of a successful Web API call, apps without
+// player stats get another
+const STEAMRESULTOK = 1
+
+type steamProvider struct{}
+
+func (p *steamProvider) Domain() string { return "steam" }
+
+func (p *steamProvider) Capabilities() Capabilities {
+	return Capabilities{
+		PlayerCount: true,
+		AppList:     true,
+		Metadata:    true,
+		RateLimit:   RateLimit{PerSecond: 40, Burst: 40},
+		// The store allows roughly 200 requests every 5 minutes
+		MetadataRateLimit: RateLimit{PerSecond: 0.6, Burst: 5},
+	}
+}
+
+func (p *steamProvider) FetchCount(ctx context.Context, opts *Options, id int) (int, error) {
+	return fetchSteam(ctx, opts, id)
+}
+
+func (p *steamProvider) FetchApps(ctx context.Context, opts *Options) (map[int]string, error) {
+	return fetchSteamApps(ctx, opts)
+}
+
+// steamURL builds a Web API url, attaching the API key when one is configured
+func steamURL(opts *Options, path string, query url.Values) string {
+	if opts.SteamAPIKey != "" {
+		query.Set("key", opts.SteamAPIKey)
+	}
+	res := opts.BaseURL("steam", STEAMDOMAIN) + path
+	if len(query) > 0 {
+		res += "?" + query.Encode()
+	}
+	return res
+}
+
+func fetchSteam(ctx context.Context, opts *Options, id int) (int, error) {
+	query := url.Values{}
+	query.Set(IDENTIFIER, strconv.Itoa(id))
 
 	res := 0
-	r, err := myClient.Get(url)
+	r, err := opts.Get(ctx, steamURL(opts, POPULATIONPATH, query))
 	if err != nil {
 		return res, err
 	}
 	defer r.Body.Close()
 
+	// Apps without player stats are reported as not found, with a result
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusNotFound {
+		return res, &StatusError{Domain: "steam", StatusCode: r.StatusCode}
+	}
+
 	serialResult, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return res, err
@@ -54,9 +105,15 @@ func fetchSteam(id int) (int, error) {
 
 	var rc ResponseContainer
 	err = json.Unmarshal(serialResult, &rc)
+	if r.StatusCode == http.StatusNotFound && (err != nil || rc.Data.Result == 0) {
+		return res, &StatusError{Domain: "steam", StatusCode: r.StatusCode}
+	}
 	if err != nil {
 		return res, err
 	}
+	if rc.Data.Result != STEAMRESULTOK {
+		return res, fmt.Errorf("%w: result %d", ErrNoStats, rc.Data.Result)
+	}
 
 	res = rc.Data.Count
 	return res, nil
@@ -75,29 +132,134 @@ type AppDataContainer struct {
 	Name string `json:"name"`
 }
 
-func fetchSteamApps() (map[int]string, error) {
+func fetchSteamApps(ctx context.Context, opts *Options) (map[int]string, error) {
 	var appMap map[int]string = make(map[int]string)
-	url := APPBASE
 
-	r, err := myClient.Get(url)
+	r, err := opts.Get(ctx, steamURL(opts, APPPATH, url.Values{}))
 	if err != nil {
 		return appMap, err
 	}
+	defer r.Body.Close()
 
-	serialResult, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return appMap, err
+	if r.StatusCode != http.StatusOK {
+		return appMap, &StatusError{Domain: "steam", StatusCode: r.StatusCode}
 	}
 
-	var responseContainer AppResponseContainer
-	err = json.Unmarshal(serialResult, &responseContainer)
-	if err != nil {
+	// The full list is large, decode it element by element rather than
+	// buffering the whole payload
+	decoder := json.NewDecoder(r.Body)
+	for _, key := range []string{"applist", "apps"} {
+		if err = seekKey(decoder, key); err != nil {
+			return appMap, err
+		}
+	}
+	if _, err = decoder.Token(); err != nil { // Opening bracket of apps
 		return appMap, err
 	}
 
-	// Convert response to map
-	for _, element := range responseContainer.AppList.Apps {
+	for decoder.More() {
+		var element AppDataContainer
+		if err = decoder.Decode(&element); err != nil {
+			return appMap, err
+		}
 		appMap[element.ID] = element.Name
 	}
 	return appMap, nil
 }
+
+// seekKey advances the decoder into the next object and past the given key,
+// skipping the values of any other keys on the way
+func seekKey(decoder *json.Decoder, key string) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected object containing %q", key)
+	}
+
+	for decoder.More() {
+		token, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+		if token == key {
+			return nil
+		}
+		var skip json.RawMessage
+		if err = decoder.Decode(&skip); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("key %q not found", key)
+}
+
+// StoreAppResponseContainer json response from IStoreService/GetAppList
+type StoreAppResponseContainer struct {
+	Data StoreAppDataContainer `json:"response"`
+}
+
+type StoreAppDataContainer struct {
+	Apps []struct {
+		ID           int    `json:"appid"`
+		Name         string `json:"name"`
+		LastModified int64  `json:"last_modified"`
+	} `json:"apps"`
+	HaveMoreResults bool `json:"have_more_results"`
+	LastAppID       int  `json:"last_appid"`
+}
+
+func (p *steamProvider) FetchAppPage(ctx context.Context, opts *Options, since time.Time, lastAppID int) (*AppPage, error) {
+	return fetchSteamAppPage(ctx, opts, since, lastAppID)
+}
+
+// Incremental listings go through the store service, which requires an API key
+func (p *steamProvider) Incremental(opts *Options) bool {
+	return opts.SteamAPIKey != ""
+}
+
+func fetchSteamAppPage(ctx context.Context, opts *Options, since time.Time, lastAppID int) (*AppPage, error) {
+	if opts.SteamAPIKey == "" {
+		return nil, fmt.Errorf("steam incremental app list requires an API key: %w", ErrNotSupported)
+	}
+
+	query := url.Values{}
+	query.Set("include_games", "true")
+	query.Set("include_dlc", "true")
+	query.Set("include_software", "true")
+	query.Set("max_results", strconv.Itoa(STOREPAGESIZE))
+	query.Set("last_appid", strconv.Itoa(lastAppID))
+	if !since.IsZero() {
+		query.Set("if_modified_since", strconv.FormatInt(since.Unix(), 10))
+	}
+
+	r, err := opts.Get(ctx, steamURL(opts, STOREAPPPATH, query))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, &StatusError{Domain: "steam", StatusCode: r.StatusCode}
+	}
+
+	var responseContainer StoreAppResponseContainer
+	if err = json.NewDecoder(r.Body).Decode(&responseContainer); err != nil {
+		return nil, err
+	}
+
+	data := responseContainer.Data
+	page := AppPage{
+		Apps:      make([]AppEntry, 0, len(data.Apps)),
+		LastAppID: data.LastAppID,
+		HaveMore:  data.HaveMoreResults,
+	}
+	for _, element := range data.Apps {
+		page.Apps = append(page.Apps, AppEntry{
+			ID:           element.ID,
+			Name:         element.Name,
+			LastModified: time.Unix(element.LastModified, 0).UTC(),
+		})
+	}
+	return &page, nil
+}
@@ -0,0 +1,111 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Steam store constants
+const (
+	STEAMSTOREDOMAIN = "https://store.steampowered.com"
+	APPDETAILSPATH   = "/api/appdetails"
+)
+
+// Release date layouts used by the store, depending on region
+var releaseDateLayouts = []string{"2 Jan, 2006", "Jan 2, 2006", "Jan 2006"}
+
+// AppDetailsContainer json response from the store appdetails endpoint
+type AppDetailsContainer struct {
+	Success bool           `json:"success"`
+	Data    AppDetailsData `json:"data"`
+}
+
+type AppDetailsData struct {
+	Type       string   `json:"type"`
+	IsFree     bool     `json:"is_free"`
+	Developers []string `json:"developers"`
+	Publishers []string `json:"publishers"`
+	Genres     []struct {
+		Description string `json:"description"`
+	} `json:"genres"`
+	ReleaseDate struct {
+		ComingSoon bool   `json:"coming_soon"`
+		Date       string `json:"date"`
+	} `json:"release_date"`
+	PriceOverview *struct {
+		Currency        string `json:"currency"`
+		Initial         int    `json:"initial"`
+		Final           int    `json:"final"`
+		DiscountPercent int    `json:"discount_percent"`
+	} `json:"price_overview"`
+}
+
+func (p *steamProvider) FetchMetadata(ctx context.Context, opts *Options, id int) (*Metadata, error) {
+	return fetchSteamMetadata(ctx, opts, id)
+}
+
+func fetchSteamMetadata(ctx context.Context, opts *Options, id int) (*Metadata, error) {
+	appID := strconv.Itoa(id)
+	query := url.Values{}
+	query.Set("appids", appID)
+
+	r, err := opts.Get(ctx, opts.BaseURL("steam_store", STEAMSTOREDOMAIN)+APPDETAILSPATH+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, &StatusError{Domain: "steam", StatusCode: r.StatusCode}
+	}
+
+	serialResult, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keyed by the requested app id
+	var responseContainer map[string]AppDetailsContainer
+	err = json.Unmarshal(serialResult, &responseContainer)
+	if err != nil {
+		return nil, err
+	}
+
+	details, ok := responseContainer[appID]
+	if !ok || !details.Success {
+		return nil, ErrNoMetadata
+	}
+
+	data := details.Data
+	metadata := Metadata{
+		Type:        data.Type,
+		Developers:  data.Developers,
+		Publishers:  data.Publishers,
+		ReleaseText: data.ReleaseDate.Date,
+		ComingSoon:  data.ReleaseDate.ComingSoon,
+		IsFree:      data.IsFree,
+	}
+	for _, genre := range data.Genres {
+		metadata.Genres = append(metadata.Genres, genre.Description)
+	}
+	for _, layout := range releaseDateLayouts {
+		if date, err := time.Parse(layout, data.ReleaseDate.Date); err == nil {
+			metadata.ReleaseDate = date
+			break
+		}
+	}
+	if data.PriceOverview != nil {
+		metadata.Price = &Price{
+			Currency:        data.PriceOverview.Currency,
+			Initial:         data.PriceOverview.Initial,
+			Final:           data.PriceOverview.Final,
+			DiscountPercent: data.PriceOverview.DiscountPercent,
+		}
+	}
+	return &metadata, nil
+}
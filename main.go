@@ -1,34 +1,179 @@
 package tracula 
 
 import (
+  "io"
+  "time"
+  "github.com/j-leg/tracula/internal/archive"
+  "github.com/j-leg/tracula/internal/backfill"
   "github.com/j-leg/tracula/internal/core"
+  "github.com/j-leg/tracula/internal/db"
+  "github.com/j-leg/tracula/internal/stats"
   "github.com/j-leg/tracula/config"
 )
 
+// Provider is a source of population data for a single domain.
+// Implement it to track apps from domains tracula does not know about.
+type Provider = stats.Provider
+
+// Capabilities describes what a Provider is able to supply
+type Capabilities = stats.Capabilities
+
+// RegisterProvider makes a provider available to every job, keyed by
+// its domain. Call it before executing any job.
+func RegisterProvider(p Provider) error {
+  return stats.Register(p)
+}
+
+// RateLimit is a token bucket budget for outbound requests to a domain
+type RateLimit = stats.RateLimit
+
+// SetRateLimit overrides the request budget a provider declares for its domain
+func SetRateLimit(domain string, limit RateLimit) {
+  stats.SetRateLimit(domain, limit)
+}
+
+// FetchOptions configures the HTTP client, base URLs, user agent, timeout
+// and API keys used by providers. Set it on config.Config.Fetch.
+type FetchOptions = stats.Options
+
+// DefaultFetchOptions returns options pointing at the public domains
+func DefaultFetchOptions() *FetchOptions {
+  return stats.DefaultOptions()
+}
+
+// FetchError is a fetch failure of a known class. Transient and rate limited
+// failures are retried by jobs under config.Config.Retry.
+type FetchError = stats.FetchError
+
+// Classes of fetch errors, check for them with errors.Is
+var (
+  ErrTransient   = stats.ErrTransient
+  ErrRateLimited = stats.ErrRateLimited
+  ErrAppNotFound = stats.ErrAppNotFound
+  ErrParse       = stats.ErrParse
+  ErrNoStats     = stats.ErrNoStats
+)
+
+// JobReport is the report of a job invocation, also kept in the store's job
+// run history when it has one
+type JobReport = db.JobRun
+
+// DomainCounts breaks a job report down by domain
+type DomainCounts = db.DomainCounts
+
+// Diff lists the writes a dry run would have made, set config.Config.DryRun
+// to run a job without writing
+type Diff = db.Diff
+
+// Job types, as found on job reports
+const (
+  DAILY    = db.DAILY
+  MONTHLY  = db.MONTHLY
+  RECOVERY = db.RECOVERY
+  REFRESH  = db.REFRESH
+  TRACK    = db.TRACK
+  ENRICH   = db.ENRICH
+  ANYJOB   = db.ANYJOB
+)
+
+// ErrAlreadyRunning is returned by a job another invocation is running,
+// check for it with errors.Is
+var ErrAlreadyRunning = core.ErrAlreadyRunning
 
 // Execute : Core execution for daily updates
 // Update all apps
-func ExecuteDaily(cfg *config.Config) {
-  core.Daily(cfg)
+func ExecuteDaily(cfg *config.Config) (*JobReport, error) {
+  return core.Daily(cfg)
 }
 
 // ExecuteMonthly : Monthly process
-func ExecuteMonthly(cfg *config.Config) {
-  core.Monthly(cfg)
+func ExecuteMonthly(cfg *config.Config) (*JobReport, error) {
+  return core.Monthly(cfg)
 }
 
 // ExecuteTracker runs a job to aggregate any apps that are worth tracking
-func ExecuteTracker(cfg *config.Config) {
-  core.Track(cfg)
+func ExecuteTracker(cfg *config.Config) (*JobReport, error) {
+  return core.Track(cfg)
 }
 
 // ExecuteRefresh updates the app library
-func ExecuteRefresh(cfg *config.Config) {
-  core.Refresh(cfg)
+func ExecuteRefresh(cfg *config.Config) (*JobReport, error) {
+  return core.Refresh(cfg)
+}
+
+// ExecuteEnrich refreshes store metadata (genres, developers, release date,
+// price) for apps whose metadata is missing or stale
+func ExecuteEnrich(cfg *config.Config) (*JobReport, error) {
+  return core.Enrich(cfg)
+}
+
+// GetJobReports returns up to limit reports of the job type, or of every job
+// for ANYJOB, newest first
+func GetJobReports(cfg *config.Config, jobType int, limit int) ([]JobReport, error) {
+  return cfg.Store.ListJobRuns(cfg.Ctx, jobType, limit)
+}
+
+// Shard selects the apps one of several parallel invocations of a job runs
+// over. Set it on config.Config.Shard, along with the same config.Config.RunID
+// on every shard.
+type Shard = db.Shard
+
+// GetRunReport aggregates the reports of every shard and resumed invocation
+// of a run into one, complete once every shard has completed
+func GetRunReport(cfg *config.Config, runID string) (*JobReport, error) {
+  return core.RunReport(cfg, runID)
+}
+
+// ImportReport summarises a historical import
+type ImportReport = core.ImportReport
+
+// ImportHistory merges historical player counts into the library, format is
+// "csv" or "json". Records carry domain, app_id, timestamp and at least one of
+// count, avg_players (monthly average) and peak (monthly peak).
+func ImportHistory(cfg *config.Config, r io.Reader, format string) (*ImportReport, error) {
+  records, err := backfill.Read(r, format)
+  if err != nil { return nil, err }
+  return core.Backfill(cfg, records), nil
+}
+
+// ArchiveSink stores the cold archive of samples past the retention limit,
+// as gzipped JSONL files partitioned by domain and month. Implement it to
+// archive to an object store and set it on config.Config.Archive.
+type ArchiveSink = archive.Sink
+
+// NewDirArchive returns a sink archiving to a local directory
+func NewDirArchive(root string) ArchiveSink {
+  return archive.NewDir(root)
+}
+
+// RestoreReport summarises the re-import of an archived partition
+type RestoreReport = core.RestoreReport
+
+// RestoreArchive re-imports the domain's archived samples for the month
+// containing month, skipping days the app already has a sample for. Restored
+// samples are past the retention limit, the next monthly job archives them again.
+func RestoreArchive(cfg *config.Config, domain string, month time.Time) (*RestoreReport, error) {
+  return core.RestoreArchive(cfg, domain, month)
 }
 
 // ExecuteRecovery : Best effort to retry all exception instances
-func ExecuteRecovery(cfg *config.Config) {
-  core.Recover(cfg)
+func ExecuteRecovery(cfg *config.Config) (*JobReport, error) {
+  return core.Recover(cfg)
 }
 
+// MigrationStatus reports whether a schema migration has been applied
+type MigrationStatus = db.MigrationStatus
+
+// MigrateUp applies the pending schema migrations in order and returns the
+// ones applied. Run it after upgrading, before executing any job.
+func MigrateUp(cfg *config.Config) ([]MigrationStatus, error) {
+  return core.MigrateUp(cfg)
+}
+
+// GetMigrationStatus lists every schema migration, whether it has been
+// applied, and the current schema version
+func GetMigrationStatus(cfg *config.Config) ([]MigrationStatus, int, error) {
+  statusList, err := cfg.Store.MigrationStatus(cfg.Ctx)
+  if err != nil { return nil, 0, err }
+  return statusList, core.SchemaVersion(statusList), nil
+}
@@ -0,0 +1,123 @@
+// Package query reads back the data the tracula jobs write, so consumers do
+// not have to query the store's schema themselves
+package query
+
+import (
+	"context"
+	"time"
+
+	"github.com/j-leg/tracula/config"
+	"github.com/j-leg/tracula/internal/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Types returned by the reader
+type (
+	App           = db.App
+	StaticAppData = db.StaticAppData
+	DailyMetric   = db.DailyMetric
+	Metric        = db.Metric
+	RankedApp     = db.RankedApp
+)
+
+// ErrNotFound is returned when the library has no such app
+var ErrNotFound = db.ErrNotFound
+
+const (
+	DEFAULTLIMIT = 50   // Used when a limit of 0 or less is given
+	MAXLIMIT     = 1000 // Larger limits are capped
+)
+
+// Reader runs read-only queries against a config's store
+type Reader struct {
+	store db.Store
+}
+
+// NewReader returns a reader over the store the config writes to
+func NewReader(cfg *config.Config) *Reader {
+	return &Reader{store: cfg.Store}
+}
+
+func clampLimit(limit int) int {
+	if limit <= 0 {
+		return DEFAULTLIMIT
+	}
+	if limit > MAXLIMIT {
+		return MAXLIMIT
+	}
+	return limit
+}
+
+// GetApp returns the app with the given domain and app id, its monthly
+// metrics included
+func (r *Reader) GetApp(ctx context.Context, domain string, appID int) (*App, error) {
+	return r.store.FindApp(ctx, domain, appID)
+}
+
+// SearchApps returns apps whose name contains text, ignoring case
+func (r *Reader) SearchApps(ctx context.Context, text string, limit int) ([]*App, error) {
+	return r.store.SearchApps(ctx, text, clampLimit(limit))
+}
+
+// ListTracked returns a page of tracked apps in id order, after is the hex id
+// of the last app of the previous page or empty for the first page
+func (r *Reader) ListTracked(ctx context.Context, after string, limit int) ([]*App, error) {
+	filter := db.AppFilter{TrackedOnly: true}
+	if after != "" {
+		afterID, err := primitive.ObjectIDFromHex(after)
+		if err != nil {
+			return nil, err
+		}
+		filter.AfterID = afterID
+	}
+
+	limit = clampLimit(limit)
+	_, cursor, err := r.store.IterateApps(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	apps := make([]*App, 0, limit)
+	for len(apps) < limit && cursor.Next(ctx) {
+		app, err := cursor.App()
+		if err != nil {
+			return apps, err
+		}
+		apps = append(apps, app)
+	}
+	return apps, cursor.Err()
+}
+
+// TopByPlayerCount ranks tracked apps on their last sampled player count
+func (r *Reader) TopByPlayerCount(ctx context.Context, limit int) ([]RankedApp, error) {
+	return r.store.TopByPlayerCount(ctx, clampLimit(limit))
+}
+
+// TopByMonthlyAverage ranks apps on their average players over the month
+// containing month
+func (r *Reader) TopByMonthlyAverage(ctx context.Context, month time.Time, limit int) ([]RankedApp, error) {
+	month = month.UTC()
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return r.store.TopByMonthlyAverage(ctx, start, clampLimit(limit))
+}
+
+// DailySeries returns the app's samples dated in [from, to), a zero to
+// leaves the range open ended
+func (r *Reader) DailySeries(ctx context.Context, domain string, appID int, from time.Time, to time.Time) ([]DailyMetric, error) {
+	app, err := r.store.FindApp(ctx, domain, appID)
+	if err != nil {
+		return nil, err
+	}
+	return r.store.GetDailyMetrics(ctx, app.ID, from, to)
+}
+
+// MonthlySeries returns the app's monthly metrics dated in [from, to), a
+// zero to leaves the range open ended
+func (r *Reader) MonthlySeries(ctx context.Context, domain string, appID int, from time.Time, to time.Time) ([]Metric, error) {
+	app, err := r.store.FindApp(ctx, domain, appID)
+	if err != nil {
+		return nil, err
+	}
+	return r.store.GetMetrics(ctx, app.ID, from, to)
+}
@@ -0,0 +1,81 @@
+package query
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/j-leg/tracula/config"
+	"github.com/j-leg/tracula/internal/db"
+)
+
+func TestReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracula")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	cfg, err := config.InitSQLiteConfig(ctx, filepath.Join(dir, "tracula.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cfg.Store.Close(ctx)
+
+	month := time.Date(2020, time.March, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"Counter-Strike", "Counter-Strike: Source", "Dota 2"} {
+		app := db.App{StaticData: db.StaticAppData{Name: name, AppID: 10 * (i + 1), Domain: "steam"}}
+		if err = cfg.Store.InsertApp(ctx, &app); err != nil {
+			t.Fatal(err)
+		}
+		if err = cfg.Store.SetTrackFlag(ctx, app.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		sample := db.DailyMetric{Date: month.AddDate(0, 0, 1), PlayerCount: 100 * (i + 1)}
+		if err = cfg.Store.AppendDailyMetric(ctx, app.ID, sample); err != nil {
+			t.Fatal(err)
+		}
+		metric := db.Metric{Date: month, AvgPlayers: 300 - 100*i, NoPrevious: true}
+		if err = cfg.Store.AppendMetric(ctx, app.ID, metric, time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader := NewReader(cfg)
+
+	found, err := reader.SearchApps(ctx, "counter-strike", 0)
+	if err != nil || len(found) != 2 || found[0].StaticData.Name != "Counter-Strike" {
+		t.Errorf("[FAIL] TestReader: unexpected search results %+v %v\n", found, err)
+	}
+
+	top, err := reader.TopByPlayerCount(ctx, 1)
+	if err != nil || len(top) != 1 || top[0].StaticData.Name != "Dota 2" || top[0].Value != 300 {
+		t.Errorf("[FAIL] TestReader: unexpected top by player count %+v %v\n", top, err)
+	}
+
+	top, err = reader.TopByMonthlyAverage(ctx, month.AddDate(0, 0, 14), 2)
+	if err != nil || len(top) != 2 || top[0].StaticData.Name != "Counter-Strike" || top[0].Value != 300 {
+		t.Errorf("[FAIL] TestReader: unexpected top by monthly average %+v %v\n", top, err)
+	}
+
+	page, err := reader.ListTracked(ctx, "", 2)
+	if err != nil || len(page) != 2 {
+		t.Fatalf("[FAIL] TestReader: unexpected first page %+v %v\n", page, err)
+	}
+	page, err = reader.ListTracked(ctx, page[1].ID.Hex(), 2)
+	if err != nil || len(page) != 1 {
+		t.Errorf("[FAIL] TestReader: unexpected second page %+v %v\n", page, err)
+	}
+
+	series, err := reader.MonthlySeries(ctx, "steam", 10, month, month.AddDate(0, 1, 0))
+	if err != nil || len(series) != 1 || series[0].AvgPlayers != 300 {
+		t.Errorf("[FAIL] TestReader: unexpected monthly series %+v %v\n", series, err)
+	}
+	if _, err = reader.DailySeries(ctx, "steam", 99, time.Time{}, time.Time{}); err != ErrNotFound {
+		t.Errorf("[FAIL] TestReader: expected ErrNotFound, got %v\n", err)
+	}
+}